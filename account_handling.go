@@ -0,0 +1,371 @@
+package main
+
+import (
+	"database/sql"
+	"html/template"
+	"log"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+)
+
+const defaultCurrency = "RUB"
+
+var currencyCodePattern = regexp.MustCompile("^[A-Z]{3}$")
+
+// Account - element of corresponding table with the balance calculated from
+// transactions, MissingRates of them have no rate to the account currency and
+// are not in the balance
+type Account struct {
+	ID             int
+	Name           string
+	Currency       string
+	OpeningBalance Money
+	Balance        Money
+	MissingRates   int
+}
+
+// AccountEntry - transaction as it changes the balance of one account
+type AccountEntry struct {
+	ID           int
+	Date         time.Time
+	Kind         string
+	CategoryName string
+	Amount       *Money
+	Comment      string
+	Balance      Money
+}
+
+// AccountViewData - information to display on page
+type AccountViewData struct {
+	LayoutData
+	Title            string
+	Accounts         []Account
+	ErrorDescription string
+}
+
+// AccountEditorViewData - information to display on page
+type AccountEditorViewData struct {
+	LayoutData
+	Title            string
+	Account          Account
+	ErrorDescription string
+}
+
+// AccountReportViewData - information to display on page
+type AccountReportViewData struct {
+	LayoutData
+	Title    string
+	Accounts []Account
+	Account  Account
+	Entries  []AccountEntry
+}
+
+// signedAmountSQL returns the expression for the change of the balance of
+// the account made by the transaction t, converted to the account currency
+func signedAmountSQL(account string, currency string) string {
+	amount := convertedAmountSQL(currency)
+	return `
+	CASE
+		WHEN t.kind = 'income' THEN ` + amount + `
+		WHEN t.kind = 'expense' THEN -` + amount + `
+		WHEN t.kind = 'transfer' AND t.to_account = ` + account + ` THEN ` + amount + `
+		WHEN t.kind = 'transfer' THEN -` + amount + `
+	END`
+}
+
+func allAccountsView(w http.ResponseWriter, r *http.Request, userID int) {
+	accounts, err := getAllAccountsOfUser(database, userID)
+	if err != nil {
+		log.Println("Query accounts failed", err)
+	}
+
+	data := AccountViewData{
+		Title:            "Счета",
+		Accounts:         accounts,
+		ErrorDescription: allErrors[getErrorCode(r)],
+	}
+	tmpl, _ := template.ParseFiles("templates/layout.html", "templates/accounts.html", "templates/navigation_logedin.html")
+	renderLayout(w, r, tmpl, &data)
+}
+
+func editAccountView(w http.ResponseWriter, r *http.Request, userID int) {
+	accountIDs := r.URL.Query()["account-id"]
+	var accountID int64
+	if len(accountIDs) > 0 {
+		var err error
+		accountID, err = strconv.ParseInt(accountIDs[0], 10, 32)
+		if err != nil {
+			log.Println(err)
+		}
+	}
+
+	var account Account
+	err := database.QueryRowx(
+		"SELECT id, name, currency, opening_balance AS openingbalance FROM accounts WHERE id = $1 AND user_id = $2",
+		accountID, userID,
+	).StructScan(&account)
+	if err != nil {
+		log.Println(err)
+		http.Redirect(w, r, "/accounts", 302)
+		return
+	}
+
+	data := AccountEditorViewData{
+		Title:            "Счета",
+		Account:          account,
+		ErrorDescription: allErrors[getErrorCode(r)],
+	}
+	tmpl, _ := template.ParseFiles("templates/layout.html", "templates/accounts_editor.html", "templates/navigation_logedin.html")
+	renderLayout(w, r, tmpl, &data)
+}
+
+// parseAccountForm returns the account from the form and the error code if it is invalid
+func parseAccountForm(r *http.Request) (account Account, errorCode int) {
+	account.Name = strings.TrimSpace(r.FormValue("account-name"))
+	if account.Name == "" {
+		return account, 22
+	}
+	var ok bool
+	account.Currency, ok = parseCurrency(r.FormValue("account-currency"), defaultCurrency)
+	if !ok {
+		return account, 20
+	}
+	if openingBalance := r.FormValue("opening-balance"); openingBalance != "" {
+		value, err := ParseMoney(openingBalance)
+		if err != nil {
+			log.Println(err)
+			return account, 5
+		}
+		account.OpeningBalance = value
+	}
+	return account, 0
+}
+
+func addNewAccount(w http.ResponseWriter, r *http.Request, userID int) {
+	err := r.ParseForm()
+	if err != nil {
+		log.Println(err)
+		http.Redirect(w, r, "/accounts?error=3", 302)
+		return
+	}
+	account, errorCode := parseAccountForm(r)
+	if errorCode != 0 {
+		http.Redirect(w, r, "/accounts?error="+strconv.Itoa(errorCode), 302)
+		return
+	}
+
+	_, err = database.Exec(
+		"INSERT INTO accounts(name, currency, opening_balance, user_id) VALUES ($1, $2, $3, $4)",
+		account.Name, account.Currency, account.OpeningBalance, userID,
+	)
+	if err != nil {
+		log.Println(err)
+		http.Redirect(w, r, "/accounts?error=6", 302)
+		return
+	}
+	http.Redirect(w, r, "/accounts", 302)
+}
+
+func editAccount(w http.ResponseWriter, r *http.Request, userID int) {
+	err := r.ParseForm()
+	if err != nil {
+		log.Println(err)
+		http.Redirect(w, r, "/accounts?error=3", 302)
+		return
+	}
+	accountID := r.FormValue("account-id")
+	account, errorCode := parseAccountForm(r)
+	if errorCode != 0 {
+		http.Redirect(w, r, "/accounts/edit?account-id="+accountID+"&error="+strconv.Itoa(errorCode), 302)
+		return
+	}
+
+	_, err = database.Exec(
+		"UPDATE accounts SET name = $1, currency = $2, opening_balance = $3 WHERE id = $4 AND user_id = $5",
+		account.Name, account.Currency, account.OpeningBalance, accountID, userID,
+	)
+	if err != nil {
+		log.Println(err)
+		http.Redirect(w, r, "/accounts?error=6", 302)
+		return
+	}
+	http.Redirect(w, r, "/accounts", 302)
+}
+
+func deleteAccount(w http.ResponseWriter, r *http.Request, userID int) {
+	err := r.ParseForm()
+	if err != nil {
+		log.Println(err)
+	}
+	accountID := r.FormValue("account-id")
+
+	// Transactions reference accounts with ON DELETE RESTRICT, so the history
+	// is never lost silently
+	_, err = database.Exec(
+		"DELETE FROM accounts WHERE id = $1 AND user_id = $2",
+		accountID, userID,
+	)
+	if err != nil {
+		log.Println(err)
+		http.Redirect(w, r, "/accounts?error=21", 302)
+		return
+	}
+	http.Redirect(w, r, "/accounts", 302)
+}
+
+func accountReportView(w http.ResponseWriter, r *http.Request, userID int) {
+	accounts, err := getAllAccountsOfUser(database, userID)
+	if err != nil {
+		log.Println("Query accounts failed", err)
+	}
+
+	data := AccountReportViewData{
+		Title:    "Отчеты",
+		Accounts: accounts,
+		Entries:  []AccountEntry{},
+	}
+	if len(accounts) > 0 {
+		data.Account = accounts[0]
+		accountID, err := strconv.Atoi(r.URL.Query().Get("account-id"))
+		if err == nil {
+			for _, account := range accounts {
+				if account.ID == accountID {
+					data.Account = account
+				}
+			}
+		}
+		data.Entries, err = getAccountEntries(database, data.Account, userID)
+		if err != nil {
+			log.Println("Query account entries failed", err)
+		}
+	}
+
+	tmpl, err := template.ParseFiles("templates/layout.html", "templates/reports_accounts.html", "templates/navigation_logedin.html")
+	if err != nil {
+		log.Println(err)
+	}
+	err = renderLayout(w, r, tmpl, &data)
+	if err != nil {
+		log.Println(err)
+	}
+}
+
+func getAllAccountsOfUser(db *sqlx.DB, userID int) (accounts []Account, err error) {
+	accounts = []Account{}
+	err = db.Select(&accounts, `
+	SELECT a.id, a.name, a.currency, a.opening_balance AS openingbalance,
+		a.opening_balance + COALESCE((
+			SELECT SUM(`+signedAmountSQL("a.id", "a.currency")+`)
+			FROM transactions t
+			WHERE t.account = a.id OR t.to_account = a.id
+		), 0) AS balance,
+		(
+			SELECT COUNT(*)
+			FROM transactions t
+			WHERE (t.account = a.id OR t.to_account = a.id) AND `+signedAmountSQL("a.id", "a.currency")+` IS NULL
+		) AS missingrates
+	FROM accounts a
+	WHERE a.user_id = $1 ORDER BY a.name
+	`, userID)
+	return accounts, err
+}
+
+// getAccountEntries returns transactions of the account, newest first, with
+// the balance after each of them
+func getAccountEntries(db *sqlx.DB, account Account, userID int) (entries []AccountEntry, err error) {
+	entries = []AccountEntry{}
+	err = db.Select(&entries, `
+	SELECT id, date, kind, categoryname, comment, amount,
+		$2::numeric + SUM(amount) OVER (ORDER BY date, id) AS balance
+	FROM (
+		SELECT t.id, t.date, t.kind, `+transactionCategoryNameSQL+` AS categoryname,
+			COALESCE(t.comment, '') AS comment, `+signedAmountSQL("$1", "$4")+` AS amount
+		FROM transactions t
+		LEFT JOIN categories c
+		ON t.category = c.id
+		WHERE t.user_id = $3 AND (t.account = $1 OR t.to_account = $1)
+	) AS entries
+	ORDER BY date DESC, id DESC
+	`, account.ID, account.OpeningBalance, userID, account.Currency)
+	return entries, err
+}
+
+func getAccountCurrency(accountID int32) (currency string, err error) {
+	err = database.QueryRowx("SELECT currency FROM accounts WHERE id = $1", accountID).Scan(&currency)
+	return currency, err
+}
+
+// parseTransactionCurrency returns the currency of the form or API input,
+// transactions are made in the account currency unless another one is given
+func parseTransactionCurrency(value string, account int32) (currency string, errorCode int) {
+	accountCurrency, err := getAccountCurrency(account)
+	if err != nil {
+		log.Println(err)
+		accountCurrency = defaultCurrency
+	}
+	currency, ok := parseCurrency(value, accountCurrency)
+	if !ok {
+		return currency, 20
+	}
+	return currency, 0
+}
+
+func isAccountOfUser(accountID int32, userID int) (bool, error) {
+	var exists bool
+	err := database.QueryRowx(
+		"SELECT EXISTS(SELECT 1 FROM accounts WHERE id = $1 AND user_id = $2)",
+		accountID, userID,
+	).Scan(&exists)
+	return exists, err
+}
+
+// validateTransactionAccounts checks that the accounts belong to the user,
+// the target account is kept only for transfers
+func validateTransactionAccounts(kind string, account int32, toAccount int32, userID int) (target sql.NullInt32, errorCode int) {
+	exists, err := isAccountOfUser(account, userID)
+	if err != nil {
+		log.Println(err)
+	}
+	if !exists {
+		return target, 18
+	}
+	if kind != kindTransfer {
+		return target, 0
+	}
+
+	if toAccount == account {
+		return target, 19
+	}
+	exists, err = isAccountOfUser(toAccount, userID)
+	if err != nil {
+		log.Println(err)
+	}
+	if !exists {
+		return target, 19
+	}
+	return sql.NullInt32{Int32: toAccount, Valid: true}, 0
+}
+
+// parseTransactionAccounts reads account-id and to-account-id of transaction forms
+func parseTransactionAccounts(r *http.Request, kind string, userID int) (account int32, toAccount sql.NullInt32, errorCode int) {
+	accountID, err := strconv.ParseInt(r.FormValue("account-id"), 10, 32)
+	if err != nil {
+		log.Println(err)
+		return 0, toAccount, 18
+	}
+	var toAccountID int64
+	if kind == kindTransfer {
+		toAccountID, err = strconv.ParseInt(r.FormValue("to-account-id"), 10, 32)
+		if err != nil {
+			log.Println(err)
+			return 0, toAccount, 19
+		}
+	}
+	toAccount, errorCode = validateTransactionAccounts(kind, int32(accountID), int32(toAccountID), userID)
+	return int32(accountID), toAccount, errorCode
+}
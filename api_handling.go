@@ -0,0 +1,745 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+const (
+	defaultPageLimit = 50
+	maxPageLimit     = 500
+)
+
+// APIError - error object returned by the JSON API
+type APIError struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+// APIErrorResponse - envelope of the error object
+type APIErrorResponse struct {
+	Error APIError `json:"error"`
+}
+
+// APIPage - one page of a list endpoint
+type APIPage struct {
+	Items  interface{} `json:"items"`
+	Limit  int         `json:"limit"`
+	Offset int         `json:"offset"`
+	Total  int         `json:"total"`
+}
+
+// APITransaction - transaction as it is sent and received by the JSON API
+type APITransaction struct {
+	ID        int    `json:"id"`
+	Date      string `json:"date"`
+	Kind      string `json:"kind"`
+	Account   int32  `json:"account"`
+	ToAccount *int32 `json:"to_account,omitempty"`
+	Category  int32  `json:"category"`
+	Amount    Money  `json:"amount"`
+	Currency  string `json:"currency"`
+	Comment   string `json:"comment"`
+}
+
+// APIBuckets - sums of transactions by time buckets and categories
+type APIBuckets struct {
+	Unit         string         `json:"unit"`
+	From         string         `json:"from"`
+	To           string         `json:"to"`
+	Kind         string         `json:"kind"`
+	BaseCurrency string         `json:"base_currency"`
+	Items        []BucketAmount `json:"items"`
+}
+
+// APICategory - category as it is sent and received by the JSON API
+type APICategory struct {
+	ID       int    `json:"id"`
+	Name     string `json:"name"`
+	Parent   int    `json:"parent"`
+	Archived bool   `json:"archived"`
+}
+
+// APISession - session as it is sent by the JSON API
+type APISession struct {
+	ID        int       `json:"id"`
+	Initiated time.Time `json:"initiated"`
+	Expires   time.Time `json:"expires"`
+	IP        string    `json:"ip"`
+	UserAgent string    `json:"user_agent"`
+	Token     string    `json:"token,omitempty"`
+	CSRFToken string    `json:"csrf_token,omitempty"`
+	Current   bool      `json:"current"`
+}
+
+// APILogin - credentials to open a new session
+type APILogin struct {
+	Email      string `json:"email"`
+	Password   string `json:"password"`
+	Code       string `json:"code"`
+	RememberMe bool   `json:"remember_me"`
+}
+
+func registerAPIRoutes(router *mux.Router) {
+	api := router.PathPrefix("/api/v1").Subrouter()
+	api.HandleFunc("/transactions", apiLoginRequired(apiListTransactions)).Methods("GET")
+	api.HandleFunc("/transactions", apiLoginRequired(apiCreateTransaction)).Methods("POST")
+	api.HandleFunc("/transactions/{id:[0-9]+}", apiLoginRequired(apiGetTransaction)).Methods("GET")
+	api.HandleFunc("/transactions/{id:[0-9]+}", apiLoginRequired(apiUpdateTransaction)).Methods("PUT")
+	api.HandleFunc("/transactions/{id:[0-9]+}", apiLoginRequired(apiDeleteTransaction)).Methods("DELETE")
+	api.HandleFunc("/categories", apiLoginRequired(apiListCategories)).Methods("GET")
+	api.HandleFunc("/categories", apiLoginRequired(apiCreateCategory)).Methods("POST")
+	api.HandleFunc("/categories/{id:[0-9]+}", apiLoginRequired(apiGetCategory)).Methods("GET")
+	api.HandleFunc("/categories/{id:[0-9]+}", apiLoginRequired(apiUpdateCategory)).Methods("PUT")
+	api.HandleFunc("/categories/{id:[0-9]+}", apiLoginRequired(apiDeleteCategory)).Methods("DELETE")
+	api.HandleFunc("/reports/buckets", apiLoginRequired(apiListBuckets)).Methods("GET")
+	api.HandleFunc("/sessions", apiLoginRequired(apiListSessions)).Methods("GET")
+	api.HandleFunc("/sessions", apiCreateSession).Methods("POST")
+	api.HandleFunc("/sessions/{id:[0-9]+}", apiLoginRequired(apiDeleteSession)).Methods("DELETE")
+	api.NotFoundHandler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		writeAPIError(w, http.StatusNotFound, 11)
+	})
+}
+
+func apiLoginRequired(handler func(w http.ResponseWriter, r *http.Request, userID int)) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var userID int
+		if authorization := r.Header.Get("Authorization"); authorization != "" {
+			var err error
+			userID, err = getAPITokenUserID(r, authorization)
+			// A known token without the write scope is not a missing login
+			if err == errAPITokenScope {
+				writeAPIError(w, http.StatusForbidden, tokenScopeErrorCode)
+				return
+			}
+		} else {
+			userID = getUserID(r)
+		}
+		if userID == 0 {
+			writeAPIError(w, http.StatusUnauthorized, 10)
+		} else {
+			handler(w, r, userID)
+		}
+	}
+}
+
+func writeJSON(w http.ResponseWriter, status int, value interface{}) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(status)
+	err := json.NewEncoder(w).Encode(value)
+	if err != nil {
+		log.Println("Encoding response failed", err)
+	}
+}
+
+func writeAPIError(w http.ResponseWriter, status int, errorCode int) {
+	writeJSON(w, status, APIErrorResponse{APIError{errorCode, allErrors[errorCode]}})
+}
+
+func readJSON(w http.ResponseWriter, r *http.Request, value interface{}) error {
+	decoder := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<20))
+	decoder.DisallowUnknownFields()
+	return decoder.Decode(value)
+}
+
+func getPagination(r *http.Request) (limit int, offset int, ok bool) {
+	limit = defaultPageLimit
+	if value := r.URL.Query().Get("limit"); value != "" {
+		parsed, err := strconv.Atoi(value)
+		if err != nil || parsed < 1 {
+			return 0, 0, false
+		}
+		limit = parsed
+	}
+	if limit > maxPageLimit {
+		limit = maxPageLimit
+	}
+	if value := r.URL.Query().Get("offset"); value != "" {
+		parsed, err := strconv.Atoi(value)
+		if err != nil || parsed < 0 {
+			return 0, 0, false
+		}
+		offset = parsed
+	}
+	return limit, offset, true
+}
+
+func getRouteID(r *http.Request) int {
+	// The route pattern only accepts digits, so only overflow is possible here
+	id, err := strconv.ParseInt(mux.Vars(r)["id"], 10, 32)
+	if err != nil {
+		return 0
+	}
+	return int(id)
+}
+
+func isCategoryOfUser(categoryID int32, userID int) (bool, error) {
+	var exists bool
+	err := database.QueryRowx(
+		"SELECT EXISTS(SELECT 1 FROM categories WHERE id = $1 AND user_id = $2)",
+		categoryID, userID,
+	).Scan(&exists)
+	return exists, err
+}
+
+func apiListTransactions(w http.ResponseWriter, r *http.Request, userID int) {
+	limit, offset, ok := getPagination(r)
+	if !ok {
+		writeAPIError(w, http.StatusBadRequest, 12)
+		return
+	}
+
+	var total int
+	err := database.QueryRowx("SELECT COUNT(*) FROM transactions WHERE user_id = $1", userID).Scan(&total)
+	if err != nil {
+		log.Println("Count transactions failed", err)
+		writeAPIError(w, http.StatusInternalServerError, 13)
+		return
+	}
+
+	rows, err := database.Queryx(
+		"SELECT id, date, kind, account, to_account AS toaccount, category, amount, currency, comment FROM transactions WHERE user_id = $1 ORDER BY date DESC, id DESC LIMIT $2 OFFSET $3",
+		userID, limit, offset,
+	)
+	if err != nil {
+		log.Println("Query transactions failed", err)
+		writeAPIError(w, http.StatusInternalServerError, 13)
+		return
+	}
+	defer rows.Close()
+
+	transactions := []APITransaction{}
+	for rows.Next() {
+		var t Transaction
+		err := rows.StructScan(&t)
+		if err != nil {
+			log.Println("Scan transactions failed", err)
+			writeAPIError(w, http.StatusInternalServerError, 13)
+			return
+		}
+		transactions = append(transactions, newAPITransaction(t))
+	}
+	err = rows.Err()
+	if err != nil {
+		log.Println(err)
+		writeAPIError(w, http.StatusInternalServerError, 13)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, APIPage{transactions, limit, offset, total})
+}
+
+func apiGetTransaction(w http.ResponseWriter, r *http.Request, userID int) {
+	var t Transaction
+	err := database.QueryRowx(
+		"SELECT id, date, kind, account, to_account AS toaccount, category, amount, currency, comment FROM transactions WHERE id = $1 AND user_id = $2",
+		getRouteID(r), userID,
+	).StructScan(&t)
+	if err == sql.ErrNoRows {
+		writeAPIError(w, http.StatusNotFound, 11)
+		return
+	}
+	if err != nil {
+		log.Println("Query transaction failed", err)
+		writeAPIError(w, http.StatusInternalServerError, 13)
+		return
+	}
+	writeJSON(w, http.StatusOK, newAPITransaction(t))
+}
+
+func apiCreateTransaction(w http.ResponseWriter, r *http.Request, userID int) {
+	t, errorCode := readAPITransaction(w, r, userID)
+	if errorCode != 0 {
+		writeAPIError(w, http.StatusBadRequest, errorCode)
+		return
+	}
+
+	err := database.QueryRowx(
+		"INSERT INTO transactions(user_id, date, kind, account, to_account, category, amount, currency, comment) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9) RETURNING id",
+		userID, t.Date, t.Kind, t.Account, t.ToAccount, t.Category, t.Amount, t.Currency, t.Comment,
+	).Scan(&t.ID)
+	if err != nil {
+		log.Println("Inserting transaction failed", err)
+		writeAPIError(w, http.StatusInternalServerError, 6)
+		return
+	}
+	writeJSON(w, http.StatusCreated, newAPITransaction(t))
+}
+
+func apiUpdateTransaction(w http.ResponseWriter, r *http.Request, userID int) {
+	t, errorCode := readAPITransaction(w, r, userID)
+	if errorCode != 0 {
+		writeAPIError(w, http.StatusBadRequest, errorCode)
+		return
+	}
+	t.ID = getRouteID(r)
+
+	tx, err := database.Beginx()
+	if err != nil {
+		log.Println("Updating transaction failed", err)
+		writeAPIError(w, http.StatusInternalServerError, 6)
+		return
+	}
+	defer tx.Rollback()
+	result, err := tx.Exec(
+		"UPDATE transactions SET date = $1, kind = $2, account = $3, to_account = $4, category = $5, amount = $6, currency = $7, comment = $8 WHERE id = $9 AND user_id = $10",
+		t.Date, t.Kind, t.Account, t.ToAccount, t.Category, t.Amount, t.Currency, t.Comment, t.ID, userID,
+	)
+	if err != nil {
+		log.Println("Updating transaction failed", err)
+		writeAPIError(w, http.StatusInternalServerError, 6)
+		return
+	}
+	if affected, _ := result.RowsAffected(); affected == 0 {
+		writeAPIError(w, http.StatusNotFound, 11)
+		return
+	}
+	// The transaction is replaced with one category and amount, so its lines
+	// would not sum up anymore
+	err = setTransactionSplits(tx, userID, t.ID, nil)
+	if err == nil {
+		err = tx.Commit()
+	}
+	if err != nil {
+		log.Println("Updating transaction failed", err)
+		writeAPIError(w, http.StatusInternalServerError, 6)
+		return
+	}
+	writeJSON(w, http.StatusOK, newAPITransaction(t))
+}
+
+func apiDeleteTransaction(w http.ResponseWriter, r *http.Request, userID int) {
+	result, err := database.Exec(
+		"DELETE FROM transactions WHERE id = $1 AND user_id = $2",
+		getRouteID(r), userID,
+	)
+	if err != nil {
+		log.Println("Deleting transaction failed", err)
+		writeAPIError(w, http.StatusInternalServerError, 6)
+		return
+	}
+	if affected, _ := result.RowsAffected(); affected == 0 {
+		writeAPIError(w, http.StatusNotFound, 11)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func newAPITransaction(t Transaction) APITransaction {
+	result := APITransaction{
+		ID:       t.ID,
+		Date:     t.Date.Format(dateLayout),
+		Kind:     t.Kind,
+		Account:  t.Account,
+		Category: t.Category,
+		Amount:   t.Amount,
+		Currency: t.Currency,
+		Comment:  t.Comment,
+	}
+	if t.ToAccount.Valid {
+		result.ToAccount = &t.ToAccount.Int32
+	}
+	return result
+}
+
+// readAPITransaction parses and validates the request body, the returned
+// error code is a key of allErrors
+func readAPITransaction(w http.ResponseWriter, r *http.Request, userID int) (t Transaction, errorCode int) {
+	var input APITransaction
+	err := readJSON(w, r, &input)
+	if err != nil {
+		log.Println(err)
+		return t, 3
+	}
+
+	t.Date = time.Now()
+	if input.Date != "" {
+		t.Date, err = time.Parse(dateLayout, input.Date)
+		if err != nil {
+			log.Println(err)
+			return t, 14
+		}
+	}
+	if input.Kind == "" {
+		input.Kind = kindExpense
+	}
+	if !isValidKind(input.Kind) {
+		return t, 17
+	}
+	var toAccount int32
+	if input.ToAccount != nil {
+		toAccount = *input.ToAccount
+	}
+	t.ToAccount, errorCode = validateTransactionAccounts(input.Kind, input.Account, toAccount, userID)
+	if errorCode != 0 {
+		return t, errorCode
+	}
+	t.Currency, errorCode = parseTransactionCurrency(input.Currency, input.Account)
+	if errorCode != 0 {
+		return t, errorCode
+	}
+	if !input.Amount.IsPositive() {
+		return t, 5
+	}
+	exists, err := isCategoryOfUser(input.Category, userID)
+	if err != nil {
+		log.Println(err)
+	}
+	if !exists {
+		return t, 4
+	}
+
+	t.Kind = input.Kind
+	t.Account = input.Account
+	t.Category = input.Category
+	t.Amount = input.Amount
+	t.Comment = input.Comment
+	return t, 0
+}
+
+func apiListBuckets(w http.ResponseWriter, r *http.Request, userID int) {
+	weekStart, err := getUserWeekStart(database, userID)
+	if err != nil {
+		log.Println("Query week start failed", err)
+	}
+	unit, from, to, errorCode := parseBucketRange(r, time.Now(), weekStart)
+	if errorCode != 0 {
+		writeAPIError(w, http.StatusBadRequest, errorCode)
+		return
+	}
+	kind := r.URL.Query().Get("kind")
+	if kind == "" {
+		kind = kindExpense
+	}
+	if !isValidKind(kind) {
+		writeAPIError(w, http.StatusBadRequest, 17)
+		return
+	}
+	baseCurrency, err := getUserBaseCurrency(database, userID)
+	if err != nil {
+		log.Println(err)
+	}
+
+	amounts, err := getBucketAmounts(database, userID, kind, unit, from, to, weekStart)
+	if err != nil {
+		log.Println("Query bucket amounts failed", err)
+		writeAPIError(w, http.StatusInternalServerError, 13)
+		return
+	}
+	writeJSON(w, http.StatusOK, APIBuckets{unit, from.Format(dateLayout), to.Format(dateLayout), kind, baseCurrency, amounts})
+}
+
+func apiListCategories(w http.ResponseWriter, r *http.Request, userID int) {
+	limit, offset, ok := getPagination(r)
+	if !ok {
+		writeAPIError(w, http.StatusBadRequest, 12)
+		return
+	}
+
+	var total int
+	err := database.QueryRowx("SELECT COUNT(*) FROM categories WHERE user_id = $1", userID).Scan(&total)
+	if err != nil {
+		log.Println("Count categories failed", err)
+		writeAPIError(w, http.StatusInternalServerError, 13)
+		return
+	}
+
+	rows, err := database.Queryx(
+		"SELECT id, name, COALESCE(parent, 0) AS parent, archived FROM categories WHERE user_id = $1 ORDER BY name, id LIMIT $2 OFFSET $3",
+		userID, limit, offset,
+	)
+	if err != nil {
+		log.Println("Query categories failed", err)
+		writeAPIError(w, http.StatusInternalServerError, 13)
+		return
+	}
+	defer rows.Close()
+
+	categories := []APICategory{}
+	for rows.Next() {
+		var c Category
+		err := rows.StructScan(&c)
+		if err != nil {
+			log.Println("Scan categories failed", err)
+			writeAPIError(w, http.StatusInternalServerError, 13)
+			return
+		}
+		categories = append(categories, APICategory{c.ID, c.Name, c.Parent, c.Archived})
+	}
+	err = rows.Err()
+	if err != nil {
+		log.Println(err)
+		writeAPIError(w, http.StatusInternalServerError, 13)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, APIPage{categories, limit, offset, total})
+}
+
+func apiGetCategory(w http.ResponseWriter, r *http.Request, userID int) {
+	var c Category
+	err := database.QueryRowx(
+		"SELECT id, name, COALESCE(parent, 0) AS parent, archived FROM categories WHERE id = $1 AND user_id = $2",
+		getRouteID(r), userID,
+	).StructScan(&c)
+	if err == sql.ErrNoRows {
+		writeAPIError(w, http.StatusNotFound, 11)
+		return
+	}
+	if err != nil {
+		log.Println("Query category failed", err)
+		writeAPIError(w, http.StatusInternalServerError, 13)
+		return
+	}
+	writeJSON(w, http.StatusOK, APICategory{c.ID, c.Name, c.Parent, c.Archived})
+}
+
+func apiCreateCategory(w http.ResponseWriter, r *http.Request, userID int) {
+	var c APICategory
+	err := readJSON(w, r, &c)
+	if err != nil {
+		log.Println(err)
+		writeAPIError(w, http.StatusBadRequest, 3)
+		return
+	}
+	c.Name = strings.TrimSpace(c.Name)
+	if c.Name == "" {
+		writeAPIError(w, http.StatusBadRequest, 15)
+		return
+	}
+	if c.Parent != 0 {
+		exists, err := isCategoryOfUser(int32(c.Parent), userID)
+		if err != nil {
+			log.Println(err)
+		}
+		if !exists {
+			writeAPIError(w, http.StatusBadRequest, 4)
+			return
+		}
+	}
+
+	err = database.QueryRowx(
+		"INSERT INTO categories(name, user_id, parent, archived) VALUES ($1, $2, NULLIF($3, 0), $4) RETURNING id",
+		c.Name, userID, c.Parent, c.Archived,
+	).Scan(&c.ID)
+	if err != nil {
+		log.Println("Inserting category failed", err)
+		writeAPIError(w, http.StatusConflict, 6)
+		return
+	}
+	writeJSON(w, http.StatusCreated, c)
+}
+
+func apiUpdateCategory(w http.ResponseWriter, r *http.Request, userID int) {
+	var c APICategory
+	err := readJSON(w, r, &c)
+	if err != nil {
+		log.Println(err)
+		writeAPIError(w, http.StatusBadRequest, 3)
+		return
+	}
+	c.ID = getRouteID(r)
+	c.Name = strings.TrimSpace(c.Name)
+	if c.Name == "" {
+		writeAPIError(w, http.StatusBadRequest, 15)
+		return
+	}
+
+	result, err := database.Exec(
+		"UPDATE categories SET name = $1, archived = $2 WHERE id = $3 AND user_id = $4",
+		c.Name, c.Archived, c.ID, userID,
+	)
+	if err != nil {
+		log.Println("Updating category failed", err)
+		writeAPIError(w, http.StatusConflict, 6)
+		return
+	}
+	if affected, _ := result.RowsAffected(); affected == 0 {
+		writeAPIError(w, http.StatusNotFound, 11)
+		return
+	}
+	err = setCategoryParent(database, userID, int32(c.ID), int32(c.Parent))
+	if err != nil {
+		log.Println("Moving category failed", err)
+		status := http.StatusBadRequest
+		if categoryErrorCode(err) == 6 {
+			status = http.StatusInternalServerError
+		}
+		writeAPIError(w, status, categoryErrorCode(err))
+		return
+	}
+	writeJSON(w, http.StatusOK, c)
+}
+
+// apiDeleteCategory moves transactions of the category to the category given
+// by move_to parameter and deletes it, the parameter is required when the
+// category has transactions
+func apiDeleteCategory(w http.ResponseWriter, r *http.Request, userID int) {
+	var targetID int64
+	if value := r.URL.Query().Get("move_to"); value != "" {
+		var err error
+		targetID, err = strconv.ParseInt(value, 10, 32)
+		if err != nil {
+			writeAPIError(w, http.StatusBadRequest, 4)
+			return
+		}
+	}
+	err := mergeCategory(database, userID, int32(getRouteID(r)), int32(targetID))
+	switch err {
+	case nil:
+		w.WriteHeader(http.StatusNoContent)
+	case errCategoryNotFound:
+		writeAPIError(w, http.StatusNotFound, 11)
+	case errCategoryUsed:
+		writeAPIError(w, http.StatusConflict, 31)
+	case errSameCategory:
+		writeAPIError(w, http.StatusBadRequest, 32)
+	default:
+		log.Println("Deleting category failed", err)
+		writeAPIError(w, http.StatusInternalServerError, 6)
+	}
+}
+
+func newAPISession(s Session, current bool) APISession {
+	return APISession{
+		ID:        s.ID,
+		Initiated: s.Initiated,
+		Expires:   s.Expires,
+		IP:        s.IP,
+		UserAgent: s.UserAgent,
+		Current:   current,
+	}
+}
+
+func apiListSessions(w http.ResponseWriter, r *http.Request, userID int) {
+	limit, offset, ok := getPagination(r)
+	if !ok {
+		writeAPIError(w, http.StatusBadRequest, 12)
+		return
+	}
+
+	var total int
+	err := database.QueryRowx("SELECT COUNT(*) FROM sessions WHERE user_id = $1 AND expires > NOW()", userID).Scan(&total)
+	if err != nil {
+		log.Println("Count sessions failed", err)
+		writeAPIError(w, http.StatusInternalServerError, 13)
+		return
+	}
+
+	rows, err := database.Queryx(
+		"SELECT "+sessionColumns+" FROM sessions WHERE user_id = $1 AND expires > NOW() ORDER BY initiated LIMIT $2 OFFSET $3",
+		userID, limit, offset,
+	)
+	if err != nil {
+		log.Println("Query sessions failed", err)
+		writeAPIError(w, http.StatusInternalServerError, 13)
+		return
+	}
+	defer rows.Close()
+
+	currentSessionID := getSessionID(r)
+
+	sessions := []APISession{}
+	for rows.Next() {
+		var s Session
+		err := rows.StructScan(&s)
+		if err != nil {
+			log.Println("Scan sessions failed", err)
+			writeAPIError(w, http.StatusInternalServerError, 13)
+			return
+		}
+		sessions = append(sessions, newAPISession(s, s.ID == currentSessionID))
+	}
+	err = rows.Err()
+	if err != nil {
+		log.Println(err)
+		writeAPIError(w, http.StatusInternalServerError, 13)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, APIPage{sessions, limit, offset, total})
+}
+
+// loginErrorStatus returns the status of a failed login, attempts that could
+// not be recorded are refused as server errors
+func loginErrorStatus(errorCode int) int {
+	switch errorCode {
+	case lockedErrorCode:
+		return http.StatusTooManyRequests
+	case 6:
+		return http.StatusInternalServerError
+	}
+	return http.StatusUnauthorized
+}
+
+func apiCreateSession(w http.ResponseWriter, r *http.Request) {
+	var input APILogin
+	err := readJSON(w, r, &input)
+	if err != nil {
+		log.Println(err)
+		writeAPIError(w, http.StatusBadRequest, 3)
+		return
+	}
+
+	email := strings.ToLower(input.Email)
+	dbUser, errorCode := authenticate(r, email, input.Password)
+	if errorCode != 0 {
+		log.Println("Login failed", email)
+		writeAPIError(w, loginErrorStatus(errorCode), errorCode)
+		return
+	}
+	// Both factors come in one request, the API has no second step
+	if dbUser.TOTPEnabled {
+		if input.Code == "" {
+			writeAPIError(w, http.StatusUnauthorized, missingCodeErrorCode)
+			return
+		}
+		errorCode = authenticateSecondFactor(r, email, dbUser.ID, input.Code)
+		if errorCode != 0 {
+			log.Println("Second factor failed", email)
+			writeAPIError(w, loginErrorStatus(errorCode), errorCode)
+			return
+		}
+	}
+
+	log.Println("User logged in via API", email)
+	token, csrf := setCookie(w, r, dbUser.ID, input.RememberMe)
+	if token == "" {
+		writeAPIError(w, http.StatusInternalServerError, 6)
+		return
+	}
+	// The tokens are sent only once: the value of the cookie for further
+	// requests and the X-CSRF-Token header for changing ones
+	writeJSON(w, http.StatusCreated, APISession{
+		Initiated: time.Now(),
+		IP:        clientIP(r),
+		UserAgent: r.Header.Get("User-Agent"),
+		Token:     token,
+		CSRFToken: csrf,
+		Current:   true,
+	})
+}
+
+func apiDeleteSession(w http.ResponseWriter, r *http.Request, userID int) {
+	result, err := database.Exec(
+		"DELETE FROM sessions WHERE id = $1 AND user_id = $2",
+		getRouteID(r), userID,
+	)
+	if err != nil {
+		log.Println("Deleting session failed", err)
+		writeAPIError(w, http.StatusInternalServerError, 6)
+		return
+	}
+	if affected, _ := result.RowsAffected(); affected == 0 {
+		writeAPIError(w, http.StatusNotFound, 11)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
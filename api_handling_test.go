@@ -0,0 +1,60 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gorilla/mux"
+)
+
+func TestGetPagination(t *testing.T) {
+	cases := []struct {
+		query  string
+		limit  int
+		offset int
+		ok     bool
+	}{
+		{"", defaultPageLimit, 0, true},
+		{"?limit=10&offset=20", 10, 20, true},
+		{"?limit=100000", maxPageLimit, 0, true},
+		{"?limit=0", 0, 0, false},
+		{"?offset=-1", 0, 0, false},
+		{"?limit=abc", 0, 0, false},
+	}
+	for _, c := range cases {
+		r := httptest.NewRequest("GET", "/api/v1/transactions"+c.query, nil)
+		limit, offset, ok := getPagination(r)
+		if limit != c.limit || offset != c.offset || ok != c.ok {
+			t.Errorf("%q: got (%d, %d, %v), expected (%d, %d, %v)", c.query, limit, offset, ok, c.limit, c.offset, c.ok)
+		}
+	}
+}
+
+func TestAPIRequiresAuthorization(t *testing.T) {
+	router := mux.NewRouter()
+	registerAPIRoutes(router)
+
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("GET", "/api/v1/transactions", nil))
+	if w.Code != http.StatusUnauthorized {
+		t.Fatalf("got status %d, expected %d", w.Code, http.StatusUnauthorized)
+	}
+	var response APIErrorResponse
+	err := json.NewDecoder(w.Body).Decode(&response)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if response.Error.Code != 10 || response.Error.Message != allErrors[10] {
+		t.Errorf("unexpected error object %+v", response.Error)
+	}
+}
+
+func TestAPIDeleteCategoryChecksTarget(t *testing.T) {
+	w := httptest.NewRecorder()
+	apiDeleteCategory(w, httptest.NewRequest("DELETE", "/api/v1/categories/1?move_to=abc", nil), 1)
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("got status %d, expected %d", w.Code, http.StatusBadRequest)
+	}
+}
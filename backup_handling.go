@@ -0,0 +1,757 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/lib/pq"
+)
+
+// backupVersion is increased on every incompatible change of the format,
+// older versions have to be converted by restoreBackup
+const backupVersion = 2
+
+// minBackupVersion - the oldest format restoreBackup still reads, version 1
+// has no budgets, recurring transactions and import profiles
+const minBackupVersion = 1
+
+const maxBackupSize = 50 << 20
+
+// Backup - all the data of one user, identifiers are only valid inside the file
+type Backup struct {
+	Version        int                   `json:"version"`
+	Created        time.Time             `json:"created"`
+	Settings       BackupSettings        `json:"settings"`
+	Accounts       []BackupAccount       `json:"accounts"`
+	Categories     []BackupCategory      `json:"categories"`
+	Transactions   []BackupTransaction   `json:"transactions"`
+	ExchangeRates  []BackupRate          `json:"exchange_rates"`
+	Sessions       []BackupSession       `json:"sessions"`
+	Budgets        []BackupBudget        `json:"budgets,omitempty"`
+	Recurring      []BackupRecurring     `json:"recurring,omitempty"`
+	ImportProfiles []BackupImportProfile `json:"import_profiles,omitempty"`
+}
+
+// BackupSettings - user preferences
+type BackupSettings struct {
+	WeekStart    int    `json:"week_start"`
+	BaseCurrency string `json:"base_currency"`
+}
+
+// BackupAccount - element of accounts table
+type BackupAccount struct {
+	ID             int32  `json:"id"`
+	Name           string `json:"name"`
+	Currency       string `json:"currency"`
+	OpeningBalance Money  `json:"opening_balance" db:"openingbalance"`
+}
+
+// BackupCategory - element of categories table
+type BackupCategory struct {
+	ID       int32  `json:"id"`
+	Name     string `json:"name"`
+	Parent   *int32 `json:"parent,omitempty"`
+	Archived bool   `json:"archived,omitempty"`
+}
+
+// BackupTransaction - element of transactions table
+type BackupTransaction struct {
+	ID        int32          `json:"id"`
+	Date      string         `json:"date"`
+	Kind      string         `json:"kind"`
+	Account   int32          `json:"account"`
+	ToAccount *int32         `json:"to_account" db:"toaccount"`
+	Category  *int32         `json:"category"`
+	Amount    Money          `json:"amount"`
+	Currency  string         `json:"currency"`
+	Comment   string         `json:"comment"`
+	Tags      pq.StringArray `json:"tags,omitempty"`
+	Splits    []BackupSplit  `json:"splits,omitempty"`
+}
+
+// BackupSplit - element of transaction_splits table
+type BackupSplit struct {
+	Category int32 `json:"category"`
+	Amount   Money `json:"amount"`
+}
+
+// BackupRate - element of exchange_rates table
+type BackupRate struct {
+	Date         string  `json:"date"`
+	Currency     string  `json:"currency"`
+	BaseCurrency string  `json:"base_currency" db:"basecurrency"`
+	Rate         float64 `json:"rate"`
+}
+
+// BackupBudget - element of budgets table, category is absent for the
+// overall budget
+type BackupBudget struct {
+	Category *int32 `json:"category"`
+	Amount   Money  `json:"amount"`
+	Rollover bool   `json:"rollover,omitempty"`
+	Since    string `json:"since"`
+}
+
+// BackupRecurring - element of recurring_transactions table with its
+// created and skipped occurrences
+type BackupRecurring struct {
+	ID          int32              `json:"id"`
+	Kind        string             `json:"kind"`
+	Account     int32              `json:"account"`
+	ToAccount   *int32             `json:"to_account" db:"toaccount"`
+	Category    *int32             `json:"category"`
+	Amount      Money              `json:"amount"`
+	Currency    string             `json:"currency"`
+	Comment     string             `json:"comment"`
+	Frequency   string             `json:"frequency"`
+	Every       int                `json:"every"`
+	Cron        string             `json:"cron,omitempty"`
+	Starts      string             `json:"starts"`
+	Ends        *string            `json:"ends,omitempty"`
+	Processed   *string            `json:"processed,omitempty"`
+	Occurrences []BackupOccurrence `json:"occurrences,omitempty"`
+}
+
+// BackupOccurrence - element of recurring_occurrences table, the transaction
+// is absent for skipped occurrences and deleted transactions
+type BackupOccurrence struct {
+	Date        string `json:"date"`
+	Status      string `json:"status"`
+	Transaction *int32 `json:"transaction,omitempty"`
+}
+
+// BackupImportProfile - element of import_profiles table
+type BackupImportProfile struct {
+	Name              string `json:"name"`
+	Delimiter         string `json:"delimiter"`
+	HasHeader         bool   `json:"has_header" db:"hasheader"`
+	DateColumn        int    `json:"date_column" db:"datecolumn"`
+	DateFormat        string `json:"date_format" db:"dateformat"`
+	AmountColumn      int    `json:"amount_column" db:"amountcolumn"`
+	CommentColumn     int    `json:"comment_column" db:"commentcolumn"`
+	CategoryColumn    int    `json:"category_column" db:"categorycolumn"`
+	PositiveIsExpense bool   `json:"positive_is_expense" db:"positiveisexpense"`
+	Account           *int32 `json:"account"`
+	DefaultCategory   *int32 `json:"default_category" db:"defaultcategory"`
+}
+
+// BackupSession - session metadata, tokens are never written, so sessions
+// are not restored
+type BackupSession struct {
+	Initiated time.Time `json:"initiated"`
+	IP        string    `json:"ip"`
+	UserAgent string    `json:"user_agent" db:"useragent"`
+}
+
+// backupKey identifies transactions when the backup is restored into an
+// account which already has some of them
+type backupKey struct {
+	date      string
+	kind      string
+	account   int32
+	toAccount int32
+	category  int32
+	amount    Money
+	currency  string
+	comment   string
+}
+
+// isLegacyTransfer reports whether the transaction is a transfer recorded
+// before accounts existed, such transfers have no target
+func (t BackupTransaction) isLegacyTransfer() bool {
+	return t.Kind == kindTransfer && t.ToAccount == nil
+}
+
+// recurringKey identifies recurring transactions when the backup is
+// restored again, the date of the key is the first date of the schedule
+type recurringKey struct {
+	backupKey
+	frequency string
+	every     int
+	cron      string
+}
+
+func (r BackupRecurring) key() recurringKey {
+	t := BackupTransaction{
+		Date:      r.Starts,
+		Kind:      r.Kind,
+		Account:   r.Account,
+		ToAccount: r.ToAccount,
+		Category:  r.Category,
+		Amount:    r.Amount,
+		Currency:  r.Currency,
+		Comment:   r.Comment,
+	}
+	return recurringKey{t.key(), r.Frequency, r.Every, r.Cron}
+}
+
+func (t BackupTransaction) key() backupKey {
+	key := backupKey{
+		date:     t.Date,
+		kind:     t.Kind,
+		account:  t.Account,
+		amount:   t.Amount,
+		currency: t.Currency,
+		comment:  t.Comment,
+	}
+	if t.ToAccount != nil {
+		key.toAccount = *t.ToAccount
+	}
+	if t.Category != nil {
+		key.category = *t.Category
+	}
+	return key
+}
+
+func getBackup(db *sqlx.DB, userID int) (backup Backup, err error) {
+	backup = Backup{
+		Version:        backupVersion,
+		Created:        time.Now().UTC(),
+		Accounts:       []BackupAccount{},
+		Categories:     []BackupCategory{},
+		Transactions:   []BackupTransaction{},
+		ExchangeRates:  []BackupRate{},
+		Sessions:       []BackupSession{},
+		Budgets:        []BackupBudget{},
+		Recurring:      []BackupRecurring{},
+		ImportProfiles: []BackupImportProfile{},
+	}
+	err = db.QueryRowx(
+		"SELECT week_start, base_currency FROM users WHERE id = $1", userID,
+	).Scan(&backup.Settings.WeekStart, &backup.Settings.BaseCurrency)
+	if err != nil {
+		return backup, err
+	}
+	err = db.Select(&backup.Accounts,
+		"SELECT id, name, currency, opening_balance AS openingbalance FROM accounts WHERE user_id = $1 ORDER BY id",
+		userID,
+	)
+	if err != nil {
+		return backup, err
+	}
+	err = db.Select(&backup.Categories, "SELECT id, name, parent, archived FROM categories WHERE user_id = $1 ORDER BY id", userID)
+	if err != nil {
+		return backup, err
+	}
+	err = db.Select(&backup.Transactions, `
+	SELECT id, to_char(date, 'YYYY-MM-DD') AS date, kind, account, to_account AS toaccount,
+		category, amount, currency, COALESCE(comment, '') AS comment,
+		ARRAY(
+			SELECT g.name FROM transaction_tags tt JOIN tags g ON tt.tag_id = g.id
+			WHERE tt.transaction_id = t.id ORDER BY g.name
+		) AS tags
+	FROM transactions t WHERE user_id = $1 ORDER BY date, id
+	`, userID)
+	if err != nil {
+		return backup, err
+	}
+	err = addBackupSplits(db, userID, backup.Transactions)
+	if err != nil {
+		return backup, err
+	}
+	err = db.Select(&backup.ExchangeRates, `
+	SELECT to_char(date, 'YYYY-MM-DD') AS date, currency, base_currency AS basecurrency, rate
+	FROM exchange_rates WHERE user_id = $1 ORDER BY date, currency, base_currency
+	`, userID)
+	if err != nil {
+		return backup, err
+	}
+	err = db.Select(&backup.Budgets, `
+	SELECT category, amount, rollover, to_char(since, 'YYYY-MM-DD') AS since
+	FROM budgets WHERE user_id = $1 ORDER BY id
+	`, userID)
+	if err != nil {
+		return backup, err
+	}
+	err = db.Select(&backup.Recurring, `
+	SELECT id, kind, account, to_account AS toaccount, category, amount, currency,
+		COALESCE(comment, '') AS comment, frequency, every, cron, to_char(starts, 'YYYY-MM-DD') AS starts,
+		to_char(ends, 'YYYY-MM-DD') AS ends, to_char(processed, 'YYYY-MM-DD') AS processed
+	FROM recurring_transactions WHERE user_id = $1 ORDER BY id
+	`, userID)
+	if err != nil {
+		return backup, err
+	}
+	err = addBackupOccurrences(db, userID, backup.Recurring)
+	if err != nil {
+		return backup, err
+	}
+	err = db.Select(&backup.ImportProfiles, `
+	SELECT name, delimiter, has_header AS hasheader, date_column AS datecolumn, date_format AS dateformat,
+		amount_column AS amountcolumn, comment_column AS commentcolumn, category_column AS categorycolumn,
+		positive_is_expense AS positiveisexpense, account, default_category AS defaultcategory
+	FROM import_profiles WHERE user_id = $1 ORDER BY name
+	`, userID)
+	if err != nil {
+		return backup, err
+	}
+	err = db.Select(&backup.Sessions,
+		"SELECT initiated, COALESCE(ip, '') AS ip, COALESCE(user_agent, '') AS useragent FROM sessions WHERE user_id = $1 ORDER BY initiated",
+		userID,
+	)
+	return backup, err
+}
+
+// addBackupSplits reads lines of the split transactions of the user
+func addBackupSplits(db *sqlx.DB, userID int, transactions []BackupTransaction) error {
+	rows, err := db.Queryx(`
+	SELECT s.transaction_id, s.category, s.amount
+	FROM transaction_splits s
+	JOIN transactions t
+	ON s.transaction_id = t.id
+	WHERE t.user_id = $1
+	ORDER BY s.id
+	`, userID)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	positions := map[int32]int{}
+	for i, t := range transactions {
+		positions[t.ID] = i
+	}
+	for rows.Next() {
+		var (
+			transactionID int32
+			split         BackupSplit
+		)
+		err = rows.Scan(&transactionID, &split.Category, &split.Amount)
+		if err != nil {
+			return err
+		}
+		i := positions[transactionID]
+		transactions[i].Splits = append(transactions[i].Splits, split)
+	}
+	return rows.Err()
+}
+
+// addBackupOccurrences reads created and skipped occurrences of the recurring
+// transactions of the user
+func addBackupOccurrences(db *sqlx.DB, userID int, templates []BackupRecurring) error {
+	rows, err := db.Queryx(`
+	SELECT o.recurring_id, to_char(o.date, 'YYYY-MM-DD'), o.status, o.transaction_id
+	FROM recurring_occurrences o
+	JOIN recurring_transactions r
+	ON o.recurring_id = r.id
+	WHERE r.user_id = $1
+	ORDER BY o.date
+	`, userID)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	positions := map[int32]int{}
+	for i, recurring := range templates {
+		positions[recurring.ID] = i
+	}
+	for rows.Next() {
+		var (
+			recurringID int32
+			occurrence  BackupOccurrence
+		)
+		err = rows.Scan(&recurringID, &occurrence.Date, &occurrence.Status, &occurrence.Transaction)
+		if err != nil {
+			return err
+		}
+		i := positions[recurringID]
+		templates[i].Occurrences = append(templates[i].Occurrences, occurrence)
+	}
+	return rows.Err()
+}
+
+// parseBackup reads the backup and checks that it is consistent, so the
+// restore never stops in the middle
+func parseBackup(input io.Reader) (backup Backup, err error) {
+	err = json.NewDecoder(input).Decode(&backup)
+	if err != nil {
+		return backup, err
+	}
+	if backup.Version < minBackupVersion || backup.Version > backupVersion {
+		return backup, fmt.Errorf("unsupported backup version %d", backup.Version)
+	}
+	if backup.Settings.WeekStart < 0 || backup.Settings.WeekStart > 6 {
+		return backup, errors.New("invalid week start")
+	}
+	if !currencyCodePattern.MatchString(backup.Settings.BaseCurrency) {
+		return backup, errors.New("invalid base currency")
+	}
+
+	accounts := map[int32]bool{}
+	for _, account := range backup.Accounts {
+		if account.Name == "" || !currencyCodePattern.MatchString(account.Currency) {
+			return backup, fmt.Errorf("invalid account %d", account.ID)
+		}
+		accounts[account.ID] = true
+	}
+	categories := map[int32]bool{}
+	for _, category := range backup.Categories {
+		if category.Name == "" {
+			return backup, fmt.Errorf("invalid category %d", category.ID)
+		}
+		categories[category.ID] = true
+	}
+	for _, category := range backup.Categories {
+		if category.Parent != nil && (!categories[*category.Parent] || *category.Parent == category.ID) {
+			return backup, fmt.Errorf("invalid parent of category %d", category.ID)
+		}
+	}
+	transactions := map[int32]bool{}
+	for _, t := range backup.Transactions {
+		transactions[t.ID] = true
+		_, dateErr := time.Parse(dateLayout, t.Date)
+		valid := dateErr == nil && isValidKind(t.Kind) && t.Amount.IsPositive() &&
+			accounts[t.Account] && currencyCodePattern.MatchString(t.Currency) &&
+			(t.Category == nil || categories[*t.Category]) &&
+			(t.Kind == kindTransfer || t.ToAccount == nil) &&
+			(t.ToAccount == nil || (accounts[*t.ToAccount] && *t.ToAccount != t.Account))
+		splits := []TransactionSplit{}
+		for _, split := range t.Splits {
+			valid = valid && categories[split.Category]
+			splits = append(splits, TransactionSplit{Category: split.Category, Amount: split.Amount})
+		}
+		if !valid || checkSplits(splits, t.Kind, t.Amount) != 0 {
+			return backup, fmt.Errorf("invalid transaction %d", t.ID)
+		}
+	}
+	for _, rate := range backup.ExchangeRates {
+		_, dateErr := time.Parse(dateLayout, rate.Date)
+		if dateErr != nil || rate.Rate <= 0 || rate.Currency == rate.BaseCurrency ||
+			!currencyCodePattern.MatchString(rate.Currency) || !currencyCodePattern.MatchString(rate.BaseCurrency) {
+			return backup, fmt.Errorf("invalid exchange rate %s %s", rate.Date, rate.Currency)
+		}
+	}
+	for _, budget := range backup.Budgets {
+		_, dateErr := time.Parse(dateLayout, budget.Since)
+		if dateErr != nil || !budget.Amount.IsPositive() || (budget.Category != nil && !categories[*budget.Category]) {
+			return backup, fmt.Errorf("invalid budget %s", budget.Since)
+		}
+	}
+	for _, recurring := range backup.Recurring {
+		if !isValidBackupRecurring(recurring, accounts, categories) {
+			return backup, fmt.Errorf("invalid recurring transaction %d", recurring.ID)
+		}
+		for _, occurrence := range recurring.Occurrences {
+			_, dateErr := time.Parse(dateLayout, occurrence.Date)
+			if dateErr != nil || (occurrence.Status != "created" && occurrence.Status != "skipped") ||
+				(occurrence.Transaction != nil && !transactions[*occurrence.Transaction]) {
+				return backup, fmt.Errorf("invalid occurrence %s of recurring transaction %d", occurrence.Date, recurring.ID)
+			}
+		}
+	}
+	for _, profile := range backup.ImportProfiles {
+		knownFormat := false
+		for _, format := range statementDateFormats {
+			knownFormat = knownFormat || profile.DateFormat == format
+		}
+		if profile.Name == "" || profile.Delimiter == "" || !knownFormat ||
+			profile.DateColumn < 0 || profile.AmountColumn < 0 ||
+			profile.CommentColumn < noColumn || profile.CategoryColumn < noColumn ||
+			(profile.Account != nil && !accounts[*profile.Account]) ||
+			(profile.DefaultCategory != nil && !categories[*profile.DefaultCategory]) {
+			return backup, fmt.Errorf("invalid import profile %s", profile.Name)
+		}
+	}
+	return backup, nil
+}
+
+// isValidBackupRecurring checks the recurring transaction of the backup the
+// same way as the form of a new one
+func isValidBackupRecurring(recurring BackupRecurring, accounts map[int32]bool, categories map[int32]bool) bool {
+	rule := RecurrenceRule{Frequency: recurring.Frequency, Interval: recurring.Every, Cron: recurring.Cron}
+	var startsErr, endsErr, processedErr error
+	rule.Starts, startsErr = time.Parse(dateLayout, recurring.Starts)
+	if recurring.Ends != nil {
+		rule.Ends, endsErr = time.Parse(dateLayout, *recurring.Ends)
+	}
+	if recurring.Processed != nil {
+		_, processedErr = time.Parse(dateLayout, *recurring.Processed)
+	}
+	return startsErr == nil && endsErr == nil && processedErr == nil && rule.Validate() == nil &&
+		isValidKind(recurring.Kind) && recurring.Amount.IsPositive() &&
+		accounts[recurring.Account] && currencyCodePattern.MatchString(recurring.Currency) &&
+		(recurring.Category == nil || categories[*recurring.Category]) &&
+		(recurring.Kind == kindTransfer) == (recurring.ToAccount != nil) &&
+		(recurring.ToAccount == nil || (accounts[*recurring.ToAccount] && *recurring.ToAccount != recurring.Account))
+}
+
+// mappedID returns the identifier restored in place of the one of the file
+func mappedID(ids map[int32]int32, id *int32) *int32 {
+	if id == nil {
+		return nil
+	}
+	mapped := ids[*id]
+	return &mapped
+}
+
+// restoreBackup merges the backup into the data of the user. Categories and
+// accounts are matched by name, transactions already present are skipped, so
+// restoring the same backup twice changes nothing.
+func restoreBackup(db *sqlx.DB, userID int, backup Backup) (restored int, err error) {
+	tx, err := db.Beginx()
+	if err != nil {
+		return 0, err
+	}
+	defer func() {
+		if err != nil {
+			tx.Rollback()
+		}
+	}()
+
+	_, err = tx.Exec(
+		"UPDATE users SET week_start = $1, base_currency = $2 WHERE id = $3",
+		backup.Settings.WeekStart, backup.Settings.BaseCurrency, userID,
+	)
+	if err != nil {
+		return 0, err
+	}
+
+	categoryIDs := map[int32]int32{}
+	for _, category := range backup.Categories {
+		var id int32
+		err = tx.QueryRowx(`
+		INSERT INTO categories(name, user_id, archived) VALUES ($1, $2, $3)
+		ON CONFLICT (name, user_id) DO UPDATE SET name = EXCLUDED.name
+		RETURNING id
+		`, category.Name, userID, category.Archived).Scan(&id)
+		if err != nil {
+			return 0, err
+		}
+		categoryIDs[category.ID] = id
+	}
+	// Parents are set when all the categories exist, categories which already
+	// have a parent keep it and loops with existing ones are not made
+	tree, err := getCategoryTree(tx, userID)
+	if err != nil {
+		return 0, err
+	}
+	for _, category := range backup.Categories {
+		id, parent := categoryIDs[category.ID], int32(0)
+		if category.Parent != nil {
+			parent = categoryIDs[*category.Parent]
+		}
+		if parent == 0 || tree[id] != 0 || !tree.canMove(id, parent) {
+			continue
+		}
+		_, err = tx.Exec("UPDATE categories SET parent = $1 WHERE id = $2", parent, id)
+		if err != nil {
+			return 0, err
+		}
+		tree[id] = parent
+	}
+
+	accountIDs := map[int32]int32{}
+	for _, account := range backup.Accounts {
+		var id int32
+		err = tx.QueryRowx(`
+		INSERT INTO accounts(name, currency, opening_balance, user_id) VALUES ($1, $2, $3, $4)
+		ON CONFLICT (name, user_id) DO UPDATE SET name = EXCLUDED.name
+		RETURNING id
+		`, account.Name, account.Currency, account.OpeningBalance, userID).Scan(&id)
+		if err != nil {
+			return 0, err
+		}
+		accountIDs[account.ID] = id
+	}
+
+	for _, rate := range backup.ExchangeRates {
+		_, err = tx.Exec(`
+		INSERT INTO exchange_rates(user_id, date, currency, base_currency, rate) VALUES ($1, $2, $3, $4, $5)
+		ON CONFLICT (user_id, date, currency, base_currency) DO UPDATE SET rate = EXCLUDED.rate
+		`, userID, rate.Date, rate.Currency, rate.BaseCurrency, rate.Rate)
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	// Budgets which are already set are kept
+	for _, budget := range backup.Budgets {
+		_, err = tx.Exec(`
+		INSERT INTO budgets(user_id, category, amount, rollover, since) VALUES ($1, $2, $3, $4, $5)
+		ON CONFLICT (user_id, COALESCE(category, 0)) DO NOTHING
+		`, userID, mappedID(categoryIDs, budget.Category), budget.Amount, budget.Rollover, budget.Since)
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	existing := []BackupTransaction{}
+	err = tx.Select(&existing, `
+	SELECT id, to_char(date, 'YYYY-MM-DD') AS date, kind, account, to_account AS toaccount,
+		category, amount, currency, COALESCE(comment, '') AS comment
+	FROM transactions WHERE user_id = $1
+	`, userID)
+	if err != nil {
+		return 0, err
+	}
+	existingIDs := map[backupKey][]int{}
+	for _, t := range existing {
+		existingIDs[t.key()] = append(existingIDs[t.key()], int(t.ID))
+	}
+
+	// Occurrences of recurring transactions refer to the restored transactions
+	transactionIDs := map[int32]int{}
+	for _, t := range backup.Transactions {
+		t.Account = accountIDs[t.Account]
+		t.ToAccount = mappedID(accountIDs, t.ToAccount)
+		t.Category = mappedID(categoryIDs, t.Category)
+		key := t.key()
+		if ids := existingIDs[key]; len(ids) > 0 {
+			transactionIDs[t.ID] = ids[0]
+			existingIDs[key] = ids[1:]
+			continue
+		}
+		var id int
+		err = tx.QueryRowx(`
+		INSERT INTO transactions(date, kind, account, to_account, category, amount, currency, comment, user_id, legacy_transfer)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10) RETURNING id
+		`, t.Date, t.Kind, t.Account, t.ToAccount, t.Category, t.Amount, t.Currency, t.Comment, userID, t.isLegacyTransfer()).Scan(&id)
+		if err != nil {
+			return 0, err
+		}
+		transactionIDs[t.ID] = id
+		err = setTransactionTags(tx, userID, id, parseTags(strings.Join(t.Tags, ",")))
+		if err != nil {
+			return 0, err
+		}
+		splits := []TransactionSplit{}
+		for _, split := range t.Splits {
+			splits = append(splits, TransactionSplit{Category: categoryIDs[split.Category], Amount: split.Amount})
+		}
+		err = setTransactionSplits(tx, userID, id, splits)
+		if err != nil {
+			return 0, err
+		}
+		restored++
+	}
+
+	err = restoreBackupRecurring(tx, userID, backup.Recurring, accountIDs, categoryIDs, transactionIDs)
+	if err != nil {
+		return 0, err
+	}
+	for _, profile := range backup.ImportProfiles {
+		_, err = tx.Exec(`
+		INSERT INTO import_profiles(user_id, name, delimiter, has_header, date_column, date_format,
+			amount_column, comment_column, category_column, positive_is_expense, account, default_category)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12)
+		ON CONFLICT (user_id, name) DO NOTHING
+		`,
+			userID, profile.Name, profile.Delimiter, profile.HasHeader, profile.DateColumn, profile.DateFormat,
+			profile.AmountColumn, profile.CommentColumn, profile.CategoryColumn, profile.PositiveIsExpense,
+			mappedID(accountIDs, profile.Account), mappedID(categoryIDs, profile.DefaultCategory),
+		)
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	err = tx.Commit()
+	return restored, err
+}
+
+// restoreBackupRecurring creates the recurring transactions missing in the
+// account and records their occurrences, so the scheduler does not create
+// the restored transactions again
+func restoreBackupRecurring(tx *sqlx.Tx, userID int, templates []BackupRecurring,
+	accountIDs map[int32]int32, categoryIDs map[int32]int32, transactionIDs map[int32]int) error {
+	existing := []BackupRecurring{}
+	err := tx.Select(&existing, `
+	SELECT id, kind, account, to_account AS toaccount, category, amount, currency,
+		COALESCE(comment, '') AS comment, frequency, every, cron, to_char(starts, 'YYYY-MM-DD') AS starts
+	FROM recurring_transactions WHERE user_id = $1
+	`, userID)
+	if err != nil {
+		return err
+	}
+	recurringIDs := map[recurringKey]int32{}
+	for _, recurring := range existing {
+		recurringIDs[recurring.key()] = recurring.ID
+	}
+
+	for _, recurring := range templates {
+		recurring.Account = accountIDs[recurring.Account]
+		recurring.ToAccount = mappedID(accountIDs, recurring.ToAccount)
+		recurring.Category = mappedID(categoryIDs, recurring.Category)
+		id, exists := recurringIDs[recurring.key()]
+		if !exists {
+			err = tx.QueryRowx(`
+			INSERT INTO recurring_transactions(user_id, kind, account, to_account, category, amount, currency, comment,
+				frequency, every, cron, starts, ends, processed)
+			VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14) RETURNING id
+			`,
+				userID, recurring.Kind, recurring.Account, recurring.ToAccount, recurring.Category, recurring.Amount,
+				recurring.Currency, recurring.Comment, recurring.Frequency, recurring.Every, recurring.Cron,
+				recurring.Starts, recurring.Ends, recurring.Processed,
+			).Scan(&id)
+			if err != nil {
+				return err
+			}
+			recurringIDs[recurring.key()] = id
+		}
+		for _, occurrence := range recurring.Occurrences {
+			var transactionID *int
+			if occurrence.Transaction != nil {
+				restoredID := transactionIDs[*occurrence.Transaction]
+				transactionID = &restoredID
+			}
+			_, err = tx.Exec(`
+			INSERT INTO recurring_occurrences(recurring_id, date, status, transaction_id) VALUES ($1, $2, $3, $4)
+			ON CONFLICT DO NOTHING
+			`, id, occurrence.Date, occurrence.Status, transactionID)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func downloadBackup(w http.ResponseWriter, r *http.Request, userID int) {
+	backup, err := getBackup(database, userID)
+	if err != nil {
+		log.Println("Backup failed", err)
+		http.Redirect(w, r, "/settings?error=13", 302)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.Header().Set("Content-Disposition", `attachment; filename="egonomy-backup-`+backup.Created.Format(dateLayout)+`.json"`)
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	err = encoder.Encode(backup)
+	if err != nil {
+		log.Println("Backup write failed", err)
+	}
+}
+
+func uploadBackup(w http.ResponseWriter, r *http.Request, userID int) {
+	file, _, err := r.FormFile("backup-file")
+	if err != nil {
+		log.Println(err)
+		http.Redirect(w, r, "/settings?error=3", 302)
+		return
+	}
+	defer file.Close()
+
+	backup, err := parseBackup(io.LimitReader(file, maxBackupSize))
+	if err != nil {
+		log.Println("Parsing backup failed", err)
+		http.Redirect(w, r, "/settings?error=27", 302)
+		return
+	}
+	restored, err := restoreBackup(database, userID, backup)
+	if err != nil {
+		log.Println("Restoring backup failed", err)
+		http.Redirect(w, r, "/settings?error=27", 302)
+		return
+	}
+	log.Println("Restored transactions from backup", restored)
+	http.Redirect(w, r, "/settings?success=6", 302)
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+const sampleBackup = `{
+	"version": 2,
+	"settings": {"week_start": 1, "base_currency": "RUB"},
+	"accounts": [{"id": 1, "name": "Основной", "currency": "RUB", "opening_balance": 100.00},
+		{"id": 2, "name": "Карта", "currency": "USD", "opening_balance": 0}],
+	"categories": [{"id": 5, "name": "Еда"}, {"id": 6, "name": "Кафе", "parent": 5}],
+	"transactions": [
+		{"id": 1, "date": "2020-05-01", "kind": "expense", "account": 1, "to_account": null, "category": 5, "amount": 12.50, "currency": "RUB", "comment": "", "tags": ["отпуск"],
+			"splits": [{"category": 5, "amount": 10}, {"category": 6, "amount": 2.50}]},
+		{"id": 2, "date": "2020-05-02", "kind": "transfer", "account": 1, "to_account": 2, "category": null, "amount": 10, "currency": "RUB", "comment": ""}
+	],
+	"exchange_rates": [{"date": "2020-05-01", "currency": "USD", "base_currency": "RUB", "rate": 73.5}],
+	"sessions": [],
+	"budgets": [{"category": null, "amount": 30000, "since": "2020-05-01"},
+		{"category": 6, "amount": 5000, "rollover": true, "since": "2020-05-01"}],
+	"recurring": [{"id": 3, "kind": "transfer", "account": 1, "to_account": 2, "category": null, "amount": 10, "currency": "RUB", "comment": "",
+		"frequency": "monthly", "every": 1, "starts": "2020-04-02", "processed": "2020-05-02",
+		"occurrences": [{"date": "2020-04-02", "status": "skipped"}, {"date": "2020-05-02", "status": "created", "transaction": 2}]}],
+	"import_profiles": [{"name": "Банк", "delimiter": ";", "has_header": true, "date_column": 0, "date_format": "02.01.2006",
+		"amount_column": 1, "comment_column": -1, "category_column": -1, "positive_is_expense": false, "account": 1, "default_category": 5}]
+}`
+
+func TestParseBackup(t *testing.T) {
+	backup, err := parseBackup(strings.NewReader(sampleBackup))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(backup.Transactions) != 2 || backup.Transactions[0].Amount != 1250 || *backup.Transactions[1].ToAccount != 2 ||
+		len(backup.Transactions[0].Tags) != 1 || len(backup.Transactions[1].Tags) != 0 ||
+		len(backup.Transactions[0].Splits) != 2 || backup.Transactions[0].Splits[1].Amount != 250 {
+		t.Errorf("unexpected transactions %+v", backup.Transactions)
+	}
+	if len(backup.Budgets) != 2 || backup.Budgets[0].Category != nil || !backup.Budgets[1].Rollover {
+		t.Errorf("unexpected budgets %+v", backup.Budgets)
+	}
+	if len(backup.Recurring) != 1 || len(backup.Recurring[0].Occurrences) != 2 ||
+		*backup.Recurring[0].Occurrences[1].Transaction != 2 || len(backup.ImportProfiles) != 1 {
+		t.Errorf("unexpected recurring transactions %+v and import profiles %+v", backup.Recurring, backup.ImportProfiles)
+	}
+
+	// The written backup has to be read back
+	encoded, err := json.Marshal(backup)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = parseBackup(strings.NewReader(string(encoded)))
+	if err != nil {
+		t.Error(err)
+	}
+
+	broken := map[string]string{
+		"version":           strings.Replace(sampleBackup, `"version": 2`, `"version": 99`, 1),
+		"unknown account":   strings.Replace(sampleBackup, `"to_account": 2`, `"to_account": 3`, 1),
+		"unknown category":  strings.Replace(sampleBackup, `"category": 5`, `"category": 7`, 1),
+		"unknown parent":    strings.Replace(sampleBackup, `"parent": 5`, `"parent": 7`, 1),
+		"own parent":        strings.Replace(sampleBackup, `"parent": 5`, `"parent": 6`, 1),
+		"expense target":    strings.Replace(sampleBackup, `"to_account": null`, `"to_account": 2`, 1),
+		"amount":            strings.Replace(sampleBackup, `"amount": 12.50`, `"amount": 0`, 1),
+		"rate":              strings.Replace(sampleBackup, `"rate": 73.5`, `"rate": -1`, 1),
+		"split category":    strings.Replace(sampleBackup, `{"category": 6,`, `{"category": 7,`, 1),
+		"split sum":         strings.Replace(sampleBackup, `"amount": 2.50`, `"amount": 3`, 1),
+		"budget category":   strings.Replace(sampleBackup, `"category": 6, "amount": 5000`, `"category": 7, "amount": 5000`, 1),
+		"budget amount":     strings.Replace(sampleBackup, `"amount": 30000`, `"amount": 0`, 1),
+		"recurring target":  strings.Replace(sampleBackup, `"kind": "transfer", "account": 1, "to_account": 2`, `"kind": "expense", "account": 1, "to_account": 2`, 1),
+		"recurring every":   strings.Replace(sampleBackup, `"every": 1`, `"every": 0`, 1),
+		"occurrence":        strings.Replace(sampleBackup, `"status": "skipped"`, `"status": "deleted"`, 1),
+		"occurrence target": strings.Replace(sampleBackup, `"transaction": 2`, `"transaction": 7`, 1),
+		"profile format":    strings.Replace(sampleBackup, `"date_format": "02.01.2006"`, `"date_format": "2006"`, 1),
+		"profile account":   strings.Replace(sampleBackup, `"account": 1, "default_category"`, `"account": 3, "default_category"`, 1),
+	}
+	for name, input := range broken {
+		_, err = parseBackup(strings.NewReader(input))
+		if err == nil {
+			t.Errorf("%s: broken backup accepted", name)
+		}
+	}
+}
+
+func TestParseBackupVersion1(t *testing.T) {
+	// Backups written before budgets, recurring transactions and import
+	// profiles were added are still restored
+	input := strings.Replace(sampleBackup, `"version": 2`, `"version": 1`, 1)
+	input = input[:strings.Index(input, `,
+	"budgets"`)] + "\n}"
+	backup, err := parseBackup(strings.NewReader(input))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(backup.Budgets) != 0 || len(backup.Recurring) != 0 || len(backup.ImportProfiles) != 0 || len(backup.Transactions) != 2 {
+		t.Errorf("unexpected backup %+v", backup)
+	}
+}
+
+func TestParseBackupLegacyTransfer(t *testing.T) {
+	// Transfers recorded before accounts existed are exported without a target
+	input := strings.Replace(sampleBackup, `"to_account": 2`, `"to_account": null`, 1)
+	backup, err := parseBackup(strings.NewReader(input))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !backup.Transactions[1].isLegacyTransfer() || backup.Transactions[0].isLegacyTransfer() {
+		t.Errorf("legacy transfer is not told apart: %+v", backup.Transactions)
+	}
+}
+
+func TestBackupTransactionKey(t *testing.T) {
+	category := int32(5)
+	withCategory := BackupTransaction{Date: "2020-05-01", Kind: kindExpense, Account: 1, Category: &category, Amount: 100}
+	withoutCategory := withCategory
+	withoutCategory.Category = nil
+	if withCategory.key() == withoutCategory.key() {
+		t.Error("transactions of different categories have equal keys")
+	}
+	sameCategory := int32(5)
+	copied := withCategory
+	copied.ID = 10
+	copied.Category = &sameCategory
+	if withCategory.key() != copied.key() {
+		t.Error("identifiers of transactions are a part of the key")
+	}
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// Sizes of time buckets of charts and the API
+const (
+	bucketDay   = "day"
+	bucketWeek  = "week"
+	bucketMonth = "month"
+)
+
+// maxBuckets limits the length of requested series, a daily chart over
+// several years is unreadable anyway
+const maxBuckets = 400
+
+// BucketAmount - sum of transactions of one category within one time bucket
+type BucketAmount struct {
+	Start        time.Time `json:"-"`
+	Date         string    `json:"start"`
+	Category     int32     `json:"category"`
+	CategoryName string    `json:"category_name"`
+	Amount       Money     `json:"amount"`
+}
+
+func isValidBucketUnit(unit string) bool {
+	return unit == bucketDay || unit == bucketWeek || unit == bucketMonth
+}
+
+// bucketStart returns the first day of the bucket containing the date, weeks
+// start on the day chosen by the user
+func bucketStart(date time.Time, unit string, weekStart time.Weekday) time.Time {
+	starts := getPeriodStarts(date, weekStart)
+	switch unit {
+	case bucketWeek:
+		return starts.Week
+	case bucketMonth:
+		return starts.Month
+	}
+	return starts.Day
+}
+
+// bucketStarts lists all the buckets between the dates, including empty ones
+func bucketStarts(unit string, from time.Time, to time.Time, weekStart time.Weekday) []time.Time {
+	starts := []time.Time{}
+	for start := bucketStart(from, unit, weekStart); !start.After(to); {
+		starts = append(starts, start)
+		switch unit {
+		case bucketWeek:
+			start = start.AddDate(0, 0, 7)
+		case bucketMonth:
+			start = start.AddDate(0, 1, 0)
+		default:
+			start = start.AddDate(0, 0, 1)
+		}
+	}
+	return starts
+}
+
+// parseBucketRange reads unit, from and to query parameters. The range ends
+// today and covers a dozen of buckets unless given otherwise.
+func parseBucketRange(r *http.Request, now time.Time, weekStart time.Weekday) (unit string, from time.Time, to time.Time, errorCode int) {
+	unit = r.URL.Query().Get("unit")
+	if unit == "" {
+		unit = bucketMonth
+	}
+	if !isValidBucketUnit(unit) {
+		return unit, from, to, 28
+	}
+	filter, errorCode := parseTransactionFilter(r)
+	if errorCode != 0 {
+		return unit, from, to, errorCode
+	}
+
+	year, month, day := now.Date()
+	to = time.Date(year, month, day, 0, 0, 0, 0, time.UTC)
+	if !filter.To.IsZero() {
+		to = filter.To
+	}
+	from = filter.From
+	if from.IsZero() {
+		switch unit {
+		case bucketDay:
+			from = to.AddDate(0, 0, -29)
+		case bucketWeek:
+			from = to.AddDate(0, 0, -7*11)
+		default:
+			from = time.Date(to.Year(), to.Month()-11, 1, 0, 0, 0, 0, time.UTC)
+		}
+	}
+	// Buckets are always complete
+	from = bucketStart(from, unit, weekStart)
+	if to.Before(from) || len(bucketStarts(unit, from, to, weekStart)) > maxBuckets {
+		return unit, from, to, 28
+	}
+	return unit, from, to, 0
+}
+
+// getBucketAmounts sums transactions of the kind by buckets and categories,
+// amounts are converted to the base currency of the user. Empty buckets are
+// not returned, bucketStarts lists them. Transactions without a rate are left
+// out.
+func getBucketAmounts(db *sqlx.DB, userID int, kind string, unit string, from time.Time, to time.Time, weekStart time.Weekday) (amounts []BucketAmount, err error) {
+	rows, err := db.Queryx(`
+	SELECT start, COALESCE(c.id, 0) AS category, COALESCE(c.name, '') AS categoryname, SUM(amount) AS amount
+	FROM (
+		SELECT t.category, `+convertedAmountSQL("u.base_currency")+` AS amount,
+			CASE $2::text
+				WHEN 'week' THEN t.date - (EXTRACT(DOW FROM t.date)::int - $3::int + 7) % 7
+				WHEN 'month' THEN date_trunc('month', t.date)::date
+				ELSE t.date
+			END AS start
+		FROM `+transactionLinesSQL+` t
+		JOIN users u
+		ON t.user_id = u.id
+		WHERE t.user_id = $1 AND t.kind = $6 AND t.date >= $4::date AND t.date <= $5::date
+	) AS b
+	LEFT JOIN categories c
+	ON b.category = c.id
+	WHERE b.amount IS NOT NULL
+	GROUP BY start, c.id, c.name
+	ORDER BY start, amount DESC
+	`, userID, unit, int(weekStart), from.Format(dateLayout), to.Format(dateLayout), kind)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	amounts = []BucketAmount{}
+	for rows.Next() {
+		var amount BucketAmount
+		err = rows.Scan(&amount.Start, &amount.Category, &amount.CategoryName, &amount.Amount)
+		if err != nil {
+			return nil, err
+		}
+		amount.Date = amount.Start.Format(dateLayout)
+		amounts = append(amounts, amount)
+	}
+	return amounts, rows.Err()
+}
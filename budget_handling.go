@@ -0,0 +1,275 @@
+package main
+
+import (
+	"html/template"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+)
+
+const monthLayout = "2006-01"
+
+// Budget - element of corresponding table, the monthly limit of expenses in
+// the base currency. Category 0 is the overall budget.
+type Budget struct {
+	ID           int
+	Category     int32
+	CategoryName string
+	Limit        Money
+	Rollover     bool
+	Since        time.Time
+}
+
+// BudgetProgress - state of the budget in some month
+type BudgetProgress struct {
+	Budget
+	Spent   Money
+	Carried Money
+}
+
+// Available - the limit with the amount carried from the previous months
+func (p BudgetProgress) Available() Money {
+	return p.Limit + p.Carried
+}
+
+// Remaining - amount which still can be spent, negative when overspent
+func (p BudgetProgress) Remaining() Money {
+	return p.Available() - p.Spent
+}
+
+// Percent - spent share of the available amount for progress bars, limited by 100
+func (p BudgetProgress) Percent() int {
+	if p.Available() <= 0 {
+		return 100
+	}
+	percent := int(int64(p.Spent) * 100 / int64(p.Available()))
+	if percent > 100 {
+		return 100
+	}
+	return percent
+}
+
+// ProgressClass - color of the progress bar
+func (p BudgetProgress) ProgressClass() string {
+	switch {
+	case p.Spent > p.Available():
+		return "bg-danger"
+	case p.Percent() >= 80:
+		return "bg-warning"
+	}
+	return "bg-success"
+}
+
+// BudgetViewData - information to display on page
+type BudgetViewData struct {
+	LayoutData
+	Title            string
+	BaseCurrency     string
+	Month            time.Time
+	Budgets          []BudgetProgress
+	Categories       []Category
+	ErrorDescription string
+}
+
+// MonthlyExpenses - expenses by months and categories, uncategorized ones
+// are stored under category 0
+type MonthlyExpenses map[string]map[int32]Money
+
+// spent sums expenses of the category with its subcategories, category 0
+// sums all the expenses
+func (e MonthlyExpenses) spent(month time.Time, category int32, tree CategoryTree) Money {
+	var total Money
+	for id, amount := range e[month.Format(monthLayout)] {
+		if category == 0 || (id != 0 && tree.isWithin(id, category)) {
+			total += amount
+		}
+	}
+	return total
+}
+
+func getMonthStart(date time.Time) time.Time {
+	return time.Date(date.Year(), date.Month(), 1, 0, 0, 0, 0, time.UTC)
+}
+
+func getAllBudgetsOfUser(db *sqlx.DB, userID int) (budgets []Budget, err error) {
+	budgets = []Budget{}
+	err = db.Select(&budgets, `
+	SELECT b.id, COALESCE(b.category, 0) AS category, COALESCE(c.name, '') AS categoryname,
+		b.amount AS "limit", b.rollover, b.since
+	FROM budgets b
+	LEFT JOIN categories c
+	ON b.category = c.id
+	WHERE b.user_id = $1
+	ORDER BY b.category IS NOT NULL, c.name
+	`, userID)
+	return budgets, err
+}
+
+// getMonthlyExpenses sums expenses converted to the base currency by months
+func getMonthlyExpenses(db *sqlx.DB, userID int, from time.Time, to time.Time) (MonthlyExpenses, error) {
+	rows, err := db.Queryx(`
+	SELECT to_char(date, 'YYYY-MM') AS month, COALESCE(category, 0) AS category, SUM(amount) AS amount
+	FROM (`+convertedTransactionsSQL()+`) AS converted
+	WHERE kind = 'expense'
+	GROUP BY 1, 2
+	`, userID, from.Format(dateLayout), to.Format(dateLayout))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	expenses := MonthlyExpenses{}
+	for rows.Next() {
+		var (
+			month    string
+			category int32
+			amount   Money
+		)
+		err = rows.Scan(&month, &category, &amount)
+		if err != nil {
+			return nil, err
+		}
+		if expenses[month] == nil {
+			expenses[month] = map[int32]Money{}
+		}
+		expenses[month][category] = amount
+	}
+	return expenses, rows.Err()
+}
+
+// computeBudgetProgress returns the state of the budgets in the month. Budgets
+// of categories include their subcategories. Unspent amounts of the previous
+// months are carried for budgets with rollover, overspending is not carried.
+func computeBudgetProgress(budgets []Budget, expenses MonthlyExpenses, tree CategoryTree, month time.Time) []BudgetProgress {
+	month = getMonthStart(month)
+	progress := make([]BudgetProgress, len(budgets))
+	for i, budget := range budgets {
+		progress[i] = BudgetProgress{Budget: budget, Spent: expenses.spent(month, budget.Category, tree)}
+		if !budget.Rollover {
+			continue
+		}
+		for m := getMonthStart(budget.Since); m.Before(month); m = m.AddDate(0, 1, 0) {
+			progress[i].Carried += budget.Limit - expenses.spent(m, budget.Category, tree)
+			if progress[i].Carried < 0 {
+				progress[i].Carried = 0
+			}
+		}
+	}
+	return progress
+}
+
+// getBudgetProgress returns the state of all the budgets of the user in the month
+func getBudgetProgress(db *sqlx.DB, userID int, month time.Time) ([]BudgetProgress, error) {
+	budgets, err := getAllBudgetsOfUser(db, userID)
+	if err != nil || len(budgets) == 0 {
+		return []BudgetProgress{}, err
+	}
+	from := getMonthStart(month)
+	for _, budget := range budgets {
+		if budget.Rollover && budget.Since.Before(from) {
+			from = getMonthStart(budget.Since)
+		}
+	}
+	to := getMonthStart(month).AddDate(0, 1, -1)
+	expenses, err := getMonthlyExpenses(db, userID, from, to)
+	if err != nil {
+		return []BudgetProgress{}, err
+	}
+	tree, err := getCategoryTree(db, userID)
+	if err != nil {
+		return []BudgetProgress{}, err
+	}
+	return computeBudgetProgress(budgets, expenses, tree, month), nil
+}
+
+func budgetsView(w http.ResponseWriter, r *http.Request, userID int) {
+	now := time.Now()
+	progress, err := getBudgetProgress(database, userID, now)
+	if err != nil {
+		log.Println("Query budgets failed", err)
+	}
+	baseCurrency, err := getUserBaseCurrency(database, userID)
+	if err != nil {
+		log.Println(err)
+	}
+
+	data := BudgetViewData{
+		Title:            "Бюджеты",
+		BaseCurrency:     baseCurrency,
+		Month:            getMonthStart(now),
+		Budgets:          progress,
+		Categories:       getAllCategoriesOfUser(database, userID),
+		ErrorDescription: allErrors[getErrorCode(r)],
+	}
+	tmpl, err := template.ParseFiles("templates/layout.html", "templates/budgets.html", "templates/navigation_logedin.html")
+	if err != nil {
+		log.Println(err)
+	}
+	renderLayout(w, r, tmpl, &data)
+}
+
+// saveBudget creates the budget of the category or changes its limit, the
+// month the budget was created in stays the same
+func saveBudget(w http.ResponseWriter, r *http.Request, userID int) {
+	err := r.ParseForm()
+	if err != nil {
+		log.Println(err)
+		http.Redirect(w, r, "/budgets?error=3", 302)
+		return
+	}
+	var category *int32
+	if value := r.FormValue("category-id"); value != "" {
+		categoryID, err := strconv.ParseInt(value, 10, 32)
+		if err != nil {
+			log.Println(err)
+			http.Redirect(w, r, "/budgets?error=4", 302)
+			return
+		}
+		id := int32(categoryID)
+		exists, err := isCategoryOfUser(id, userID)
+		if err != nil {
+			log.Println(err)
+		}
+		if !exists {
+			http.Redirect(w, r, "/budgets?error=4", 302)
+			return
+		}
+		category = &id
+	}
+	limit, err := ParseMoney(r.FormValue("amount"))
+	if err != nil || !limit.IsPositive() {
+		log.Println("Invalid budget", r.FormValue("amount"))
+		http.Redirect(w, r, "/budgets?error=5", 302)
+		return
+	}
+	rollover := r.FormValue("rollover") != ""
+
+	_, err = database.Exec(`
+	INSERT INTO budgets(user_id, category, amount, rollover, since) VALUES ($1, $2, $3, $4, $5)
+	ON CONFLICT (user_id, COALESCE(category, 0)) DO UPDATE SET amount = EXCLUDED.amount, rollover = EXCLUDED.rollover
+	`, userID, category, limit, rollover, getMonthStart(time.Now()).Format(dateLayout))
+	if err != nil {
+		log.Println(err)
+		http.Redirect(w, r, "/budgets?error=6", 302)
+		return
+	}
+	http.Redirect(w, r, "/budgets", 302)
+}
+
+func deleteBudget(w http.ResponseWriter, r *http.Request, userID int) {
+	err := r.ParseForm()
+	if err != nil {
+		log.Println(err)
+	}
+	_, err = database.Exec(
+		"DELETE FROM budgets WHERE id = $1 AND user_id = $2",
+		r.FormValue("budget-id"), userID,
+	)
+	if err != nil {
+		log.Println(err)
+	}
+	http.Redirect(w, r, "/budgets", 302)
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestComputeBudgetProgress(t *testing.T) {
+	march := time.Date(2020, time.March, 15, 0, 0, 0, 0, time.UTC)
+	expenses := MonthlyExpenses{
+		"2020-01": {1: 8000, 2: 500},
+		"2020-02": {1: 12000, 0: 300},
+		"2020-03": {1: 4000, 2: 1000},
+	}
+	budgets := []Budget{
+		{Category: 0, Limit: 20000},
+		{Category: 1, Limit: 10000, Rollover: true, Since: time.Date(2020, time.January, 1, 0, 0, 0, 0, time.UTC)},
+		{Category: 2, Limit: 1000, Rollover: true, Since: time.Date(2020, time.February, 10, 0, 0, 0, 0, time.UTC)},
+	}
+	progress := computeBudgetProgress(budgets, expenses, CategoryTree{1: 0, 2: 0}, march)
+
+	overall := progress[0]
+	if overall.Spent != 5000 || overall.Carried != 0 || overall.Remaining() != 15000 || overall.Percent() != 25 {
+		t.Errorf("unexpected overall budget %+v", overall)
+	}
+	// 2000 are left in January, February overspending takes them all
+	category := progress[1]
+	if category.Carried != 0 || category.Spent != 4000 || category.ProgressClass() != "bg-success" {
+		t.Errorf("unexpected category budget %+v", category)
+	}
+	// Nothing was spent in February, the budget started then
+	rollover := progress[2]
+	if rollover.Carried != 1000 || rollover.Available() != 2000 || rollover.Percent() != 50 {
+		t.Errorf("unexpected rollover budget %+v", rollover)
+	}
+}
+
+func TestBudgetIncludesSubcategories(t *testing.T) {
+	march := time.Date(2020, time.March, 1, 0, 0, 0, 0, time.UTC)
+	expenses := MonthlyExpenses{"2020-03": {1: 1000, 2: 2000, 3: 400, 0: 50}}
+	// Food contains Restaurants, Restaurants contain Cafes
+	tree := CategoryTree{1: 0, 2: 1, 3: 2}
+	budgets := []Budget{{Category: 0}, {Category: 1}, {Category: 2}, {Category: 3}}
+	progress := computeBudgetProgress(budgets, expenses, tree, march)
+	expected := []Money{3450, 3400, 2400, 400}
+	for i, p := range progress {
+		if p.Spent != expected[i] {
+			t.Errorf("budget of category %d spent %s, expected %s", p.Category, p.Spent, expected[i])
+		}
+	}
+}
+
+func TestBudgetProgressClass(t *testing.T) {
+	cases := []struct {
+		progress BudgetProgress
+		percent  int
+		class    string
+	}{
+		{BudgetProgress{Budget: Budget{Limit: 1000}, Spent: 850}, 85, "bg-warning"},
+		{BudgetProgress{Budget: Budget{Limit: 1000}, Spent: 1000}, 100, "bg-warning"},
+		{BudgetProgress{Budget: Budget{Limit: 1000}, Spent: 1500}, 100, "bg-danger"},
+	}
+	for _, c := range cases {
+		if c.progress.Percent() != c.percent || c.progress.ProgressClass() != c.class {
+			t.Errorf("%+v: %d %s", c.progress, c.progress.Percent(), c.progress.ProgressClass())
+		}
+	}
+}
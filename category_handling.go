@@ -1,60 +1,378 @@
 package main
 
 import (
+	"errors"
 	"html/template"
 	"log"
 	"net/http"
+	"sort"
 	"strconv"
+	"strings"
 
 	"github.com/jmoiron/sqlx"
 )
 
-// Category - element of corresponding table
+var (
+	errCategoryNotFound = errors.New("category not found")
+	errCategoryCycle    = errors.New("category can not be nested into itself")
+	errCategoryUsed     = errors.New("category has transactions")
+	errSameCategory     = errors.New("category can not be merged into itself")
+)
+
+// Category - element of corresponding table, Parent is 0 for top level
+// categories and Depth is the level in the tree. Archived categories are
+// hidden from entry forms.
 type Category struct {
-	ID   int
-	Name string
+	ID       int
+	Name     string
+	Parent   int
+	Archived bool
+	Depth    int
+}
+
+// Label - name indented by the level for lists of categories
+func (c Category) Label() string {
+	label := strings.Repeat("— ", c.Depth) + c.Name
+	if c.Archived {
+		label += " (в архиве)"
+	}
+	return label
 }
 
 // CategoryViewData - information to display on page
 type CategoryViewData struct {
-	Title      string
-	Categories []Category
+	LayoutData
+	Title            string
+	Categories       []Category
+	ErrorDescription string
 }
 
 // CategoryEditorViewData - information to display on page
 type CategoryEditorViewData struct {
-	Title    string
-	Category Category
+	LayoutData
+	Title            string
+	Category         Category
+	Parents          []Category
+	Targets          []Category
+	ErrorDescription string
 }
 
-func allCategoriesView(w http.ResponseWriter, r *http.Request, userID int) {
-	rows, err := database.Queryx("SELECT id, name FROM categories WHERE user_id = $1 ORDER BY name DESC", userID)
-	if err != nil {
-		log.Fatal(err)
+// CategoryDeleteViewData - information to display on page
+type CategoryDeleteViewData struct {
+	LayoutData
+	Title            string
+	Category         Category
+	Transactions     int
+	Targets          []Category
+	ErrorDescription string
+}
+
+// CategoryTree - parents of categories, 0 for the top level ones
+type CategoryTree map[int32]int32
+
+func newCategoryTree(categories []Category) CategoryTree {
+	tree := CategoryTree{}
+	for _, category := range categories {
+		tree[int32(category.ID)] = int32(category.Parent)
 	}
-	defer rows.Close()
+	return tree
+}
+
+// ancestors returns parents of the category starting from the closest one
+func (t CategoryTree) ancestors(id int32) []int32 {
+	ancestors := []int32{}
+	// The length limit stops the walk on a loop in broken data
+	for parent := t[id]; parent != 0 && len(ancestors) < len(t); parent = t[parent] {
+		ancestors = append(ancestors, parent)
+	}
+	return ancestors
+}
 
+// root returns the top level category the category belongs to
+func (t CategoryTree) root(id int32) int32 {
+	ancestors := t.ancestors(id)
+	if len(ancestors) == 0 {
+		return id
+	}
+	return ancestors[len(ancestors)-1]
+}
+
+// isWithin reports whether the category is the ancestor or its subcategory
+func (t CategoryTree) isWithin(id int32, ancestor int32) bool {
+	if id == ancestor {
+		return true
+	}
+	for _, parent := range t.ancestors(id) {
+		if parent == ancestor {
+			return true
+		}
+	}
+	return false
+}
+
+// canMove reports whether the category can be nested into the parent without
+// a loop, parent 0 makes the category a top level one
+func (t CategoryTree) canMove(id int32, parent int32) bool {
+	return parent == 0 || !t.isWithin(parent, id)
+}
+
+// walk visits the categories depth first, subcategories right after their
+// parent in the order given by less. Categories whose parent is not in ids
+// are visited as top level ones.
+func (t CategoryTree) walk(ids []int32, less func(a int32, b int32) bool, visit func(id int32, depth int)) {
+	present := map[int32]bool{}
+	for _, id := range ids {
+		present[id] = true
+	}
+	roots := []int32{}
+	children := map[int32][]int32{}
+	for _, id := range ids {
+		parent := t[id]
+		if parent == 0 || parent == id || !present[parent] {
+			roots = append(roots, id)
+			continue
+		}
+		children[parent] = append(children[parent], id)
+	}
+
+	var visitLevel func(level []int32, depth int)
+	visitLevel = func(level []int32, depth int) {
+		sort.SliceStable(level, func(i, j int) bool {
+			return less(level[i], level[j])
+		})
+		for _, id := range level {
+			visit(id, depth)
+			visitLevel(children[id], depth+1)
+		}
+	}
+	visitLevel(roots, 0)
+}
+
+// sortCategories orders the categories as a tree by names and fills Depth
+func sortCategories(categories []Category) []Category {
+	tree := newCategoryTree(categories)
+	byID := map[int32]Category{}
+	ids := make([]int32, len(categories))
+	for i, category := range categories {
+		byID[int32(category.ID)] = category
+		ids[i] = int32(category.ID)
+	}
+	sorted := make([]Category, 0, len(categories))
+	tree.walk(ids, func(a int32, b int32) bool {
+		return byID[a].Name < byID[b].Name
+	}, func(id int32, depth int) {
+		category := byID[id]
+		category.Depth = depth
+		sorted = append(sorted, category)
+	})
+	return sorted
+}
+
+func getCategoryTree(db sqlx.Queryer, userID int) (CategoryTree, error) {
 	categories := []Category{}
+	err := sqlx.Select(db, &categories, "SELECT id, name, COALESCE(parent, 0) AS parent FROM categories WHERE user_id = $1", userID)
+	if err != nil {
+		return nil, err
+	}
+	return newCategoryTree(categories), nil
+}
 
-	for rows.Next() {
-		var c Category
-		err := rows.StructScan(&c)
+// setCategoryParent nests the category into the parent, 0 makes it a top
+// level one. Loops are not allowed.
+func setCategoryParent(db *sqlx.DB, userID int, categoryID int32, parentID int32) (err error) {
+	tx, err := db.Beginx()
+	if err != nil {
+		return err
+	}
+	defer func() {
 		if err != nil {
-			log.Fatal(err)
+			tx.Rollback()
 		}
-		categories = append(categories, c)
+	}()
+
+	// Two moves checked at the same time could make a loop together
+	_, err = tx.Exec("SELECT id FROM categories WHERE user_id = $1 FOR UPDATE", userID)
+	if err != nil {
+		return err
 	}
-	err = rows.Err()
+	tree, err := getCategoryTree(tx, userID)
 	if err != nil {
-		log.Fatal(err)
+		return err
+	}
+	if _, ok := tree[categoryID]; !ok {
+		return errCategoryNotFound
+	}
+	if _, ok := tree[parentID]; !ok && parentID != 0 {
+		return errCategoryNotFound
+	}
+	if !tree.canMove(categoryID, parentID) {
+		return errCategoryCycle
+	}
+	_, err = tx.Exec(
+		"UPDATE categories SET parent = NULLIF($1, 0) WHERE id = $2 AND user_id = $3",
+		parentID, categoryID, userID,
+	)
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// countCategoryTransactions returns the number of transactions, including
+// split ones with a line of the category, and recurring transactions
+func countCategoryTransactions(db sqlx.Queryer, categoryID int32) (count int, err error) {
+	err = db.QueryRowx(`
+	SELECT (
+			SELECT COUNT(*) FROM transactions t WHERE t.category = $1 OR EXISTS (
+				SELECT 1 FROM transaction_splits s WHERE s.transaction_id = t.id AND s.category = $1
+			)
+		) +
+		(SELECT COUNT(*) FROM recurring_transactions WHERE category = $1)
+	`, categoryID).Scan(&count)
+	return count, err
+}
+
+// mergeCategory moves transactions, lines of split transactions, recurring
+// transactions, import profiles and the budget of the category to the target
+// and deletes the category, its subcategories move to its parent. Target 0 is
+// allowed only for categories without transactions. All of it is done in one
+// database transaction.
+func mergeCategory(db *sqlx.DB, userID int, categoryID int32, targetID int32) (err error) {
+	tx, err := db.Beginx()
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			tx.Rollback()
+		}
+	}()
+
+	_, err = tx.Exec("SELECT id FROM categories WHERE user_id = $1 FOR UPDATE", userID)
+	if err != nil {
+		return err
+	}
+	tree, err := getCategoryTree(tx, userID)
+	if err != nil {
+		return err
+	}
+	if _, ok := tree[categoryID]; !ok {
+		return errCategoryNotFound
+	}
+	if _, ok := tree[targetID]; !ok && targetID != 0 {
+		return errCategoryNotFound
+	}
+	if targetID == categoryID {
+		return errSameCategory
+	}
+
+	if targetID == 0 {
+		count, err := countCategoryTransactions(tx, categoryID)
+		if err != nil {
+			return err
+		}
+		if count > 0 {
+			return errCategoryUsed
+		}
+	} else {
+		queries := []string{
+			"UPDATE transactions SET category = $1 WHERE category = $2",
+			"UPDATE transaction_splits SET category = $1 WHERE category = $2",
+			"UPDATE recurring_transactions SET category = $1 WHERE category = $2",
+			"UPDATE import_profiles SET default_category = $1 WHERE default_category = $2",
+			// The budget of the target stays when both categories have one
+			"UPDATE budgets SET category = $1 WHERE category = $2 AND NOT EXISTS (SELECT 1 FROM budgets WHERE category = $1)",
+		}
+		for _, query := range queries {
+			_, err = tx.Exec(query, targetID, categoryID)
+			if err != nil {
+				return err
+			}
+		}
 	}
 
+	_, err = tx.Exec(
+		"UPDATE categories SET parent = NULLIF($1, 0) WHERE parent = $2 AND user_id = $3",
+		tree[categoryID], categoryID, userID,
+	)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec("DELETE FROM categories WHERE id = $1 AND user_id = $2", categoryID, userID)
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// setCategoryArchived archives or returns the category with its subcategories
+func setCategoryArchived(db *sqlx.DB, userID int, categoryID int32, archived bool) error {
+	result, err := db.Exec(`
+	WITH RECURSIVE subcategories(id) AS (
+		SELECT id FROM categories WHERE id = $1 AND user_id = $2
+		UNION
+		SELECT c.id FROM categories c JOIN subcategories s ON c.parent = s.id
+	)
+	UPDATE categories SET archived = $3 WHERE id IN (SELECT id FROM subcategories)
+	`, categoryID, userID, archived)
+	if err != nil {
+		return err
+	}
+	if affected, _ := result.RowsAffected(); affected == 0 {
+		return errCategoryNotFound
+	}
+	return nil
+}
+
+// withoutArchived removes archived categories from the list except the ones
+// which are still used by the edited item
+func withoutArchived(categories []Category, keepIDs ...int) []Category {
+	active := []Category{}
+	for _, category := range categories {
+		keep := !category.Archived
+		for _, id := range keepIDs {
+			keep = keep || category.ID == id
+		}
+		if keep {
+			active = append(active, category)
+		}
+	}
+	return active
+}
+
+// parseParentID reads the optional parent-id form field, empty is 0
+func parseParentID(r *http.Request) (int32, error) {
+	value := r.FormValue("parent-id")
+	if value == "" {
+		return 0, nil
+	}
+	parentID, err := strconv.ParseInt(value, 10, 32)
+	return int32(parentID), err
+}
+
+// categoryErrorCode returns the code of the error shown on the categories page
+func categoryErrorCode(err error) int {
+	switch err {
+	case errCategoryNotFound:
+		return 4
+	case errCategoryCycle:
+		return 30
+	case errCategoryUsed:
+		return 31
+	case errSameCategory:
+		return 32
+	}
+	return 6
+}
+
+func allCategoriesView(w http.ResponseWriter, r *http.Request, userID int) {
 	data := CategoryViewData{
-		Title:      "Вход",
-		Categories: categories,
+		Title:            "Вход",
+		Categories:       getCategoriesOfUser(database, userID, true),
+		ErrorDescription: allErrors[getErrorCode(r)],
 	}
 	tmpl, _ := template.ParseFiles("templates/layout.html", "templates/categories.html", "templates/navigation_logedin.html")
-	tmpl.ExecuteTemplate(w, "layout", data)
+	renderLayout(w, r, tmpl, &data)
 }
 
 func editCategoryView(w http.ResponseWriter, r *http.Request, userID int) {
@@ -67,20 +385,32 @@ func editCategoryView(w http.ResponseWriter, r *http.Request, userID int) {
 			log.Println(err)
 		}
 	}
-	categoryNames := r.URL.Query()["category-name"]
-	var categoryName string
-	if len(categoryNames) > 0 {
-		categoryName = categoryNames[0]
-	} else {
-		log.Print("Error: you need to pass category-name")
-	}
 
+	categories := getCategoriesOfUser(database, userID, true)
+	tree := newCategoryTree(categories)
 	data := CategoryEditorViewData{
-		Title:    "Вход",
-		Category: Category{ID: int(categoryID), Name: categoryName},
+		Title:            "Вход",
+		Parents:          []Category{},
+		Targets:          []Category{},
+		ErrorDescription: allErrors[getErrorCode(r)],
+	}
+	for _, category := range categories {
+		if category.ID == int(categoryID) {
+			data.Category = category
+		} else {
+			data.Targets = append(data.Targets, category)
+		}
+		// The category can not be moved into itself or its subcategories
+		if tree.canMove(int32(categoryID), int32(category.ID)) {
+			data.Parents = append(data.Parents, category)
+		}
+	}
+	if data.Category.ID == 0 {
+		http.Redirect(w, r, "/categories?error=4", 302)
+		return
 	}
 	tmpl, _ := template.ParseFiles("templates/layout.html", "templates/categories_editor.html", "templates/navigation_logedin.html")
-	tmpl.ExecuteTemplate(w, "layout", data)
+	renderLayout(w, r, tmpl, &data)
 }
 
 func addNewCategory(w http.ResponseWriter, r *http.Request, userID int) {
@@ -90,10 +420,26 @@ func addNewCategory(w http.ResponseWriter, r *http.Request, userID int) {
 	}
 
 	categoryName := r.FormValue("category-name")
+	parentID, err := parseParentID(r)
+	if err != nil {
+		log.Println(err)
+		http.Redirect(w, r, "/categories?error=4", 302)
+		return
+	}
+	if parentID != 0 {
+		exists, err := isCategoryOfUser(parentID, userID)
+		if err != nil {
+			log.Println(err)
+		}
+		if !exists {
+			http.Redirect(w, r, "/categories?error=4", 302)
+			return
+		}
+	}
 
 	_, err = database.Exec(
-		"INSERT INTO categories(name, user_id) VALUES ($1, $2)",
-		categoryName, userID,
+		"INSERT INTO categories(name, user_id, parent) VALUES ($1, $2, NULLIF($3, 0))",
+		categoryName, userID, parentID,
 	)
 	if err != nil {
 		log.Println(err)
@@ -117,38 +463,159 @@ func editCategory(w http.ResponseWriter, r *http.Request, userID int) {
 	if err != nil {
 		log.Println(err)
 	}
+	moveCategory(w, r, userID)
+}
+
+// moveCategory changes the parent of the category, it is used by the editor
+// and by dragging categories on the categories page
+func moveCategory(w http.ResponseWriter, r *http.Request, userID int) {
+	err := r.ParseForm()
+	if err != nil {
+		log.Println(err)
+	}
+	categoryID, err := strconv.ParseInt(r.FormValue("category-id"), 10, 32)
+	if err != nil {
+		log.Println(err)
+		http.Redirect(w, r, "/categories?error=4", 302)
+		return
+	}
+	parentID, err := parseParentID(r)
+	if err != nil {
+		log.Println(err)
+		http.Redirect(w, r, "/categories?error=4", 302)
+		return
+	}
+	err = setCategoryParent(database, userID, int32(categoryID), parentID)
+	if err != nil {
+		log.Println("Moving category failed", err)
+		http.Redirect(w, r, "/categories?error="+strconv.Itoa(categoryErrorCode(err)), 302)
+		return
+	}
 	http.Redirect(w, r, "/categories", 302)
 }
 
+func deleteCategoryView(w http.ResponseWriter, r *http.Request, userID int) {
+	categoryID, err := strconv.ParseInt(r.URL.Query().Get("category-id"), 10, 32)
+	if err != nil {
+		log.Println(err)
+		http.Redirect(w, r, "/categories?error=4", 302)
+		return
+	}
+
+	data := CategoryDeleteViewData{
+		Title:            "Вход",
+		Targets:          []Category{},
+		ErrorDescription: allErrors[getErrorCode(r)],
+	}
+	for _, category := range getCategoriesOfUser(database, userID, true) {
+		if category.ID == int(categoryID) {
+			data.Category = category
+		} else {
+			data.Targets = append(data.Targets, category)
+		}
+	}
+	if data.Category.ID == 0 {
+		http.Redirect(w, r, "/categories?error=4", 302)
+		return
+	}
+	data.Transactions, err = countCategoryTransactions(database, int32(categoryID))
+	if err != nil {
+		log.Println(err)
+	}
+	tmpl, _ := template.ParseFiles("templates/layout.html", "templates/categories_delete.html", "templates/navigation_logedin.html")
+	renderLayout(w, r, tmpl, &data)
+}
+
+// deleteCategory deletes the category moving its transactions to the target
+// category, the target can be omitted for categories without transactions
 func deleteCategory(w http.ResponseWriter, r *http.Request, userID int) {
+	removeCategory(w, r, userID, "/categories/delete", false)
+}
+
+// mergeCategories merges the category into the target
+func mergeCategories(w http.ResponseWriter, r *http.Request, userID int) {
+	removeCategory(w, r, userID, "/categories/edit", true)
+}
+
+// removeCategory merges the category into the target-id category, errors are
+// shown on the page the form was sent from
+func removeCategory(w http.ResponseWriter, r *http.Request, userID int, formPage string, targetRequired bool) {
 	err := r.ParseForm()
 	if err != nil {
 		log.Println(err)
 	}
-	categoryID := r.FormValue("category-id")
-	var categoryUserID int
-	err = database.QueryRowx("select user_id from categories where id = $1", categoryID).Scan(&categoryUserID)
+	categoryID, err := strconv.ParseInt(r.FormValue("category-id"), 10, 32)
 	if err != nil {
 		log.Println(err)
+		http.Redirect(w, r, "/categories?error=4", 302)
+		return
 	}
-
-	if userID == categoryUserID {
-		log.Println("Delete category")
-		_, err = database.Exec(
-			"DELETE FROM categories WHERE id = $1 AND user_id = $2",
-			categoryID, userID,
-		)
+	var targetID int64
+	if value := r.FormValue("target-id"); value != "" {
+		targetID, err = strconv.ParseInt(value, 10, 32)
 		if err != nil {
 			log.Println(err)
+			http.Redirect(w, r, "/categories?error=4", 302)
+			return
 		}
-	} else {
-		log.Println("Wrong user")
+	}
+
+	formPage += "?category-id=" + strconv.FormatInt(categoryID, 10)
+	if targetRequired && targetID == 0 {
+		http.Redirect(w, r, formPage+"&error=4", 302)
+		return
+	}
+
+	err = mergeCategory(database, userID, int32(categoryID), int32(targetID))
+	if err != nil {
+		log.Println("Deleting category failed", err)
+		http.Redirect(w, r, formPage+"&error="+strconv.Itoa(categoryErrorCode(err)), 302)
+		return
+	}
+	http.Redirect(w, r, "/categories", 302)
+}
+
+func archiveCategory(w http.ResponseWriter, r *http.Request, userID int) {
+	changeCategoryArchived(w, r, userID, true)
+}
+
+func unarchiveCategory(w http.ResponseWriter, r *http.Request, userID int) {
+	changeCategoryArchived(w, r, userID, false)
+}
+
+func changeCategoryArchived(w http.ResponseWriter, r *http.Request, userID int, archived bool) {
+	err := r.ParseForm()
+	if err != nil {
+		log.Println(err)
+	}
+	categoryID, err := strconv.ParseInt(r.FormValue("category-id"), 10, 32)
+	if err != nil {
+		log.Println(err)
+		http.Redirect(w, r, "/categories?error=4", 302)
+		return
+	}
+	err = setCategoryArchived(database, userID, int32(categoryID), archived)
+	if err != nil {
+		log.Println("Archiving category failed", err)
+		http.Redirect(w, r, "/categories?error="+strconv.Itoa(categoryErrorCode(err)), 302)
+		return
 	}
 	http.Redirect(w, r, "/categories", 302)
 }
 
-func getAllCategoriesOfUser(db *sqlx.DB, userID int) (categories []Category) {
-	rows, err := db.Queryx("SELECT id, name FROM categories WHERE user_id = $1 ORDER BY name DESC", userID)
+// getAllCategoriesOfUser returns the categories which are not archived for
+// entry forms
+func getAllCategoriesOfUser(db *sqlx.DB, userID int) []Category {
+	return getCategoriesOfUser(db, userID, false)
+}
+
+// getCategoriesOfUser returns the categories ordered as a tree, archived ones
+// are included for reports and the categories page
+func getCategoriesOfUser(db *sqlx.DB, userID int, withArchived bool) (categories []Category) {
+	rows, err := db.Queryx(
+		"SELECT id, name, COALESCE(parent, 0) AS parent, archived FROM categories WHERE user_id = $1 AND (NOT archived OR $2)",
+		userID, withArchived,
+	)
 	if err != nil {
 		log.Fatal(err)
 	}
@@ -168,5 +635,5 @@ func getAllCategoriesOfUser(db *sqlx.DB, userID int) (categories []Category) {
 	if err != nil {
 		log.Fatal(err)
 	}
-	return categories
+	return sortCategories(categories)
 }
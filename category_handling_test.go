@@ -0,0 +1,87 @@
+package main
+
+import "testing"
+
+// Food contains Groceries and Restaurants, Restaurants contain Cafes
+var sampleCategories = []Category{
+	{ID: 4, Name: "Кафе", Parent: 3},
+	{ID: 5, Name: "Кино"},
+	{ID: 3, Name: "Рестораны", Parent: 1},
+	{ID: 2, Name: "Продукты", Parent: 1},
+	{ID: 1, Name: "Еда"},
+}
+
+func TestSortCategories(t *testing.T) {
+	sorted := sortCategories(sampleCategories)
+	expected := []string{"Еда", "— Продукты", "— Рестораны", "— — Кафе", "Кино"}
+	if len(sorted) != len(expected) {
+		t.Fatalf("unexpected categories %+v", sorted)
+	}
+	for i, label := range expected {
+		if sorted[i].Label() != label {
+			t.Errorf("category %d is %q, expected %q", i, sorted[i].Label(), label)
+		}
+	}
+}
+
+func TestCategoryTreeCanMove(t *testing.T) {
+	tree := newCategoryTree(sampleCategories)
+	cases := []struct {
+		id, parent int32
+		allowed    bool
+	}{
+		{4, 0, true},
+		{4, 5, true},
+		{3, 2, true},
+		{1, 1, false},
+		{1, 3, false},
+		{1, 4, false},
+		{3, 4, false},
+	}
+	for _, c := range cases {
+		if tree.canMove(c.id, c.parent) != c.allowed {
+			t.Errorf("moving %d into %d: expected %v", c.id, c.parent, c.allowed)
+		}
+	}
+	if tree.root(4) != 1 || tree.root(5) != 5 || tree.root(0) != 0 {
+		t.Errorf("unexpected roots %d %d %d", tree.root(4), tree.root(5), tree.root(0))
+	}
+
+	// A loop in the data does not hang the walk
+	broken := CategoryTree{1: 2, 2: 1}
+	if len(broken.ancestors(1)) > 2 || broken.canMove(1, 2) {
+		t.Errorf("loop is not detected")
+	}
+}
+
+func TestGroupByTopCategories(t *testing.T) {
+	amounts := []BucketAmount{
+		{Date: "2020-03-01", Category: 4, CategoryName: "Кафе", Amount: 300},
+		{Date: "2020-03-01", Category: 1, CategoryName: "Еда", Amount: 200},
+		{Date: "2020-03-01", Category: 0, Amount: 100},
+	}
+	grouped := groupByTopCategories(amounts, sampleCategories)
+	if grouped[0].Category != 1 || grouped[0].CategoryName != "Еда" || grouped[2].Category != 0 {
+		t.Errorf("unexpected amounts %+v", grouped)
+	}
+	if amounts[0].Category != 4 {
+		t.Errorf("source amounts are changed")
+	}
+}
+
+func TestWithoutArchived(t *testing.T) {
+	categories := []Category{{ID: 1, Name: "Еда"}, {ID: 2, Name: "Кино", Archived: true}, {ID: 3, Name: "Спорт", Archived: true}}
+	active := withoutArchived(categories, 3)
+	if len(active) != 2 || active[0].ID != 1 || active[1].ID != 3 {
+		t.Errorf("unexpected categories %+v", active)
+	}
+	if active[1].Label() != "Спорт (в архиве)" {
+		t.Errorf("archived category is labeled %q", active[1].Label())
+	}
+	if len(withoutArchived(categories, 2, 3)) != 3 {
+		t.Errorf("used archived categories are removed")
+	}
+	if len(withoutArchived(categories, 0)) != 1 {
+		t.Errorf("archived categories are not removed")
+	}
+}
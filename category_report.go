@@ -0,0 +1,274 @@
+package main
+
+import (
+	"fmt"
+	"html/template"
+	"log"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// CategoryShare - sum of transactions of one category over the period,
+// subcategories are included after rollUpShares
+type CategoryShare struct {
+	ID             int32
+	Name           string
+	Amount         Money
+	Count          int
+	PreviousAmount Money
+	Percent        float64
+	Color          string
+	Depth          int
+}
+
+// FormattedPercent - share of the total with one decimal
+func (s CategoryShare) FormattedPercent() string {
+	return strconv.FormatFloat(s.Percent, 'f', 1, 64)
+}
+
+// Change - difference with the previous period
+func (s CategoryShare) Change() Money {
+	return s.Amount - s.PreviousAmount
+}
+
+// CategoryReportViewData - information to display on page
+type CategoryReportViewData struct {
+	LayoutData
+	Title            string
+	BaseCurrency     string
+	Kind             string
+	From             time.Time
+	To               time.Time
+	PreviousFrom     time.Time
+	PreviousTo       time.Time
+	Shares           []CategoryShare
+	Total            Money
+	PreviousTotal    Money
+	MissingRates     int
+	Chart            template.HTML
+	ErrorDescription string
+}
+
+// TotalChange - difference of totals with the previous period
+func (d CategoryReportViewData) TotalChange() Money {
+	return d.Total - d.PreviousTotal
+}
+
+// Colors of the chart slices, categories beyond the palette reuse them
+var chartColors = []string{
+	"#007bff", "#28a745", "#dc3545", "#ffc107", "#17a2b8",
+	"#6f42c1", "#fd7e14", "#20c997", "#e83e8c", "#6c757d",
+}
+
+// previousPeriod returns the period of the same length right before the given one
+func previousPeriod(from time.Time, to time.Time) (time.Time, time.Time) {
+	days := int(to.Sub(from).Hours()/24+0.5) + 1
+	previousTo := from.AddDate(0, 0, -1)
+	return previousTo.AddDate(0, 0, 1-days), previousTo
+}
+
+func getCategoryShares(db *sqlx.DB, userID int, kind string, from time.Time, to time.Time, previousFrom time.Time) (shares []CategoryShare, err error) {
+	shares = []CategoryShare{}
+	// Both periods are read at once, categories used only in the previous one
+	// are shown with zero amounts
+	err = db.Select(&shares, `
+	SELECT COALESCE(c.id, 0) AS id, COALESCE(c.name, '') AS name,
+		COALESCE(SUM(amount) FILTER (WHERE p.date >= $2::date), 0) AS amount,
+		COUNT(*) FILTER (WHERE p.date >= $2::date) AS count,
+		COALESCE(SUM(amount) FILTER (WHERE p.date < $2::date), 0) AS previousamount
+	FROM (
+		SELECT t.category, t.date, `+convertedAmountSQL("u.base_currency")+` AS amount
+		FROM `+transactionLinesSQL+` t
+		JOIN users u
+		ON t.user_id = u.id
+		WHERE t.user_id = $1 AND t.kind = $5 AND t.date >= $4::date AND t.date <= $3::date
+	) AS p
+	LEFT JOIN categories c
+	ON p.category = c.id
+	WHERE p.amount IS NOT NULL
+	GROUP BY c.id, c.name
+	ORDER BY amount DESC, previousamount DESC, name
+	`, userID, from.Format(dateLayout), to.Format(dateLayout), previousFrom.Format(dateLayout), kind)
+	return shares, err
+}
+
+// rollUpShares adds amounts of subcategories to all their parents and orders
+// the shares as a tree, the largest categories go first on every level
+func rollUpShares(shares []CategoryShare, categories []Category) []CategoryShare {
+	tree := newCategoryTree(categories)
+	names := map[int32]string{}
+	for _, category := range categories {
+		names[int32(category.ID)] = category.Name
+	}
+
+	rolled := map[int32]CategoryShare{}
+	ids := []int32{}
+	add := func(id int32, name string, share CategoryShare) {
+		total, ok := rolled[id]
+		if !ok {
+			total = CategoryShare{ID: id, Name: name}
+			ids = append(ids, id)
+		}
+		total.Amount += share.Amount
+		total.Count += share.Count
+		total.PreviousAmount += share.PreviousAmount
+		rolled[id] = total
+	}
+	for _, share := range shares {
+		add(share.ID, share.Name, share)
+		for _, parent := range tree.ancestors(share.ID) {
+			add(parent, names[parent], share)
+		}
+	}
+
+	sorted := make([]CategoryShare, 0, len(ids))
+	tree.walk(ids, func(a int32, b int32) bool {
+		if rolled[a].Amount != rolled[b].Amount {
+			return rolled[a].Amount > rolled[b].Amount
+		}
+		if rolled[a].PreviousAmount != rolled[b].PreviousAmount {
+			return rolled[a].PreviousAmount > rolled[b].PreviousAmount
+		}
+		return rolled[a].Name < rolled[b].Name
+	}, func(id int32, depth int) {
+		share := rolled[id]
+		share.Depth = depth
+		sorted = append(sorted, share)
+	})
+	return sorted
+}
+
+// fillShares calculates percentages and assigns chart colors, the totals of
+// both periods are returned. Subcategories are already counted in top level
+// categories and get the color of their top level category.
+func fillShares(shares []CategoryShare) (total Money, previousTotal Money) {
+	for _, share := range shares {
+		if share.Depth == 0 {
+			total += share.Amount
+			previousTotal += share.PreviousAmount
+		}
+	}
+	var color string
+	topLevel := 0
+	for i := range shares {
+		if shares[i].Name == "" {
+			shares[i].Name = "Без категории"
+		}
+		if total > 0 {
+			shares[i].Percent = float64(shares[i].Amount) * 100 / float64(total)
+		}
+		if shares[i].Depth == 0 {
+			color = chartColors[topLevel%len(chartColors)]
+			topLevel++
+		}
+		shares[i].Color = color
+	}
+	return total, previousTotal
+}
+
+// renderPieChart draws the top level shares as an inline SVG, so the report
+// does not depend on scripts from CDN
+func renderPieChart(shares []CategoryShare, total Money) template.HTML {
+	const size, radius = 200.0, 95.0
+	center := size / 2
+	var chart strings.Builder
+	fmt.Fprintf(&chart, `<svg xmlns="http://www.w3.org/2000/svg" width="%g" height="%g" viewBox="0 0 %g %g" role="img">`, size, size, size, size)
+	if total <= 0 {
+		fmt.Fprintf(&chart, `<circle cx="%g" cy="%g" r="%g" fill="#e9ecef"/>`, center, center, radius)
+	}
+
+	angle := -math.Pi / 2
+	for _, share := range shares {
+		if share.Amount <= 0 || total <= 0 || share.Depth > 0 {
+			continue
+		}
+		title := template.HTMLEscapeString(fmt.Sprintf("%s: %s (%.1f%%)", share.Name, share.Amount, share.Percent))
+		fraction := float64(share.Amount) / float64(total)
+		if fraction >= 0.9999 {
+			fmt.Fprintf(&chart, `<circle cx="%g" cy="%g" r="%g" fill="%s"><title>%s</title></circle>`, center, center, radius, share.Color, title)
+			continue
+		}
+		end := angle + 2*math.Pi*fraction
+		largeArc := 0
+		if fraction > 0.5 {
+			largeArc = 1
+		}
+		fmt.Fprintf(&chart, `<path d="M%.2f %.2f L%.2f %.2f A%g %g 0 %d 1 %.2f %.2f Z" fill="%s"><title>%s</title></path>`,
+			center, center,
+			center+radius*math.Cos(angle), center+radius*math.Sin(angle),
+			radius, radius, largeArc,
+			center+radius*math.Cos(end), center+radius*math.Sin(end),
+			share.Color, title,
+		)
+		angle = end
+	}
+	chart.WriteString(`</svg>`)
+	return template.HTML(chart.String())
+}
+
+func categoryReportView(w http.ResponseWriter, r *http.Request, userID int) {
+	weekStart, err := getUserWeekStart(database, userID)
+	if err != nil {
+		log.Println("Query week start failed", err)
+	}
+	now := time.Now()
+	filter, errorCode := parseTransactionFilter(r)
+	if filter.From.IsZero() {
+		filter.From = getPeriodStarts(now, weekStart).Month
+	}
+	if filter.To.IsZero() {
+		filter.To = getPeriodStarts(now, weekStart).Day
+	}
+	if filter.To.Before(filter.From) {
+		filter.To = filter.From
+	}
+	// Dates of the query are compared by days, the time zone does not matter
+	filter.From = time.Date(filter.From.Year(), filter.From.Month(), filter.From.Day(), 0, 0, 0, 0, time.UTC)
+	filter.To = time.Date(filter.To.Year(), filter.To.Month(), filter.To.Day(), 0, 0, 0, 0, time.UTC)
+
+	kind := r.URL.Query().Get("kind")
+	if kind != kindIncome {
+		kind = kindExpense
+	}
+
+	baseCurrency, err := getUserBaseCurrency(database, userID)
+	if err != nil {
+		log.Println(err)
+	}
+
+	data := CategoryReportViewData{
+		Title:            "Отчеты",
+		BaseCurrency:     baseCurrency,
+		Kind:             kind,
+		From:             filter.From,
+		To:               filter.To,
+		ErrorDescription: allErrors[errorCode],
+	}
+	data.PreviousFrom, data.PreviousTo = previousPeriod(data.From, data.To)
+	data.Shares, err = getCategoryShares(database, userID, kind, data.From, data.To, data.PreviousFrom)
+	if err != nil {
+		log.Println("Query category shares failed", err)
+		data.ErrorDescription = allErrors[13]
+	}
+	data.MissingRates, err = countUnconvertedTransactions(database, userID, data.PreviousFrom, data.To)
+	if err != nil {
+		log.Println("Query unconverted transactions failed", err)
+	}
+	data.Shares = rollUpShares(data.Shares, getCategoriesOfUser(database, userID, true))
+	data.Total, data.PreviousTotal = fillShares(data.Shares)
+	data.Chart = renderPieChart(data.Shares, data.Total)
+
+	tmpl, err := template.ParseFiles("templates/layout.html", "templates/reports_categories.html", "templates/navigation_logedin.html")
+	if err != nil {
+		log.Println(err)
+	}
+	err = renderLayout(w, r, tmpl, &data)
+	if err != nil {
+		log.Println(err)
+	}
+}
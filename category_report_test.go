@@ -0,0 +1,111 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestPreviousPeriod(t *testing.T) {
+	cases := []struct{ from, to, previousFrom, previousTo string }{
+		{"2020-03-01", "2020-03-31", "2020-01-30", "2020-02-29"},
+		{"2020-03-10", "2020-03-10", "2020-03-09", "2020-03-09"},
+		{"2020-01-01", "2020-01-07", "2019-12-25", "2019-12-31"},
+	}
+	for _, c := range cases {
+		from, _ := time.Parse(dateLayout, c.from)
+		to, _ := time.Parse(dateLayout, c.to)
+		previousFrom, previousTo := previousPeriod(from, to)
+		if previousFrom.Format(dateLayout) != c.previousFrom || previousTo.Format(dateLayout) != c.previousTo {
+			t.Errorf("%s - %s: got %s - %s", c.from, c.to, previousFrom.Format(dateLayout), previousTo.Format(dateLayout))
+		}
+	}
+}
+
+func TestFillShares(t *testing.T) {
+	shares := []CategoryShare{
+		{Name: "Еда", Amount: 7500, PreviousAmount: 5000},
+		{Amount: 2500},
+		{Name: "Кино", PreviousAmount: 1000},
+	}
+	total, previousTotal := fillShares(shares)
+	if total != 10000 || previousTotal != 6000 {
+		t.Errorf("totals %s and %s", total, previousTotal)
+	}
+	if shares[0].FormattedPercent() != "75.0" || shares[1].Percent != 25 || shares[2].Percent != 0 {
+		t.Errorf("unexpected percentages %+v", shares)
+	}
+	if shares[1].Name != "Без категории" {
+		t.Errorf("uncategorized named %q", shares[1].Name)
+	}
+	if shares[0].Change() != 2500 || shares[2].Change() != -1000 {
+		t.Errorf("unexpected changes %+v", shares)
+	}
+}
+
+func TestRenderPieChart(t *testing.T) {
+	shares := []CategoryShare{{Name: "<Еда>", Amount: 7500}, {Name: "Кино", Amount: 2500}, {Name: "Прочее"}}
+	total, _ := fillShares(shares)
+	chart := string(renderPieChart(shares, total))
+	if strings.Count(chart, "<path") != 2 {
+		t.Errorf("expected two slices in %s", chart)
+	}
+	if strings.Contains(chart, "<Еда>") || !strings.Contains(chart, "&lt;Еда&gt;") {
+		t.Errorf("category name is not escaped in %s", chart)
+	}
+	// The large slice takes three quarters of the circle
+	if !strings.Contains(chart, "A95 95 0 1 1") {
+		t.Errorf("large arc flag is not set in %s", chart)
+	}
+
+	single := string(renderPieChart(shares[:1], shares[0].Amount))
+	if strings.Contains(single, "<path") || !strings.Contains(single, "<circle") {
+		t.Errorf("the only category should be drawn as a circle: %s", single)
+	}
+}
+
+func TestRollUpShares(t *testing.T) {
+	categories := []Category{
+		{ID: 1, Name: "Еда"},
+		{ID: 2, Name: "Продукты", Parent: 1},
+		{ID: 3, Name: "Рестораны", Parent: 1},
+		{ID: 4, Name: "Кафе", Parent: 3},
+		{ID: 5, Name: "Кино"},
+	}
+	shares := []CategoryShare{
+		{ID: 2, Name: "Продукты", Amount: 3000, Count: 3},
+		{ID: 4, Name: "Кафе", Amount: 1500, Count: 2, PreviousAmount: 500},
+		{ID: 5, Name: "Кино", Amount: 2000, Count: 1},
+		{ID: 0, Amount: 500, Count: 1},
+	}
+	rolled := rollUpShares(shares, categories)
+	expected := []struct {
+		name   string
+		amount Money
+		depth  int
+	}{
+		{"Еда", 4500, 0},
+		{"Продукты", 3000, 1},
+		{"Рестораны", 1500, 1},
+		{"Кафе", 1500, 2},
+		{"Кино", 2000, 0},
+		{"", 500, 0},
+	}
+	if len(rolled) != len(expected) {
+		t.Fatalf("unexpected shares %+v", rolled)
+	}
+	for i, e := range expected {
+		if rolled[i].Name != e.name || rolled[i].Amount != e.amount || rolled[i].Depth != e.depth {
+			t.Errorf("share %d is %+v, expected %+v", i, rolled[i], e)
+		}
+	}
+	if rolled[0].Count != 5 || rolled[0].PreviousAmount != 500 {
+		t.Errorf("unexpected roll-up %+v", rolled[0])
+	}
+
+	// Subcategories are not counted twice
+	total, _ := fillShares(rolled)
+	if total != 7000 || rolled[1].Color != rolled[0].Color || rolled[4].Color == rolled[0].Color {
+		t.Errorf("total %s, shares %+v", total, rolled)
+	}
+}
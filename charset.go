@@ -0,0 +1,90 @@
+package main
+
+import (
+	"io"
+	"unicode/utf8"
+)
+
+// windows1251High - characters of the bytes 0x80-0xBF of windows-1251, the
+// bytes 0xC0-0xFF are the letters А-я in alphabetical order
+var windows1251High = [64]rune{
+	0x0402, 0x0403, 0x201A, 0x0453, 0x201E, 0x2026, 0x2020, 0x2021,
+	0x20AC, 0x2030, 0x0409, 0x2039, 0x040A, 0x040C, 0x040B, 0x040F,
+	0x0452, 0x2018, 0x2019, 0x201C, 0x201D, 0x2022, 0x2013, 0x2014,
+	0xFFFD, 0x2122, 0x0459, 0x203A, 0x045A, 0x045C, 0x045B, 0x045F,
+	0x00A0, 0x040E, 0x045E, 0x0408, 0x00A4, 0x0490, 0x00A6, 0x00A7,
+	0x0401, 0x00A9, 0x0404, 0x00AB, 0x00AC, 0x00AD, 0x00AE, 0x0407,
+	0x00B0, 0x00B1, 0x0406, 0x0456, 0x0491, 0x00B5, 0x00B6, 0x00B7,
+	0x0451, 0x2116, 0x0454, 0x00BB, 0x0458, 0x0405, 0x0455, 0x0457,
+}
+
+var windows1251Encoding = func() map[rune]byte {
+	encoding := map[rune]byte{}
+	for i, r := range windows1251High {
+		if r != utf8.RuneError {
+			encoding[r] = byte(0x80 + i)
+		}
+	}
+	for r := 'А'; r <= 'я'; r++ {
+		encoding[r] = byte(0xC0 + r - 'А')
+	}
+	return encoding
+}()
+
+// windows1251Writer converts UTF-8 text into windows-1251 used by Excel with
+// the Russian locale, characters without representation become "?"
+type windows1251Writer struct {
+	w       io.Writer
+	pending []byte
+}
+
+func newWindows1251Writer(w io.Writer) *windows1251Writer {
+	return &windows1251Writer{w: w}
+}
+
+func (e *windows1251Writer) Write(p []byte) (int, error) {
+	data := append(e.pending, p...)
+	encoded := make([]byte, 0, len(data))
+	i := 0
+	for i < len(data) {
+		if data[i] < utf8.RuneSelf {
+			encoded = append(encoded, data[i])
+			i++
+			continue
+		}
+		// The rune may be split between two writes
+		if !utf8.FullRune(data[i:]) {
+			break
+		}
+		r, size := utf8.DecodeRune(data[i:])
+		if b, ok := windows1251Encoding[r]; ok {
+			encoded = append(encoded, b)
+		} else {
+			encoded = append(encoded, '?')
+		}
+		i += size
+	}
+	e.pending = append([]byte{}, data[i:]...)
+
+	_, err := e.w.Write(encoded)
+	if err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// decodeWindows1251 converts windows-1251 text into UTF-8
+func decodeWindows1251(data []byte) string {
+	decoded := make([]rune, 0, len(data))
+	for _, b := range data {
+		switch {
+		case b < 0x80:
+			decoded = append(decoded, rune(b))
+		case b < 0xC0:
+			decoded = append(decoded, windows1251High[b-0x80])
+		default:
+			decoded = append(decoded, 'А'+rune(b-0xC0))
+		}
+	}
+	return string(decoded)
+}
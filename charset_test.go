@@ -0,0 +1,32 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestWindows1251(t *testing.T) {
+	text := "Дата;Сумма;Ёлка №1 — €"
+	var encoded bytes.Buffer
+	writer := newWindows1251Writer(&encoded)
+	// Every byte is written separately, so runes are split between writes
+	for i := 0; i < len(text); i++ {
+		_, err := writer.Write([]byte{text[i]})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	expected := []byte("\xc4\xe0\xf2\xe0;\xd1\xf3\xec\xec\xe0;\xa8\xeb\xea\xe0 \xb91 \x97 \x88")
+	if !bytes.Equal(encoded.Bytes(), expected) {
+		t.Errorf("encoded as %x, expected %x", encoded.Bytes(), expected)
+	}
+	if decoded := decodeWindows1251(expected); decoded != text {
+		t.Errorf("decoded as %q", decoded)
+	}
+
+	encoded.Reset()
+	newWindows1251Writer(&encoded).Write([]byte("日本"))
+	if encoded.String() != "??" {
+		t.Errorf("unknown characters encoded as %q", encoded.String())
+	}
+}
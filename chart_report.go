@@ -0,0 +1,265 @@
+package main
+
+import (
+	"fmt"
+	"html/template"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	defaultAverageWindow = 3
+	maxAverageWindow     = 12
+)
+
+// ChartSeries - amounts of one category in every bucket of the chart
+type ChartSeries struct {
+	Category int32
+	Name     string
+	Color    string
+	Amounts  []Money
+	Total    Money
+}
+
+// SpendingChart - stacked series of categories with the moving average of
+// the bucket totals
+type SpendingChart struct {
+	Unit          string
+	Starts        []time.Time
+	Series        []ChartSeries
+	Totals        []Money
+	MovingAverage []Money
+}
+
+// ChartReportViewData - information to display on page
+type ChartReportViewData struct {
+	LayoutData
+	Title            string
+	BaseCurrency     string
+	Unit             string
+	From             time.Time
+	To               time.Time
+	Window           int
+	Chart            SpendingChart
+	SVG              template.HTML
+	MissingRates     int
+	ErrorDescription string
+}
+
+// movingAverage returns the trailing average of the values, the first ones
+// are averaged over the buckets available so far
+func movingAverage(values []Money, window int) []Money {
+	averages := make([]Money, len(values))
+	var sum Money
+	for i, value := range values {
+		sum += value
+		count := i + 1
+		if i >= window {
+			sum -= values[i-window]
+			count = window
+		}
+		averages[i] = Money((int64(sum) + int64(count)/2) / int64(count))
+	}
+	return averages
+}
+
+// buildSpendingChart lays the bucket amounts out by the bucket starts, the
+// categories with the largest totals are drawn at the bottom
+func buildSpendingChart(unit string, starts []time.Time, amounts []BucketAmount, window int) SpendingChart {
+	chart := SpendingChart{
+		Unit:   unit,
+		Starts: starts,
+		Series: []ChartSeries{},
+		Totals: make([]Money, len(starts)),
+	}
+	positions := map[string]int{}
+	for i, start := range starts {
+		positions[start.Format(dateLayout)] = i
+	}
+	series := map[int32]int{}
+	for _, amount := range amounts {
+		position, ok := positions[amount.Date]
+		if !ok {
+			continue
+		}
+		index, ok := series[amount.Category]
+		if !ok {
+			index = len(chart.Series)
+			series[amount.Category] = index
+			name := amount.CategoryName
+			if name == "" {
+				name = "Без категории"
+			}
+			chart.Series = append(chart.Series, ChartSeries{
+				Category: amount.Category,
+				Name:     name,
+				Amounts:  make([]Money, len(starts)),
+			})
+		}
+		chart.Series[index].Amounts[position] += amount.Amount
+		chart.Series[index].Total += amount.Amount
+		chart.Totals[position] += amount.Amount
+	}
+
+	sort.SliceStable(chart.Series, func(i, j int) bool {
+		return chart.Series[i].Total > chart.Series[j].Total
+	})
+	for i := range chart.Series {
+		chart.Series[i].Color = chartColors[i%len(chartColors)]
+	}
+	chart.MovingAverage = movingAverage(chart.Totals, window)
+	return chart
+}
+
+// groupByTopCategories moves amounts of subcategories to their top level
+// categories, so the stacked bars do not count them twice
+func groupByTopCategories(amounts []BucketAmount, categories []Category) []BucketAmount {
+	tree := newCategoryTree(categories)
+	names := map[int32]string{}
+	for _, category := range categories {
+		names[int32(category.ID)] = category.Name
+	}
+	grouped := make([]BucketAmount, len(amounts))
+	for i, amount := range amounts {
+		grouped[i] = amount
+		if root := tree.root(amount.Category); root != amount.Category {
+			grouped[i].Category = root
+			grouped[i].CategoryName = names[root]
+		}
+	}
+	return grouped
+}
+
+// bucketLabel formats the bucket start for the axis of the chart
+func bucketLabel(start time.Time, unit string) string {
+	if unit == bucketMonth {
+		return start.Format("01.2006")
+	}
+	return start.Format("02.01")
+}
+
+// renderSpendingChart draws the chart as an inline SVG: stacked bars of
+// categories and the line of the moving average
+func renderSpendingChart(chart SpendingChart) template.HTML {
+	const (
+		width, height      = 800.0, 300.0
+		left, right        = 60.0, 10.0
+		top, bottom        = 10.0, 30.0
+		plotWidth          = width - left - right
+		plotHeight         = height - top - bottom
+		maxLabels          = 12
+		averageLineColor   = "#343a40"
+		gridLineColor      = "#dee2e6"
+		barSpacingFraction = 0.2
+	)
+	var svg strings.Builder
+	fmt.Fprintf(&svg, `<svg xmlns="http://www.w3.org/2000/svg" width="100%%" viewBox="0 0 %g %g" role="img">`, width, height)
+	fmt.Fprintf(&svg, `<line x1="%g" y1="%g" x2="%g" y2="%g" stroke="%s"/>`, left, top+plotHeight, width-right, top+plotHeight, gridLineColor)
+
+	var maximum Money
+	for i := range chart.Totals {
+		if chart.Totals[i] > maximum {
+			maximum = chart.Totals[i]
+		}
+		if chart.MovingAverage[i] > maximum {
+			maximum = chart.MovingAverage[i]
+		}
+	}
+	if len(chart.Starts) == 0 || maximum <= 0 {
+		svg.WriteString(`</svg>`)
+		return template.HTML(svg.String())
+	}
+	scale := plotHeight / float64(maximum)
+	fmt.Fprintf(&svg, `<line x1="%g" y1="%g" x2="%g" y2="%g" stroke="%s"/>`, left, top, width-right, top, gridLineColor)
+	fmt.Fprintf(&svg, `<text x="%g" y="%g" font-size="11" text-anchor="end">%s</text>`, left-4, top+10, maximum)
+	fmt.Fprintf(&svg, `<text x="%g" y="%g" font-size="11" text-anchor="end">0</text>`, left-4, top+plotHeight)
+
+	step := plotWidth / float64(len(chart.Starts))
+	barWidth := step * (1 - barSpacingFraction)
+	labelEvery := (len(chart.Starts) + maxLabels - 1) / maxLabels
+	for i, start := range chart.Starts {
+		x := left + step*float64(i) + (step-barWidth)/2
+		y := top + plotHeight
+		for _, series := range chart.Series {
+			amount := series.Amounts[i]
+			if amount <= 0 {
+				continue
+			}
+			barHeight := float64(amount) * scale
+			y -= barHeight
+			title := template.HTMLEscapeString(fmt.Sprintf("%s %s: %s", bucketLabel(start, chart.Unit), series.Name, amount))
+			fmt.Fprintf(&svg, `<rect x="%.2f" y="%.2f" width="%.2f" height="%.2f" fill="%s"><title>%s</title></rect>`,
+				x, y, barWidth, barHeight, series.Color, title)
+		}
+		if i%labelEvery == 0 {
+			fmt.Fprintf(&svg, `<text x="%.2f" y="%g" font-size="11" text-anchor="middle">%s</text>`,
+				left+step*(float64(i)+0.5), height-bottom+15, bucketLabel(start, chart.Unit))
+		}
+	}
+
+	points := make([]string, len(chart.MovingAverage))
+	for i, average := range chart.MovingAverage {
+		points[i] = fmt.Sprintf("%.2f,%.2f", left+step*(float64(i)+0.5), top+plotHeight-float64(average)*scale)
+	}
+	fmt.Fprintf(&svg, `<polyline points="%s" fill="none" stroke="%s" stroke-width="2"><title>Скользящее среднее</title></polyline>`,
+		strings.Join(points, " "), averageLineColor)
+	svg.WriteString(`</svg>`)
+	return template.HTML(svg.String())
+}
+
+func chartReportView(w http.ResponseWriter, r *http.Request, userID int) {
+	weekStart, err := getUserWeekStart(database, userID)
+	if err != nil {
+		log.Println("Query week start failed", err)
+	}
+	baseCurrency, err := getUserBaseCurrency(database, userID)
+	if err != nil {
+		log.Println(err)
+	}
+
+	window := defaultAverageWindow
+	if value, err := strconv.Atoi(r.URL.Query().Get("window")); err == nil && value >= 1 && value <= maxAverageWindow {
+		window = value
+	}
+
+	data := ChartReportViewData{
+		Title:        "Отчеты",
+		BaseCurrency: baseCurrency,
+		Window:       window,
+	}
+	var errorCode int
+	data.Unit, data.From, data.To, errorCode = parseBucketRange(r, time.Now(), weekStart)
+	if errorCode != 0 {
+		// The default range of monthly buckets is always valid
+		data.ErrorDescription = allErrors[errorCode]
+		defaults, _ := http.NewRequest("GET", "/reports/charts", nil)
+		data.Unit, data.From, data.To, _ = parseBucketRange(defaults, time.Now(), weekStart)
+	}
+
+	starts := bucketStarts(data.Unit, data.From, data.To, weekStart)
+	amounts, err := getBucketAmounts(database, userID, kindExpense, data.Unit, data.From, data.To, weekStart)
+	if err != nil {
+		log.Println("Query bucket amounts failed", err)
+		data.ErrorDescription = allErrors[13]
+	}
+	data.MissingRates, err = countUnconvertedTransactions(database, userID, data.From, data.To)
+	if err != nil {
+		log.Println("Query unconverted transactions failed", err)
+	}
+	amounts = groupByTopCategories(amounts, getCategoriesOfUser(database, userID, true))
+	data.Chart = buildSpendingChart(data.Unit, starts, amounts, window)
+	data.SVG = renderSpendingChart(data.Chart)
+
+	tmpl, err := template.ParseFiles("templates/layout.html", "templates/reports_charts.html", "templates/navigation_logedin.html")
+	if err != nil {
+		log.Println(err)
+	}
+	err = renderLayout(w, r, tmpl, &data)
+	if err != nil {
+		log.Println(err)
+	}
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestBucketStarts(t *testing.T) {
+	from := time.Date(2020, time.January, 15, 0, 0, 0, 0, time.UTC)
+	to := time.Date(2020, time.March, 1, 0, 0, 0, 0, time.UTC)
+
+	months := bucketStarts(bucketMonth, from, to, time.Monday)
+	if len(months) != 3 || months[0].Format(dateLayout) != "2020-01-01" || months[2].Format(dateLayout) != "2020-03-01" {
+		t.Errorf("unexpected months %v", months)
+	}
+	// 2020-01-15 is Wednesday and 2020-03-01 is Sunday
+	weeks := bucketStarts(bucketWeek, from, to, time.Sunday)
+	if len(weeks) != 8 || weeks[0].Format(dateLayout) != "2020-01-12" || weeks[7].Format(dateLayout) != "2020-03-01" {
+		t.Errorf("unexpected weeks %v", weeks)
+	}
+	if days := bucketStarts(bucketDay, from, to, time.Monday); len(days) != 47 {
+		t.Errorf("expected 47 days, got %d", len(days))
+	}
+}
+
+func TestParseBucketRange(t *testing.T) {
+	now := time.Date(2020, time.May, 20, 15, 0, 0, 0, time.UTC)
+	request, _ := http.NewRequest("GET", "/reports/charts", nil)
+	unit, from, to, errorCode := parseBucketRange(request, now, time.Monday)
+	if errorCode != 0 || unit != bucketMonth || from.Format(dateLayout) != "2019-06-01" || to.Format(dateLayout) != "2020-05-20" {
+		t.Errorf("unexpected default range %s %s %s %d", unit, from, to, errorCode)
+	}
+
+	request, _ = http.NewRequest("GET", "/reports/charts?unit=week&from=2020-05-06", nil)
+	_, from, _, errorCode = parseBucketRange(request, now, time.Monday)
+	if errorCode != 0 || from.Format(dateLayout) != "2020-05-04" {
+		t.Errorf("range should start on Monday, got %s %d", from, errorCode)
+	}
+
+	for _, query := range []string{"unit=year", "unit=day&from=2000-01-01", "from=2020-06-01", "to=tomorrow"} {
+		request, _ = http.NewRequest("GET", "/reports/charts?"+query, nil)
+		if _, _, _, errorCode = parseBucketRange(request, now, time.Monday); errorCode == 0 {
+			t.Errorf("%s accepted", query)
+		}
+	}
+}
+
+func TestMovingAverage(t *testing.T) {
+	averages := movingAverage([]Money{300, 600, 0, 900, 1}, 3)
+	expected := []Money{300, 450, 300, 500, 300}
+	for i := range expected {
+		if averages[i] != expected[i] {
+			t.Errorf("average %d is %s, expected %s", i, averages[i], expected[i])
+		}
+	}
+}
+
+func TestBuildSpendingChart(t *testing.T) {
+	starts := []time.Time{
+		time.Date(2020, time.January, 1, 0, 0, 0, 0, time.UTC),
+		time.Date(2020, time.February, 1, 0, 0, 0, 0, time.UTC),
+	}
+	amounts := []BucketAmount{
+		{Date: "2020-01-01", Category: 1, CategoryName: "Кино", Amount: 100},
+		{Date: "2020-02-01", Category: 2, CategoryName: "Еда", Amount: 500},
+		{Date: "2020-02-01", Category: 1, CategoryName: "Кино", Amount: 200},
+		{Date: "2020-02-01", Amount: 50},
+	}
+	chart := buildSpendingChart(bucketMonth, starts, amounts, 2)
+	if len(chart.Series) != 3 || chart.Series[0].Name != "Еда" || chart.Series[2].Name != "Без категории" {
+		t.Fatalf("unexpected series %+v", chart.Series)
+	}
+	if chart.Series[1].Amounts[0] != 100 || chart.Series[1].Amounts[1] != 200 {
+		t.Errorf("unexpected amounts %v", chart.Series[1].Amounts)
+	}
+	if chart.Totals[0] != 100 || chart.Totals[1] != 750 || chart.MovingAverage[1] != 425 {
+		t.Errorf("unexpected totals %v and averages %v", chart.Totals, chart.MovingAverage)
+	}
+
+	svg := string(renderSpendingChart(chart))
+	if strings.Count(svg, "<rect") != 4 || !strings.Contains(svg, "<polyline") || !strings.Contains(svg, "02.2020") {
+		t.Errorf("unexpected chart %s", svg)
+	}
+	empty := string(renderSpendingChart(buildSpendingChart(bucketDay, nil, nil, 3)))
+	if strings.Contains(empty, "<rect") {
+		t.Errorf("empty chart has bars: %s", empty)
+	}
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"html/template"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+)
+
+// csrfErrorCode is shown when a form comes without the token of the session
+const csrfErrorCode = 35
+
+// LayoutData - values of the layout shared by all pages, it is embedded into
+// view data and filled by renderLayout
+type LayoutData struct {
+	CSRFToken string
+}
+
+func (l *LayoutData) setLayout(layout LayoutData) {
+	*l = layout
+}
+
+// layoutPage - view data with the embedded LayoutData
+type layoutPage interface {
+	setLayout(layout LayoutData)
+}
+
+// renderLayout executes the layout of the page with the token of the current
+// session, every POST form of the templates includes it
+func renderLayout(w io.Writer, r *http.Request, tmpl *template.Template, data layoutPage) error {
+	data.setLayout(LayoutData{CSRFToken: csrfToken(getSessionToken(r))})
+	return tmpl.ExecuteTemplate(w, "layout", data)
+}
+
+// csrfToken derives the token of forms from the session token, so it lives as
+// long as the session and does not reveal the session token
+func csrfToken(sessionToken string) string {
+	if sessionToken == "" {
+		return ""
+	}
+	mac := hmac.New(sha256.New, []byte(sessionToken))
+	mac.Write([]byte("csrf"))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// isSecureRequest reports whether the request came over HTTPS, directly or
+// through the proxy of the hosting
+func isSecureRequest(r *http.Request) bool {
+	return r.TLS != nil || r.Header.Get("X-Forwarded-Proto") == "https"
+}
+
+// csrfProtection rejects state changing requests authenticated by the
+// session cookie without the token of the session. Forms send it in the
+// csrf-token field, scripts in the X-CSRF-Token header. API requests with
+// tokens and requests without a session carry no ambient authority, pages do
+// not accept tokens, so the header does not exempt them.
+func csrfProtection(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if isReadOnlyMethod(r.Method) || (r.Header.Get("Authorization") != "" && strings.HasPrefix(r.URL.Path, "/api/")) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		sessionToken := getSessionToken(r)
+		if sessionToken == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		provided := r.Header.Get("X-CSRF-Token")
+		if provided == "" {
+			provided = r.PostFormValue("csrf-token")
+		}
+		if subtle.ConstantTimeCompare([]byte(provided), []byte(csrfToken(sessionToken))) != 1 {
+			log.Println("CSRF token mismatch", r.Method, r.URL.Path)
+			renderCSRFError(w, r)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func renderCSRFError(w http.ResponseWriter, r *http.Request) {
+	if strings.HasPrefix(r.URL.Path, "/api/") {
+		writeAPIError(w, http.StatusForbidden, csrfErrorCode)
+		return
+	}
+	data := ViewData{
+		Title:            "Ошибка",
+		ErrorDescription: allErrors[csrfErrorCode],
+	}
+	tmpl, err := template.ParseFiles("templates/layout.html", "templates/error.html", "templates/navigation_logedin.html")
+	if err != nil {
+		log.Println(err)
+		http.Error(w, allErrors[csrfErrorCode], http.StatusForbidden)
+		return
+	}
+	w.WriteHeader(http.StatusForbidden)
+	err = renderLayout(w, r, tmpl, &data)
+	if err != nil {
+		log.Println(err)
+	}
+}
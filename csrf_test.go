@@ -0,0 +1,85 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/securecookie"
+)
+
+func TestCSRFProtection(t *testing.T) {
+	cookieCodecs = randomCookieCodecs()
+	encoded, err := securecookie.EncodeMulti("cookie", "session", cookieCodecs...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	handler := csrfProtection(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	}))
+
+	cases := []struct {
+		name     string
+		method   string
+		path     string
+		form     url.Values
+		header   http.Header
+		cookie   bool
+		expected int
+	}{
+		{"read", "GET", "/", nil, nil, true, http.StatusNoContent},
+		{"no session", "POST", "/login", url.Values{}, nil, false, http.StatusNoContent},
+		{"no token", "POST", "/", url.Values{}, nil, true, http.StatusForbidden},
+		{"wrong token", "POST", "/", url.Values{"csrf-token": {csrfToken("other")}}, nil, true, http.StatusForbidden},
+		{"form token", "POST", "/", url.Values{"csrf-token": {csrfToken("session")}}, nil, true, http.StatusNoContent},
+		{"header token", "DELETE", "/api/v1/transactions/1", nil, http.Header{"X-Csrf-Token": {csrfToken("session")}}, true, http.StatusNoContent},
+		{"api token", "DELETE", "/api/v1/transactions/1", nil, http.Header{"Authorization": {"Bearer egt_1"}}, true, http.StatusNoContent},
+		{"page with api token", "POST", "/settings/api_tokens", nil, http.Header{"Authorization": {"Bearer egt_1"}}, true, http.StatusForbidden},
+		{"api without token", "DELETE", "/api/v1/transactions/1", nil, nil, true, http.StatusForbidden},
+	}
+	for _, c := range cases {
+		request := httptest.NewRequest(c.method, c.path, strings.NewReader(c.form.Encode()))
+		if c.form != nil {
+			request.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		}
+		for name, values := range c.header {
+			request.Header[name] = values
+		}
+		if c.cookie {
+			request.AddCookie(&http.Cookie{Name: "cookie", Value: encoded})
+		}
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, request)
+		if recorder.Code != c.expected {
+			t.Errorf("%s: status %d, expected %d", c.name, recorder.Code, c.expected)
+		}
+		if c.expected == http.StatusForbidden && strings.HasPrefix(c.path, "/api/") &&
+			!strings.Contains(recorder.Body.String(), `"code":35`) {
+			t.Errorf("%s: unexpected body %s", c.name, recorder.Body.String())
+		}
+	}
+}
+
+// Every POST form of the templates has to send the token
+func TestTemplateFormsHaveCSRFToken(t *testing.T) {
+	files, err := filepath.Glob("templates/*.html")
+	if err != nil {
+		t.Fatal(err)
+	}
+	form := regexp.MustCompile(`<form[^>]*method="POST"[^>]*>\s*\{\{ template "csrf" [.$] \}\}`)
+	for _, file := range files {
+		content, err := ioutil.ReadFile(file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		posts := strings.Count(string(content), `method="POST"`)
+		if protected := len(form.FindAllIndex(content, -1)); protected != posts {
+			t.Errorf("%s: %d of %d forms have the token", file, protected, posts)
+		}
+	}
+}
@@ -0,0 +1,273 @@
+package main
+
+import (
+	"archive/zip"
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// ExportTransaction - transaction as it is written into exported files
+type ExportTransaction struct {
+	Date         string `json:"date"`
+	Kind         string `json:"kind"`
+	Account      string `json:"account"`
+	Category     string `json:"category"`
+	Amount       Money  `json:"amount"`
+	Currency     string `json:"currency"`
+	BaseAmount   *Money `json:"base_amount"`
+	BaseCurrency string `json:"base_currency"`
+	Comment      string `json:"comment"`
+}
+
+var exportHeader = []string{"Дата", "Тип", "Счет", "Категория", "Сумма", "Валюта", "Сумма в базовой валюте", "Базовая валюта", "Комментарий"}
+
+// optionalMoney formats amounts without a rate as empty cells
+func optionalMoney(m *Money) string {
+	if m == nil {
+		return ""
+	}
+	return m.String()
+}
+
+func (t ExportTransaction) fields() []string {
+	return []string{t.Date, t.Kind, t.Account, t.Category, t.Amount.String(), t.Currency, optionalMoney(t.BaseAmount), t.BaseCurrency, t.Comment}
+}
+
+// forEachTransactionOfUser streams transactions ordered by date, so exports
+// never hold the whole history in memory
+func forEachTransactionOfUser(db *sqlx.DB, userID int, filter TransactionFilter, fn func(ExportTransaction) error) error {
+	conditions, args := filter.where([]interface{}{userID})
+	rows, err := db.Queryx(`
+	SELECT to_char(t.date, 'YYYY-MM-DD') AS date, t.kind, a.name AS account,
+		`+transactionCategoryNameSQL+` AS category, t.amount, t.currency,
+		`+convertedAmountSQL("u.base_currency")+` AS baseamount, u.base_currency AS basecurrency,
+		COALESCE(t.comment, '') AS comment
+	FROM transactions t
+	JOIN users u
+	ON t.user_id = u.id
+	JOIN accounts a
+	ON t.account = a.id
+	LEFT JOIN categories c
+	ON t.category = c.id
+	WHERE t.user_id = $1`+conditions+`
+	ORDER BY t.date, t.id
+	`, args...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var t ExportTransaction
+		err = rows.StructScan(&t)
+		if err != nil {
+			return err
+		}
+		err = fn(t)
+		if err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
+
+func exportTransactions(w http.ResponseWriter, r *http.Request, userID int) {
+	filter, errorCode := parseTransactionFilter(r)
+	if errorCode != 0 {
+		http.Redirect(w, r, "/reports?error="+strconv.Itoa(errorCode), 302)
+		return
+	}
+
+	format := r.URL.Query().Get("format")
+	filename := "transactions-" + time.Now().Format(dateLayout)
+	var err error
+	switch format {
+	case "csv":
+		delimiter := ','
+		switch r.URL.Query().Get("delimiter") {
+		case ";":
+			delimiter = ';'
+		case "tab":
+			delimiter = '\t'
+		}
+		charset := "utf-8"
+		if r.URL.Query().Get("encoding") == "windows-1251" {
+			charset = "windows-1251"
+		}
+		w.Header().Set("Content-Type", "text/csv; charset="+charset)
+		w.Header().Set("Content-Disposition", `attachment; filename="`+filename+`.csv"`)
+		err = exportCSV(w, userID, filter, delimiter, charset)
+	case "json":
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		w.Header().Set("Content-Disposition", `attachment; filename="`+filename+`.json"`)
+		err = exportJSON(w, userID, filter)
+	case "xlsx":
+		w.Header().Set("Content-Type", "application/vnd.openxmlformats-officedocument.spreadsheetml.sheet")
+		w.Header().Set("Content-Disposition", `attachment; filename="`+filename+`.xlsx"`)
+		err = exportXLSX(w, userID, filter)
+	default:
+		http.Redirect(w, r, "/reports?error=26", 302)
+		return
+	}
+	// The headers are already sent, so the broken file is the only sign of the error
+	if err != nil {
+		log.Println("Export failed", err)
+	}
+}
+
+func exportCSV(w io.Writer, userID int, filter TransactionFilter, delimiter rune, charset string) error {
+	if charset == "windows-1251" {
+		w = newWindows1251Writer(w)
+	}
+	writer := csv.NewWriter(w)
+	writer.Comma = delimiter
+	err := writer.Write(exportHeader)
+	if err != nil {
+		return err
+	}
+	err = forEachTransactionOfUser(database, userID, filter, func(t ExportTransaction) error {
+		return writer.Write(t.fields())
+	})
+	writer.Flush()
+	if err != nil {
+		return err
+	}
+	return writer.Error()
+}
+
+func exportJSON(w io.Writer, userID int, filter TransactionFilter) error {
+	buffered := bufio.NewWriter(w)
+	encoder := json.NewEncoder(buffered)
+	separator := "[\n"
+	err := forEachTransactionOfUser(database, userID, filter, func(t ExportTransaction) error {
+		_, err := buffered.WriteString(separator)
+		separator = ","
+		if err != nil {
+			return err
+		}
+		return encoder.Encode(t)
+	})
+	if err != nil {
+		return err
+	}
+	if separator == "[\n" {
+		buffered.WriteString(separator)
+	}
+	buffered.WriteString("]\n")
+	return buffered.Flush()
+}
+
+// Parts of the minimal Office Open XML workbook, the sheet is written row by row
+const (
+	xlsxContentTypes = `<?xml version="1.0" encoding="UTF-8" standalone="yes"?>
+<Types xmlns="http://schemas.openxmlformats.org/package/2006/content-types">
+<Default Extension="rels" ContentType="application/vnd.openxmlformats-package.relationships+xml"/>
+<Default Extension="xml" ContentType="application/xml"/>
+<Override PartName="/xl/workbook.xml" ContentType="application/vnd.openxmlformats-officedocument.spreadsheetml.sheet.main+xml"/>
+<Override PartName="/xl/worksheets/sheet1.xml" ContentType="application/vnd.openxmlformats-officedocument.spreadsheetml.worksheet+xml"/>
+</Types>`
+	xlsxRelationships = `<?xml version="1.0" encoding="UTF-8" standalone="yes"?>
+<Relationships xmlns="http://schemas.openxmlformats.org/package/2006/relationships">
+<Relationship Id="rId1" Type="http://schemas.openxmlformats.org/officeDocument/2006/relationships/officeDocument" Target="xl/workbook.xml"/>
+</Relationships>`
+	xlsxWorkbook = `<?xml version="1.0" encoding="UTF-8" standalone="yes"?>
+<workbook xmlns="http://schemas.openxmlformats.org/spreadsheetml/2006/main" xmlns:r="http://schemas.openxmlformats.org/officeDocument/2006/relationships">
+<sheets><sheet name="Transactions" sheetId="1" r:id="rId1"/></sheets>
+</workbook>`
+	xlsxWorkbookRelationships = `<?xml version="1.0" encoding="UTF-8" standalone="yes"?>
+<Relationships xmlns="http://schemas.openxmlformats.org/package/2006/relationships">
+<Relationship Id="rId1" Type="http://schemas.openxmlformats.org/officeDocument/2006/relationships/worksheet" Target="worksheets/sheet1.xml"/>
+</Relationships>`
+	xlsxSheetStart = `<?xml version="1.0" encoding="UTF-8" standalone="yes"?>
+<worksheet xmlns="http://schemas.openxmlformats.org/spreadsheetml/2006/main"><sheetData>`
+	xlsxSheetEnd = `</sheetData></worksheet>`
+)
+
+// Amounts are numbers in the spreadsheet, so they can be summed
+var xlsxNumericColumns = map[int]bool{4: true, 6: true}
+
+func writeXLSXRow(w io.Writer, fields []string, numeric map[int]bool) error {
+	_, err := io.WriteString(w, "<row>")
+	if err != nil {
+		return err
+	}
+	for i, field := range fields {
+		if numeric[i] && field == "" {
+			// Amounts without a rate stay empty
+			_, err = io.WriteString(w, "<c/>")
+		} else if numeric[i] {
+			_, err = fmt.Fprintf(w, `<c t="n"><v>%s</v></c>`, field)
+		} else {
+			_, err = io.WriteString(w, `<c t="inlineStr"><is><t xml:space="preserve">`)
+			if err == nil {
+				err = xml.EscapeText(w, []byte(field))
+			}
+			if err == nil {
+				_, err = io.WriteString(w, `</t></is></c>`)
+			}
+		}
+		if err != nil {
+			return err
+		}
+	}
+	_, err = io.WriteString(w, "</row>")
+	return err
+}
+
+func exportXLSX(w io.Writer, userID int, filter TransactionFilter) error {
+	archive := zip.NewWriter(w)
+	for _, part := range []struct{ name, content string }{
+		{"[Content_Types].xml", xlsxContentTypes},
+		{"_rels/.rels", xlsxRelationships},
+		{"xl/workbook.xml", xlsxWorkbook},
+		{"xl/_rels/workbook.xml.rels", xlsxWorkbookRelationships},
+	} {
+		file, err := archive.Create(part.name)
+		if err != nil {
+			return err
+		}
+		_, err = io.WriteString(file, part.content)
+		if err != nil {
+			return err
+		}
+	}
+
+	file, err := archive.Create("xl/worksheets/sheet1.xml")
+	if err != nil {
+		return err
+	}
+	sheet := bufio.NewWriter(file)
+	_, err = sheet.WriteString(xlsxSheetStart)
+	if err != nil {
+		return err
+	}
+	err = writeXLSXRow(sheet, exportHeader, nil)
+	if err != nil {
+		return err
+	}
+	err = forEachTransactionOfUser(database, userID, filter, func(t ExportTransaction) error {
+		return writeXLSXRow(sheet, t.fields(), xlsxNumericColumns)
+	})
+	if err != nil {
+		return err
+	}
+	_, err = sheet.WriteString(xlsxSheetEnd)
+	if err != nil {
+		return err
+	}
+	err = sheet.Flush()
+	if err != nil {
+		return err
+	}
+	return archive.Close()
+}
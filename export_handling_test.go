@@ -0,0 +1,28 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestWriteXLSXRow(t *testing.T) {
+	var row bytes.Buffer
+	err := writeXLSXRow(&row, []string{"Кафе & <бар>", "-12.50"}, map[int]bool{1: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := `<row><c t="inlineStr"><is><t xml:space="preserve">Кафе &amp; &lt;бар&gt;</t></is></c><c t="n"><v>-12.50</v></c></row>`
+	if row.String() != expected {
+		t.Errorf("written %s, expected %s", row.String(), expected)
+	}
+
+	// Amounts without a rate are empty cells, not invalid numbers
+	row.Reset()
+	err = writeXLSXRow(&row, []string{optionalMoney(nil)}, map[int]bool{0: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if row.String() != "<row><c/></row>" {
+		t.Errorf("written %s for a missing amount", row.String())
+	}
+}
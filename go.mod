@@ -9,4 +9,6 @@ require (
 	github.com/gorilla/securecookie v1.1.1
 	github.com/jmoiron/sqlx v1.2.0
 	github.com/lib/pq v1.2.0
+	golang.org/x/crypto v0.0.0-20200622213623-75b288015ac9
+	rsc.io/qr v0.2.0
 )
@@ -0,0 +1,507 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/csv"
+	"html/template"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const maxStatementSize = 5 << 20
+
+// Column is not present in the statement
+const noColumn = -1
+
+// Date formats used by banks in their statements
+var statementDateFormats = []string{
+	"2006-01-02",
+	"02.01.2006",
+	"02/01/2006",
+	"01/02/2006",
+	"2006-01-02 15:04:05",
+	"02.01.2006 15:04:05",
+	"02.01.2006 15:04",
+}
+
+// ImportProfile - element of corresponding table, how to read statements of one bank
+type ImportProfile struct {
+	ID                int
+	Name              string
+	Delimiter         string
+	HasHeader         bool
+	DateColumn        int
+	DateFormat        string
+	AmountColumn      int
+	CommentColumn     int
+	CategoryColumn    int
+	PositiveIsExpense bool
+	Account           int32
+	DefaultCategory   int32
+}
+
+// ImportRow - parsed line of the statement
+type ImportRow struct {
+	Line      int
+	Date      time.Time
+	Kind      string
+	Amount    Money
+	Comment   string
+	Category  int32
+	Error     string
+	Duplicate bool
+}
+
+// ImportViewData - information to display on page
+type ImportViewData struct {
+	LayoutData
+	Title              string
+	Profiles           []ImportProfile
+	Profile            ImportProfile
+	Accounts           []Account
+	Categories         []Category
+	DateFormats        []string
+	Content            string
+	Header             []string
+	Rows               []ImportRow
+	ErrorDescription   string
+	SuccessDescription string
+}
+
+// ColumnNumbers is used by the template to build column selects
+func (data ImportViewData) ColumnNumbers() []int {
+	numbers := []int{}
+	for i := range data.Header {
+		numbers = append(numbers, i)
+	}
+	return numbers
+}
+
+// CategoryName is used by the template to show the category of parsed rows
+func (data ImportViewData) CategoryName(categoryID int32) string {
+	for _, c := range data.Categories {
+		if int32(c.ID) == categoryID {
+			return c.Name
+		}
+	}
+	return ""
+}
+
+func readStatement(content []byte, delimiter string) (records [][]string, err error) {
+	// Excel saves UTF-8 files with BOM
+	content = bytes.TrimPrefix(content, []byte("\xef\xbb\xbf"))
+	reader := csv.NewReader(bytes.NewReader(content))
+	reader.FieldsPerRecord = -1
+	reader.LazyQuotes = true
+	reader.TrimLeadingSpace = true
+	if delimiter == "tab" {
+		reader.Comma = '\t'
+	} else if len(delimiter) == 1 {
+		reader.Comma = rune(delimiter[0])
+	}
+	return reader.ReadAll()
+}
+
+func statementColumn(record []string, column int) string {
+	if column < 0 || column >= len(record) {
+		return ""
+	}
+	return strings.TrimSpace(record[column])
+}
+
+// parseStatement converts records into rows, errors are reported per row so
+// the user can fix the mapping before committing
+func parseStatement(records [][]string, profile ImportProfile, categoryIDs map[string]int32) []ImportRow {
+	rows := []ImportRow{}
+	for i, record := range records {
+		if i == 0 && profile.HasHeader {
+			continue
+		}
+		if len(record) == 1 && strings.TrimSpace(record[0]) == "" {
+			continue
+		}
+		row := ImportRow{Line: i + 1, Category: profile.DefaultCategory}
+
+		date, err := time.Parse(profile.DateFormat, statementColumn(record, profile.DateColumn))
+		if err != nil {
+			row.Error = "Некорректная дата"
+			rows = append(rows, row)
+			continue
+		}
+		row.Date = date
+
+		amount, err := ParseMoney(statementColumn(record, profile.AmountColumn))
+		if err != nil || amount == 0 {
+			row.Error = "Некорректная сумма"
+			rows = append(rows, row)
+			continue
+		}
+		row.Kind = kindIncome
+		if (amount < 0) != profile.PositiveIsExpense {
+			row.Kind = kindExpense
+		}
+		if amount < 0 {
+			amount = -amount
+		}
+		row.Amount = amount
+
+		row.Comment = truncateText(statementColumn(record, profile.CommentColumn), 256)
+
+		if name := statementColumn(record, profile.CategoryColumn); name != "" {
+			if categoryID, ok := categoryIDs[strings.ToLower(name)]; ok {
+				row.Category = categoryID
+			}
+		}
+		if row.Category == 0 {
+			row.Error = "Не выбрана категория"
+		}
+		rows = append(rows, row)
+	}
+	return rows
+}
+
+type importKey struct {
+	date    string
+	kind    string
+	amount  Money
+	comment string
+}
+
+// markDuplicates flags rows already present in the account, a row matches
+// one existing transaction at most, so repeated purchases are kept
+func markDuplicates(rows []ImportRow, userID int, account int32) error {
+	if len(rows) == 0 {
+		return nil
+	}
+	from, to := time.Time{}, time.Time{}
+	for _, row := range rows {
+		if row.Error != "" {
+			continue
+		}
+		if from.IsZero() || row.Date.Before(from) {
+			from = row.Date
+		}
+		if to.IsZero() || row.Date.After(to) {
+			to = row.Date
+		}
+	}
+	if from.IsZero() {
+		return nil
+	}
+
+	existing, err := database.Queryx(
+		"SELECT date, kind, amount, COALESCE(comment, '') FROM transactions WHERE user_id = $1 AND account = $2 AND date BETWEEN $3::date AND $4::date",
+		userID, account, from.Format(dateLayout), to.Format(dateLayout),
+	)
+	if err != nil {
+		return err
+	}
+	defer existing.Close()
+
+	counts := map[importKey]int{}
+	for existing.Next() {
+		var (
+			date    time.Time
+			key     importKey
+			comment string
+		)
+		err = existing.Scan(&date, &key.kind, &key.amount, &comment)
+		if err != nil {
+			return err
+		}
+		key.date = date.Format(dateLayout)
+		key.comment = comment
+		counts[key]++
+	}
+	err = existing.Err()
+	if err != nil {
+		return err
+	}
+
+	for i := range rows {
+		key := importKey{rows[i].Date.Format(dateLayout), rows[i].Kind, rows[i].Amount, rows[i].Comment}
+		if rows[i].Error == "" && counts[key] > 0 {
+			counts[key]--
+			rows[i].Duplicate = true
+		}
+	}
+	return nil
+}
+
+// parseImportProfile reads the mapping form, columns are zero based
+func parseImportProfile(r *http.Request) ImportProfile {
+	column := func(name string) int {
+		value, err := strconv.Atoi(r.FormValue(name))
+		if err != nil {
+			return noColumn
+		}
+		return value
+	}
+	id := func(name string) int32 {
+		value, err := strconv.ParseInt(r.FormValue(name), 10, 32)
+		if err != nil {
+			return 0
+		}
+		return int32(value)
+	}
+
+	profile := ImportProfile{
+		Name:              strings.TrimSpace(r.FormValue("profile-name")),
+		Delimiter:         r.FormValue("delimiter"),
+		HasHeader:         r.FormValue("has-header") == "on",
+		DateColumn:        column("date-column"),
+		DateFormat:        statementDateFormats[0],
+		AmountColumn:      column("amount-column"),
+		CommentColumn:     column("comment-column"),
+		CategoryColumn:    column("category-column"),
+		PositiveIsExpense: r.FormValue("positive-is-expense") == "on",
+		Account:           id("account-id"),
+		DefaultCategory:   id("category-id"),
+	}
+	for _, format := range statementDateFormats {
+		if r.FormValue("date-format") == format {
+			profile.DateFormat = format
+		}
+	}
+	if profile.Delimiter == "" {
+		profile.Delimiter = ","
+	}
+	return profile
+}
+
+func getAllImportProfilesOfUser(userID int) (profiles []ImportProfile, err error) {
+	profiles = []ImportProfile{}
+	err = database.Select(&profiles, `
+	SELECT id, name, delimiter, has_header AS hasheader, date_column AS datecolumn,
+		date_format AS dateformat, amount_column AS amountcolumn, comment_column AS commentcolumn,
+		category_column AS categorycolumn, positive_is_expense AS positiveisexpense,
+		COALESCE(account, 0) AS account, COALESCE(default_category, 0) AS defaultcategory
+	FROM import_profiles WHERE user_id = $1 ORDER BY name
+	`, userID)
+	return profiles, err
+}
+
+func saveImportProfile(userID int, profile ImportProfile) error {
+	_, err := database.Exec(`
+	INSERT INTO import_profiles(user_id, name, delimiter, has_header, date_column, date_format,
+		amount_column, comment_column, category_column, positive_is_expense, account, default_category)
+	VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, NULLIF($11, 0), NULLIF($12, 0))
+	ON CONFLICT (user_id, name) DO UPDATE SET
+		delimiter = EXCLUDED.delimiter, has_header = EXCLUDED.has_header,
+		date_column = EXCLUDED.date_column, date_format = EXCLUDED.date_format,
+		amount_column = EXCLUDED.amount_column, comment_column = EXCLUDED.comment_column,
+		category_column = EXCLUDED.category_column, positive_is_expense = EXCLUDED.positive_is_expense,
+		account = EXCLUDED.account, default_category = EXCLUDED.default_category
+	`,
+		userID, profile.Name, profile.Delimiter, profile.HasHeader, profile.DateColumn, profile.DateFormat,
+		profile.AmountColumn, profile.CommentColumn, profile.CategoryColumn, profile.PositiveIsExpense,
+		profile.Account, profile.DefaultCategory,
+	)
+	return err
+}
+
+func getCategoryIDsByName(categories []Category) map[string]int32 {
+	categoryIDs := map[string]int32{}
+	for _, c := range categories {
+		categoryIDs[strings.ToLower(c.Name)] = int32(c.ID)
+	}
+	return categoryIDs
+}
+
+func importView(w http.ResponseWriter, r *http.Request, userID int) {
+	renderImport(w, r, userID, ImportViewData{
+		ErrorDescription:   allErrors[getErrorCode(r)],
+		SuccessDescription: allNotifications[getSuccessCode(r)],
+	})
+}
+
+func renderImport(w http.ResponseWriter, r *http.Request, userID int, data ImportViewData) {
+	var err error
+	data.Title = "Импорт"
+	data.DateFormats = statementDateFormats
+	data.Categories = getAllCategoriesOfUser(database, userID)
+	data.Accounts, err = getAllAccountsOfUser(database, userID)
+	if err != nil {
+		log.Println(err)
+	}
+	data.Profiles, err = getAllImportProfilesOfUser(userID)
+	if err != nil {
+		log.Println("Query import profiles failed", err)
+	}
+
+	tmpl, err := template.ParseFiles("templates/layout.html", "templates/import.html", "templates/navigation_logedin.html")
+	if err != nil {
+		log.Println(err)
+	}
+	err = renderLayout(w, r, tmpl, &data)
+	if err != nil {
+		log.Println(err)
+	}
+}
+
+// readImportContent returns the uploaded statement, or the one carried over
+// from the previous step of the wizard
+func readImportContent(r *http.Request) (content []byte, err error) {
+	file, _, err := r.FormFile("statement-file")
+	if err == nil {
+		defer file.Close()
+		content, err = ioutil.ReadAll(io.LimitReader(file, maxStatementSize))
+		// The rest of the wizard works with UTF-8 only
+		if err == nil && r.FormValue("encoding") == "windows-1251" {
+			content = []byte(decodeWindows1251(content))
+		}
+		return content, err
+	}
+	return base64.StdEncoding.DecodeString(r.FormValue("content"))
+}
+
+func previewImport(w http.ResponseWriter, r *http.Request, userID int) {
+	err := r.ParseMultipartForm(maxStatementSize)
+	if err != nil && err != http.ErrNotMultipart {
+		log.Println(err)
+		http.Redirect(w, r, "/import?error=3", 302)
+		return
+	}
+	content, err := readImportContent(r)
+	if err != nil || len(content) == 0 {
+		log.Println("Reading statement failed", err)
+		http.Redirect(w, r, "/import?error=25", 302)
+		return
+	}
+
+	profile := parseImportProfile(r)
+	profiles, err := getAllImportProfilesOfUser(userID)
+	if err != nil {
+		log.Println(err)
+	}
+	if profileID, err := strconv.Atoi(r.FormValue("profile-id")); err == nil {
+		for _, p := range profiles {
+			if p.ID == profileID {
+				profile = p
+			}
+		}
+	}
+
+	records, err := readStatement(content, profile.Delimiter)
+	if err != nil || len(records) == 0 {
+		log.Println("Parsing statement failed", err)
+		http.Redirect(w, r, "/import?error=25", 302)
+		return
+	}
+
+	data := ImportViewData{
+		Profile: profile,
+		Content: base64.StdEncoding.EncodeToString(content),
+		Header:  records[0],
+	}
+	if profile.DateColumn != noColumn && profile.AmountColumn != noColumn {
+		categories := getAllCategoriesOfUser(database, userID)
+		data.Rows = parseStatement(records, profile, getCategoryIDsByName(categories))
+		err = markDuplicates(data.Rows, userID, profile.Account)
+		if err != nil {
+			log.Println("Searching duplicates failed", err)
+		}
+	}
+	renderImport(w, r, userID, data)
+}
+
+func commitImport(w http.ResponseWriter, r *http.Request, userID int) {
+	err := r.ParseForm()
+	if err != nil {
+		log.Println(err)
+		http.Redirect(w, r, "/import?error=3", 302)
+		return
+	}
+	content, err := readImportContent(r)
+	if err != nil {
+		log.Println(err)
+		http.Redirect(w, r, "/import?error=25", 302)
+		return
+	}
+	profile := parseImportProfile(r)
+	exists, err := isAccountOfUser(profile.Account, userID)
+	if err != nil || !exists {
+		log.Println("Import into wrong account", profile.Account, err)
+		http.Redirect(w, r, "/import?error=18", 302)
+		return
+	}
+	accountCurrency, err := getAccountCurrency(profile.Account)
+	if err != nil {
+		log.Println(err)
+		http.Redirect(w, r, "/import?error=18", 302)
+		return
+	}
+	records, err := readStatement(content, profile.Delimiter)
+	if err != nil {
+		log.Println(err)
+		http.Redirect(w, r, "/import?error=25", 302)
+		return
+	}
+
+	// Categories are resolved among the user's ones only, so rows can not be
+	// attached to a category of somebody else
+	categories := getAllCategoriesOfUser(database, userID)
+	rows := parseStatement(records, profile, getCategoryIDsByName(categories))
+	if profile.DefaultCategory != 0 {
+		exists, err := isCategoryOfUser(profile.DefaultCategory, userID)
+		if err != nil || !exists {
+			log.Println("Import into wrong category", profile.DefaultCategory, err)
+			http.Redirect(w, r, "/import?error=4", 302)
+			return
+		}
+	}
+	err = markDuplicates(rows, userID, profile.Account)
+	if err != nil {
+		log.Println("Searching duplicates failed", err)
+		http.Redirect(w, r, "/import?error=6", 302)
+		return
+	}
+
+	tx, err := database.Beginx()
+	if err != nil {
+		log.Println(err)
+		http.Redirect(w, r, "/import?error=6", 302)
+		return
+	}
+	imported := 0
+	for _, row := range rows {
+		if row.Error != "" || row.Duplicate {
+			continue
+		}
+		_, err = tx.Exec(
+			"INSERT INTO transactions(user_id, date, kind, account, category, amount, currency, comment) VALUES ($1, $2, $3, $4, $5, $6, $7, $8)",
+			userID, row.Date.Format(dateLayout), row.Kind, profile.Account, row.Category, row.Amount, accountCurrency, row.Comment,
+		)
+		if err != nil {
+			break
+		}
+		imported++
+	}
+	if err != nil {
+		tx.Rollback()
+		log.Println("Import failed", err)
+		http.Redirect(w, r, "/import?error=6", 302)
+		return
+	}
+	err = tx.Commit()
+	if err != nil {
+		log.Println("Import failed", err)
+		http.Redirect(w, r, "/import?error=6", 302)
+		return
+	}
+	log.Println("Imported transactions", imported)
+
+	if profile.Name != "" {
+		err = saveImportProfile(userID, profile)
+		if err != nil {
+			log.Println("Saving import profile failed", err)
+		}
+	}
+	http.Redirect(w, r, "/import?success=5", 302)
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+	"unicode/utf8"
+)
+
+func TestParseStatement(t *testing.T) {
+	records, err := readStatement([]byte("\xef\xbb\xbfДата;Сумма;Описание;Категория\n"+
+		"01.03.2026;-1 250,50;Магазин;Продукты\n"+
+		"02.03.2026;50000;Зарплата;\n"+
+		"03.03.2026;abc;Ошибка;\n"+
+		"вчера;-10;Ошибка;\n"), ";")
+	if err != nil {
+		t.Fatal(err)
+	}
+	profile := ImportProfile{
+		HasHeader:       true,
+		DateColumn:      0,
+		DateFormat:      "02.01.2006",
+		AmountColumn:    1,
+		CommentColumn:   2,
+		CategoryColumn:  3,
+		DefaultCategory: 7,
+	}
+	rows := parseStatement(records, profile, map[string]int32{"продукты": 3})
+	if len(rows) != 4 {
+		t.Fatalf("got %d rows, expected 4", len(rows))
+	}
+
+	expected := ImportRow{Line: 2, Date: time.Date(2026, time.March, 1, 0, 0, 0, 0, time.UTC), Kind: kindExpense, Amount: 125050, Comment: "Магазин", Category: 3}
+	if rows[0] != expected {
+		t.Errorf("got %+v, expected %+v", rows[0], expected)
+	}
+	if rows[1].Kind != kindIncome || rows[1].Amount != 5000000 || rows[1].Category != 7 {
+		t.Errorf("income row parsed as %+v", rows[1])
+	}
+	if rows[2].Error == "" || rows[3].Error == "" {
+		t.Errorf("invalid rows are accepted: %+v, %+v", rows[2], rows[3])
+	}
+
+	profile.PositiveIsExpense = true
+	profile.DefaultCategory = 0
+	rows = parseStatement(records, profile, map[string]int32{})
+	if rows[0].Kind != kindIncome || rows[1].Kind != kindExpense {
+		t.Errorf("sign is not inverted: %+v, %+v", rows[0], rows[1])
+	}
+	if rows[0].Error == "" {
+		t.Error("row without category is accepted")
+	}
+}
+
+func TestParseStatementLongComment(t *testing.T) {
+	comment := strings.Repeat("я", 300)
+	records := [][]string{{"01.03.2026", "-10", comment + "\xff"}}
+	profile := ImportProfile{DateFormat: "02.01.2006", AmountColumn: 1, CommentColumn: 2, DefaultCategory: 7}
+	rows := parseStatement(records, profile, map[string]int32{})
+	if rows[0].Comment != comment[:512] || !utf8.ValidString(rows[0].Comment) {
+		t.Errorf("comment cut to %d bytes", len(rows[0].Comment))
+	}
+}
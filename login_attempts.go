@@ -0,0 +1,181 @@
+package main
+
+import (
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// lockedErrorCode is shown while logins of the email or the address are
+// blocked
+const lockedErrorCode = 36
+
+// Failed attempts allowed before the backoff starts, an address may be shared
+// by many users behind NAT
+const (
+	freeEmailAttempts = 5
+	freeIPAttempts    = 20
+)
+
+// The first lock lasts loginBackoffBase and every next failure doubles it up
+// to loginBackoffLimit. Failures older than loginAttemptsWindow or made before
+// a successful login are not counted.
+const (
+	loginBackoffBase    = 30 * time.Second
+	loginBackoffLimit   = time.Hour
+	loginAttemptsWindow = 24 * time.Hour
+	loginAttemptsKept   = 90 * 24 * time.Hour
+)
+
+// trustProxyHeaders is set on Heroku, where the router appends the address of
+// the client to X-Forwarded-For. Elsewhere the header is set by the client.
+var trustProxyHeaders = os.Getenv("DYNO") != ""
+
+// LoginAttempt - element of login_attempts table
+type LoginAttempt struct {
+	Attempted time.Time
+	IP        string
+	UserAgent string
+}
+
+// clientIP returns the address of the client, behind the Heroku router it is
+// the last address of X-Forwarded-For, the earlier ones may be forged
+func clientIP(r *http.Request) string {
+	if trustProxyHeaders {
+		forwarded := strings.Split(r.Header.Get("X-Forwarded-For"), ",")
+		if ip := strings.TrimSpace(forwarded[len(forwarded)-1]); ip != "" {
+			return ip
+		}
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// loginBackoff returns how long logins are blocked after the last of the
+// failures
+func loginBackoff(failures int, free int) time.Duration {
+	if failures < free {
+		return 0
+	}
+	backoff := loginBackoffBase
+	for i := free; i < failures && backoff < loginBackoffLimit; i++ {
+		backoff *= 2
+	}
+	if backoff > loginBackoffLimit {
+		backoff = loginBackoffLimit
+	}
+	return backoff
+}
+
+// loginLockedUntil returns the end of the lock by recent failures of the
+// column value, zero when logins are allowed
+func loginLockedUntil(column string, value string, free int) (until time.Time, err error) {
+	var (
+		failures    int
+		lastFailure *time.Time
+	)
+	err = database.QueryRowx(`
+	SELECT COUNT(*), MAX(attempted)
+	FROM login_attempts
+	WHERE `+column+` = $1 AND NOT succeeded AND attempted > NOW() - $2 * interval '1 second'
+		AND attempted > COALESCE((
+			SELECT MAX(attempted) FROM login_attempts WHERE `+column+` = $1 AND succeeded
+		), '-infinity')
+	`, value, int64(loginAttemptsWindow.Seconds())).Scan(&failures, &lastFailure)
+	if err != nil || lastFailure == nil {
+		return until, err
+	}
+	backoff := loginBackoff(failures, free)
+	if backoff == 0 {
+		return until, nil
+	}
+	return lastFailure.Add(backoff), nil
+}
+
+// isLoginLocked reports whether logins of the email or from the address are
+// blocked now, errors of the check do not block them
+func isLoginLocked(email string, ip string) bool {
+	email, ip = truncateText(email, 256), truncateText(ip, 128)
+	for _, limit := range []struct {
+		column, value string
+		free          int
+	}{
+		{"email", email, freeEmailAttempts},
+		{"ip", ip, freeIPAttempts},
+	} {
+		until, err := loginLockedUntil(limit.column, limit.value, limit.free)
+		if err != nil {
+			log.Println("Checking login attempts failed", err)
+			continue
+		}
+		if time.Now().Before(until) {
+			log.Println("Login locked", limit.column, limit.value, "until", until)
+			return true
+		}
+	}
+	return false
+}
+
+// recordLoginAttempt stores the attempt, the values are cleaned so that any
+// header sent by the client fits the table. A failure to record means the
+// attempt would not be counted, so callers refuse the login then.
+func recordLoginAttempt(r *http.Request, email string, userID int, succeeded bool) error {
+	email = truncateText(email, 256)
+	userAgent := truncateText(r.Header.Get("User-Agent"), 256)
+	ip := truncateText(clientIP(r), 128)
+	_, err := database.Exec(
+		"INSERT INTO login_attempts(email, user_id, ip, user_agent, succeeded) VALUES ($1, NULLIF($2, 0), $3, $4, $5)",
+		email, userID, ip, userAgent, succeeded,
+	)
+	if err != nil {
+		log.Println("Recording login attempt failed", err)
+		return err
+	}
+	_, err = database.Exec(
+		"DELETE FROM login_attempts WHERE email = $1 AND attempted < NOW() - $2 * interval '1 second'",
+		email, int64(loginAttemptsKept.Seconds()),
+	)
+	if err != nil {
+		log.Println(err)
+	}
+	return nil
+}
+
+// authenticate checks the password unless logins are locked and records the
+// attempt, the error code is 0 for a valid password. With the second factor
+// the login succeeds only with the code, so failures are not reset before it.
+func authenticate(r *http.Request, email string, password string) (dbUser User, errorCode int) {
+	if isLoginLocked(email, clientIP(r)) {
+		return dbUser, lockedErrorCode
+	}
+	dbUser, ok := checkPassword(email, password)
+	if !ok || !dbUser.TOTPEnabled {
+		if recordLoginAttempt(r, email, dbUser.ID, ok) != nil {
+			return dbUser, 6
+		}
+	}
+	if !ok {
+		return dbUser, 2
+	}
+	return dbUser, 0
+}
+
+// getFailedLoginAttempts returns recent failed logins of the user for the
+// settings page
+func getFailedLoginAttempts(userID int) (attempts []LoginAttempt, err error) {
+	attempts = []LoginAttempt{}
+	err = database.Select(&attempts, `
+	SELECT attempted, ip, COALESCE(user_agent, '') AS useragent
+	FROM login_attempts
+	WHERE user_id = $1 AND NOT succeeded
+	ORDER BY attempted DESC
+	LIMIT 20
+	`, userID)
+	return attempts, err
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+	"unicode/utf8"
+)
+
+func TestLoginBackoff(t *testing.T) {
+	cases := []struct {
+		failures int
+		expected time.Duration
+	}{
+		{0, 0},
+		{4, 0},
+		{5, 30 * time.Second},
+		{6, time.Minute},
+		{8, 4 * time.Minute},
+		{12, time.Hour},
+		{1000, time.Hour},
+	}
+	for _, c := range cases {
+		if backoff := loginBackoff(c.failures, freeEmailAttempts); backoff != c.expected {
+			t.Errorf("%d failures: backoff %s, expected %s", c.failures, backoff, c.expected)
+		}
+	}
+}
+
+func TestTruncateText(t *testing.T) {
+	cases := []struct {
+		value    string
+		length   int
+		expected string
+	}{
+		{"Mozilla/5.0", 256, "Mozilla/5.0"},
+		{"агент", 3, "аге"},
+		{"bad\xff\xfeagent", 256, "bad\uFFFDagent"},
+		{strings.Repeat("я", 200), 150, strings.Repeat("я", 150)},
+	}
+	for _, c := range cases {
+		if truncated := truncateText(c.value, c.length); truncated != c.expected || !utf8.ValidString(truncated) {
+			t.Errorf("%q cut to %q, expected %q", c.value, truncated, c.expected)
+		}
+	}
+}
+
+func TestClientIP(t *testing.T) {
+	defer func(trust bool) { trustProxyHeaders = trust }(trustProxyHeaders)
+
+	request := httptest.NewRequest("POST", "/login", nil)
+	request.RemoteAddr = "10.0.0.1:51234"
+	request.Header.Set("X-Forwarded-For", "1.2.3.4, 5.6.7.8")
+
+	trustProxyHeaders = false
+	if ip := clientIP(request); ip != "10.0.0.1" {
+		t.Errorf("untrusted header is used: %s", ip)
+	}
+	trustProxyHeaders = true
+	if ip := clientIP(request); ip != "5.6.7.8" {
+		t.Errorf("address of the router is %s", ip)
+	}
+	request.Header.Del("X-Forwarded-For")
+	if ip := clientIP(request); ip != "10.0.0.1" {
+		t.Errorf("address without the header is %s", ip)
+	}
+}
@@ -1,11 +1,14 @@
 package main
 
 import (
+	"database/sql"
 	"html/template"
 	"log"
 	"net/http"
+	"net/url"
 	"os"
 	"strconv"
+	"strings"
 	"time"
 
 	"github.com/gorilla/mux"
@@ -15,75 +18,163 @@ import (
 
 var database *sqlx.DB
 
+const dateLayout = "2006-01-02"
+
+// Kinds of transactions, only expenses are counted as spending
+const (
+	kindExpense  = "expense"
+	kindIncome   = "income"
+	kindTransfer = "transfer"
+)
+
+func isValidKind(kind string) bool {
+	return kind == kindExpense || kind == kindIncome || kind == kindTransfer
+}
+
 // Transaction - element of corresponding table
 type Transaction struct {
-	ID       int
-	Date     time.Time
-	Category int32
-	Amount   float32
-	Comment  string
+	ID        int
+	Date      time.Time
+	Kind      string
+	Account   int32
+	ToAccount sql.NullInt32
+	Category  int32
+	Amount    Money
+	Currency  string
+	Comment   string
 }
 
 // TransactionNamed - element of corresponding table
 type TransactionNamed struct {
 	ID           int
 	Date         time.Time
+	Kind         string
+	AccountName  string
 	CategoryName string
-	Amount       float32
+	Amount       Money
+	Currency     string
+	BaseAmount   *Money
 	Comment      string
+	Tags         string
 }
 
 // IndexViewData - information to display on page
 type IndexViewData struct {
+	LayoutData
 	Title            string
+	BaseCurrency     string
+	Accounts         []Account
 	Categories       []Category
-	MonthlyTotal     float32
-	WeeklyTotal      float32
+	DailyTotal       Money
+	WeeklyTotal      Money
+	MonthlyTotal     Money
+	QuarterlyTotal   Money
+	YearToDateTotal  Money
+	MonthlyIncome    Money
+	MonthlyNet       Money
+	MissingRates     int
+	Budgets          []BudgetProgress
+	Tags             []string
 	ErrorDescription string
 }
 
 // ReportsViewData - information to display on page
 type ReportsViewData struct {
-	Title        string
-	Transactions []TransactionNamed
+	LayoutData
+	Title            string
+	BaseCurrency     string
+	Transactions     []TransactionNamed
+	Categories       []Category
+	Query            ReportsQuery
+	FilterValues     url.Values
+	State            string
+	Next             string
+	ErrorDescription string
 }
 
 // ReportsEditorViewData - information to display on page
 type ReportsEditorViewData struct {
+	LayoutData
 	Title            string
 	Transaction      Transaction
+	TransactionTags  string
+	Splits           []TransactionSplit
+	Tags             []string
+	Accounts         []Account
 	Categories       []Category
+	State            string
 	ErrorDescription string
 }
 
 var allErrors = map[int]string{
-	0: "",
-	2: "Неправильные логин/пароль",
-	3: "Не удалось обработать данные формы",
-	4: "Не выбрана категория",
-	5: "Некорректное значение суммы",
-	6: "Не удалось сохранить данные в базе",
-	7: "Не удалось поменять пароль",
-	8: "Пользователь с таким email уже существует",
+	0:  "",
+	2:  "Неправильные логин/пароль",
+	3:  "Не удалось обработать данные формы",
+	4:  "Не выбрана категория",
+	5:  "Некорректное значение суммы",
+	6:  "Не удалось сохранить данные в базе",
+	7:  "Не удалось поменять пароль",
+	8:  "Пользователь с таким email уже существует",
+	9:  "Не удалось сохранить настройки",
+	10: "Требуется авторизация",
+	11: "Объект не найден",
+	12: "Некорректные параметры постраничного вывода",
+	13: "Не удалось получить данные из базы",
+	14: "Некорректная дата",
+	15: "Не задано имя категории",
+	16: "Не удалось создать токен",
+	17: "Некорректный тип операции",
+	18: "Не выбран счет",
+	19: "Некорректный счет для перевода",
+	20: "Некорректный код валюты",
+	21: "Нельзя удалить счет, по которому есть операции",
+	22: "Не задано имя счета",
+	23: "Некорректный курс валюты",
+	24: "Не удалось разобрать файл с курсами валют",
+	25: "Не удалось прочитать выписку",
+	26: "Неизвестный формат выгрузки",
+	27: "Не удалось восстановить данные из резервной копии",
+	28: "Неверный интервал графика",
+	29: "Неверное правило повторения",
+	30: "Категорию нельзя вложить в нее саму или в ее подкатегорию",
+	31: "По категории есть операции, выберите категорию для их переноса",
+	32: "Категорию нельзя объединить с ней самой",
+	33: "Расход или доход можно разделить на две категории и более",
+	34: "Сумма частей должна быть равна сумме операции",
+	35: "Форма устарела, обновите страницу и отправьте ее еще раз",
+	36: "Слишком много неудачных попыток входа, вход временно заблокирован. Попробуйте позже",
+	37: "Неверный код подтверждения",
+	38: "Время на ввод кода истекло, войдите еще раз",
+	39: "Требуется код подтверждения",
+	40: "Неверный пароль",
+	41: "Токен позволяет только чтение",
+	42: "Начало повторения не может быть раньше чем год назад",
 }
 
 var allNotifications = map[int]string{
 	0: "",
 	1: "Пароль успешно изменен",
+	2: "Настройки сохранены",
+	3: "Токен создан, скопируйте его сейчас: он больше не будет показан",
+	4: "Курсы валют загружены",
+	5: "Выписка импортирована",
+	6: "Данные восстановлены из резервной копии",
+	7: "Двухфакторная аутентификация включена. Сохраните коды восстановления: они больше не будут показаны",
+	8: "Созданы новые коды восстановления, старые больше не действуют",
+	9: "Двухфакторная аутентификация отключена",
 }
 
-func loginRequired(handler func(w http.ResponseWriter, r *http.Request, userID int)) func(w http.ResponseWriter, r *http.Request) {
-	return func(w http.ResponseWriter, r *http.Request) {
-		userID := getUserID(r)
-		if userID == 0 {
-			http.Redirect(w, r, "/login", 302)
-		} else {
-			handler(w, r, userID)
-		}
+// truncateText makes the value valid UTF-8 and cuts it to the length in
+// characters, so it fits a varchar column without splitting a character
+func truncateText(value string, length int) string {
+	value = strings.ToValidUTF8(value, "\uFFFD")
+	if runes := []rune(value); len(runes) > length {
+		return string(runes[:length])
 	}
+	return value
 }
 
-func mainPageView(w http.ResponseWriter, r *http.Request, userID int) {
+func getErrorCode(r *http.Request) int {
 	errorCodes := r.URL.Query()["error"]
 	var errorCode int64
 	if len(errorCodes) > 0 {
@@ -93,32 +184,111 @@ func mainPageView(w http.ResponseWriter, r *http.Request, userID int) {
 			log.Println(err)
 		}
 	}
+	return int(errorCode)
+}
+
+func getSuccessCode(r *http.Request) int {
+	successCodes := r.URL.Query()["success"]
+	var successCode int64
+	if len(successCodes) > 0 {
+		var err error
+		successCode, err = strconv.ParseInt(successCodes[0], 10, 32)
+		if err != nil {
+			log.Println(err)
+		}
+	}
+	return int(successCode)
+}
+
+func loginRequired(handler func(w http.ResponseWriter, r *http.Request, userID int)) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		userID := getUserID(r)
+		if userID == 0 {
+			http.Redirect(w, r, "/login", 302)
+		} else {
+			handler(w, r, userID)
+		}
+	}
+}
+
+func mainPageView(w http.ResponseWriter, r *http.Request, userID int) {
+	errorCode := getErrorCode(r)
 
 	categories := getAllCategoriesOfUser(database, userID)
-	monthlyTotal, weeklyTotal, err := getMonthlyWeeklyTotal()
+	accounts, err := getAllAccountsOfUser(database, userID)
+	if err != nil {
+		log.Println(err)
+	}
+	weekStart, err := getUserWeekStart(database, userID)
+	if err != nil {
+		log.Println(err)
+	}
+	baseCurrency, err := getUserBaseCurrency(database, userID)
+	if err != nil {
+		log.Println(err)
+	}
+	totals, err := getPeriodTotals(database, userID, time.Now(), weekStart)
+	if err != nil {
+		log.Println(err)
+	}
+	budgets, err := getBudgetProgress(database, userID, time.Now())
+	if err != nil {
+		log.Println(err)
+	}
+	missingRates, err := countUnconvertedTransactions(database, userID, getPeriodStarts(time.Now(), weekStart).earliest(), time.Now())
 	if err != nil {
 		log.Println(err)
 	}
 
 	data := IndexViewData{
 		Title:            "Главная",
+		BaseCurrency:     baseCurrency,
+		Accounts:         accounts,
 		Categories:       categories,
-		MonthlyTotal:     monthlyTotal,
-		WeeklyTotal:      weeklyTotal,
-		ErrorDescription: allErrors[int(errorCode)],
+		DailyTotal:       totals.Daily,
+		WeeklyTotal:      totals.Weekly,
+		MonthlyTotal:     totals.Monthly,
+		QuarterlyTotal:   totals.Quarterly,
+		YearToDateTotal:  totals.YearToDate,
+		MonthlyIncome:    totals.MonthlyIncome,
+		MonthlyNet:       totals.MonthlyNet(),
+		Budgets:          budgets,
+		MissingRates:     missingRates,
+		Tags:             getTagsOfUser(database, userID),
+		ErrorDescription: allErrors[errorCode],
 	}
 	tmpl, _ := template.ParseFiles("templates/layout.html", "templates/index.html", "templates/navigation_logedin.html")
-	tmpl.ExecuteTemplate(w, "layout", data)
+	renderLayout(w, r, tmpl, &data)
 }
 
 func reportsView(w http.ResponseWriter, r *http.Request, userID int) {
-	transactions := getAllTransactionsOfUser(database, userID)
+	errorCode := getErrorCode(r)
+	query, queryErrorCode := parseReportsQuery(r)
+	if queryErrorCode != 0 {
+		errorCode = queryErrorCode
+	}
+	transactions, next, err := getTransactionsPage(database, userID, query)
+	if err != nil {
+		log.Println("Query transactions failed", err)
+		errorCode = 13
+	}
+	baseCurrency, err := getUserBaseCurrency(database, userID)
+	if err != nil {
+		log.Println(err)
+	}
 	data := ReportsViewData{
-		Title:        "Главная",
-		Transactions: transactions,
+		Title:            "Главная",
+		BaseCurrency:     baseCurrency,
+		Transactions:     transactions,
+		Categories:       getCategoriesOfUser(database, userID, true),
+		Query:            query,
+		FilterValues:     filterValues(r),
+		State:            r.URL.RawQuery,
+		Next:             next,
+		ErrorDescription: allErrors[errorCode],
 	}
 	tmpl, _ := template.ParseFiles("templates/layout.html", "templates/reports.html", "templates/navigation_logedin.html")
-	tmpl.ExecuteTemplate(w, "layout", data)
+	renderLayout(w, r, tmpl, &data)
 }
 
 func newTransaction(w http.ResponseWriter, r *http.Request, userID int) {
@@ -129,29 +299,68 @@ func newTransaction(w http.ResponseWriter, r *http.Request, userID int) {
 		http.Redirect(w, r, "/?error=3", 302)
 		return
 	}
+	kind := r.FormValue("kind")
+	if !isValidKind(kind) {
+		log.Println("Invalid kind", kind)
+		http.Redirect(w, r, "/?error=17", 302)
+		return
+	}
+	account, toAccount, errorCode := parseTransactionAccounts(r, kind, userID)
+	if errorCode != 0 {
+		http.Redirect(w, r, "/?error="+strconv.Itoa(errorCode), 302)
+		return
+	}
+	currency, errorCode := parseTransactionCurrency(r.FormValue("currency"), account)
+	if errorCode != 0 {
+		http.Redirect(w, r, "/?error="+strconv.Itoa(errorCode), 302)
+		return
+	}
 	categoryID, err := strconv.ParseInt(r.FormValue("category-id"), 10, 32)
 	if err != nil {
 		log.Println(err)
 		http.Redirect(w, r, "/?error=4", 302)
 		return
 	}
-	amount, err := strconv.ParseFloat(r.FormValue("amount"), 32)
-	if err != nil {
-		log.Println(err)
+	amount, err := ParseMoney(r.FormValue("amount"))
+	if err != nil || !amount.IsPositive() {
+		log.Println("Invalid amount", r.FormValue("amount"))
 		http.Redirect(w, r, "/?error=5", 302)
 		return
 	}
 	comment := r.FormValue("comment")
-	t := Transaction{0, time.Now(), int32(categoryID), float32(amount), comment}
-	_, err = database.Exec(
-		"INSERT INTO transactions(user_id, date, category, amount, comment) VALUES ($1, $2, $3, $4, $5)",
-		userID, t.Date, t.Category, t.Amount, t.Comment,
-	)
+	tags := parseTags(r.FormValue("tags"))
+	t := Transaction{
+		Date:      time.Now(),
+		Kind:      kind,
+		Account:   account,
+		ToAccount: toAccount,
+		Category:  int32(categoryID),
+		Amount:    amount,
+		Currency:  currency,
+		Comment:   comment,
+	}
+	tx, err := database.Beginx()
 	if err != nil {
 		log.Println(err)
 		http.Redirect(w, r, "/?error=6", 302)
 		return
 	}
+	err = tx.QueryRowx(
+		"INSERT INTO transactions(user_id, date, kind, account, to_account, category, amount, currency, comment) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9) RETURNING id",
+		userID, t.Date, t.Kind, t.Account, t.ToAccount, t.Category, t.Amount, t.Currency, t.Comment,
+	).Scan(&t.ID)
+	if err == nil {
+		err = setTransactionTags(tx, userID, t.ID, tags)
+	}
+	if err == nil {
+		err = tx.Commit()
+	}
+	if err != nil {
+		log.Println(err)
+		tx.Rollback()
+		http.Redirect(w, r, "/?error=6", 302)
+		return
+	}
 	http.Redirect(w, r, "/", 302)
 }
 
@@ -179,7 +388,7 @@ func deleteTransaction(w http.ResponseWriter, r *http.Request, userID int) {
 	} else {
 		log.Println("Wrong user")
 	}
-	http.Redirect(w, r, "/reports", 302)
+	http.Redirect(w, r, reportsURL(r.FormValue("state"), 0), 302)
 }
 
 func editTransaction(w http.ResponseWriter, r *http.Request, userID int) {
@@ -189,28 +398,80 @@ func editTransaction(w http.ResponseWriter, r *http.Request, userID int) {
 	}
 
 	transactionID := r.FormValue("transaction-id")
+	// The reports page is shown with the same filter, order and page
+	state := r.FormValue("state")
+	kind := r.FormValue("kind")
+	if !isValidKind(kind) {
+		log.Println("Invalid kind", kind)
+		http.Redirect(w, r, reportsURL(state, 17), 302)
+		return
+	}
+	account, toAccount, errorCode := parseTransactionAccounts(r, kind, userID)
+	if errorCode != 0 {
+		http.Redirect(w, r, reportsURL(state, errorCode), 302)
+		return
+	}
+	currency, errorCode := parseTransactionCurrency(r.FormValue("currency"), account)
+	if errorCode != 0 {
+		http.Redirect(w, r, reportsURL(state, errorCode), 302)
+		return
+	}
 	categoryID, err := strconv.ParseInt(r.FormValue("category-id"), 10, 32)
 	if err != nil {
 		log.Println(err)
-		http.Redirect(w, r, "/reports?error=4", 302)
+		http.Redirect(w, r, reportsURL(state, 4), 302)
 		return
 	}
-	amount, err := strconv.ParseFloat(r.FormValue("amount"), 32)
-	if err != nil {
-		log.Println(err)
-		http.Redirect(w, r, "/reports?error=5", 302)
+	amount, err := ParseMoney(r.FormValue("amount"))
+	if err != nil || !amount.IsPositive() {
+		log.Println("Invalid amount", r.FormValue("amount"))
+		http.Redirect(w, r, reportsURL(state, 5), 302)
 		return
 	}
+	splits, errorCode := parseSplits(r.Form["split-category-id"], r.Form["split-amount"])
+	if errorCode == 0 {
+		errorCode = checkSplits(splits, kind, amount)
+	}
+	if errorCode != 0 {
+		http.Redirect(w, r, reportsURL(state, errorCode), 302)
+		return
+	}
+	if len(splits) > 0 {
+		// The first line stands for the whole transaction where it has one category
+		categoryID = int64(splits[0].Category)
+	}
 	comment := r.FormValue("comment")
 
-	_, err = database.Exec(
-		"UPDATE transactions SET category = $1, amount = $2, comment = $3 WHERE id = $4 AND user_id = $5",
-		categoryID, amount, comment, transactionID, userID,
+	tx, err := database.Beginx()
+	if err != nil {
+		log.Println(err)
+		http.Redirect(w, r, reportsURL(state, 6), 302)
+		return
+	}
+	result, err := tx.Exec(
+		"UPDATE transactions SET kind = $1, account = $2, to_account = $3, category = $4, amount = $5, currency = $6, comment = $7 WHERE id = $8 AND user_id = $9",
+		kind, account, toAccount, categoryID, amount, currency, comment, transactionID, userID,
 	)
+	if err == nil {
+		// Tags and lines are changed only when the transaction belongs to the user
+		if affected, _ := result.RowsAffected(); affected > 0 {
+			id, _ := strconv.Atoi(transactionID)
+			err = setTransactionTags(tx, userID, id, parseTags(r.FormValue("tags")))
+			if err == nil {
+				err = setTransactionSplits(tx, userID, id, splits)
+			}
+		}
+	}
+	if err == nil {
+		err = tx.Commit()
+	}
 	if err != nil {
 		log.Println(err)
+		tx.Rollback()
+		http.Redirect(w, r, reportsURL(state, categoryErrorCode(err)), 302)
+		return
 	}
-	http.Redirect(w, r, "/reports", 302)
+	http.Redirect(w, r, reportsURL(state, 0), 302)
 }
 
 func editTransactionView(w http.ResponseWriter, r *http.Request, userID int) {
@@ -226,78 +487,54 @@ func editTransactionView(w http.ResponseWriter, r *http.Request, userID int) {
 	log.Println(transactionID)
 
 	var transaction Transaction
-	err := database.QueryRowx("select id, date, category, amount, comment from transactions where id = $1", transactionID).StructScan(&transaction)
+	err := database.QueryRowx("select id, date, kind, account, to_account AS toaccount, category, amount, currency, comment from transactions where id = $1 AND user_id = $2", transactionID, userID).StructScan(&transaction)
 	if err != nil {
 		log.Println(err)
 	}
 
-	categories := getAllCategoriesOfUser(database, userID)
+	splits, err := getTransactionSplits(database, transaction.ID)
+	if err != nil {
+		log.Println(err)
+	}
+	// Archived categories of the transaction and its lines stay selectable
+	used := []int{int(transaction.Category)}
+	for _, split := range splits {
+		used = append(used, int(split.Category))
+	}
+	categories := withoutArchived(getCategoriesOfUser(database, userID, true), used...)
+	accounts, err := getAllAccountsOfUser(database, userID)
+	if err != nil {
+		log.Println(err)
+	}
 
 	log.Println(transaction)
 
+	transactionTags, err := getTransactionTags(database, transaction.ID)
+	if err != nil {
+		log.Println(err)
+	}
+
 	data := ReportsEditorViewData{
 		Title:            "Вход",
 		Transaction:      transaction,
+		TransactionTags:  transactionTags,
+		Splits:           splits,
+		Tags:             getTagsOfUser(database, userID),
+		Accounts:         accounts,
 		Categories:       categories,
+		State:            r.URL.Query().Get("state"),
 		ErrorDescription: "",
 	}
 	tmpl, err := template.ParseFiles("templates/layout.html", "templates/reports_editor.html", "templates/navigation_logedin.html")
 	if err != nil {
 		log.Println(err)
 	}
-	err = tmpl.ExecuteTemplate(w, "layout", data)
+	err = renderLayout(w, r, tmpl, &data)
 	if err != nil {
 		log.Println(err)
 	}
 }
 
-func getMonthlyWeeklyTotal() (monthlyTotal float32, weeklyTotal float32, err error) {
-	err = database.QueryRowx(`
-	SELECT 
-		COALESCE(monthly_sum.total_amount, 0) AS monthly_sum,
-		COALESCE(weekly_sum.total_amount, 0) AS weekly_sum
-	FROM (
-		SELECT SUM(amount) AS total_amount FROM transactions
-		WHERE EXTRACT(month FROM now()) = EXTRACT(month FROM date)
-	) AS monthly_sum
-	CROSS JOIN (
-		SELECT SUM(amount) AS total_amount FROM transactions
-		WHERE EXTRACT(week FROM now()) = EXTRACT(week FROM date)
-	) AS weekly_sum
-	`).Scan(&monthlyTotal, &weeklyTotal)
-	return monthlyTotal, weeklyTotal, err
-}
-
-func getAllTransactionsOfUser(db *sqlx.DB, userID int) (transactions []TransactionNamed) {
-	rows, err := db.Queryx(`
-	SELECT t.id, date, c.name AS categoryname, amount, comment 
-	FROM transactions t
-	JOIN categories c
-	ON t.category = c.id
-	WHERE t.user_id = $1 ORDER BY date DESC
-	`, userID)
-	if err != nil {
-		log.Fatal(err)
-	}
-	defer rows.Close()
-
-	transactions = []TransactionNamed{}
-
-	for rows.Next() {
-		t := TransactionNamed{}
-		err := rows.StructScan(&t)
-		if err != nil {
-			log.Fatal(err)
-		}
-		transactions = append(transactions, t)
-	}
-	err = rows.Err()
-	if err != nil {
-		log.Fatal(err)
-	}
-	return transactions
-}
-
 func main() {
 	dsnURL := os.Getenv("DATABASE_URL")
 	if len(dsnURL) == 0 {
@@ -313,25 +550,70 @@ func main() {
 	}
 	database = db
 	defer db.Close()
+	cookieCodecs = loadCookieKeys(os.Getenv("COOKIE_KEYS"))
+	go runRecurringScheduler(db, schedulerInterval)
 
 	var router = mux.NewRouter()
 	router.HandleFunc("/", loginRequired(mainPageView)).Methods("GET")
 	router.HandleFunc("/", loginRequired(newTransaction)).Methods("POST")
 	router.HandleFunc("/login", login)
+	router.HandleFunc("/login/two_factor", loginSecondFactor)
 	router.HandleFunc("/signup", signup)
 	router.HandleFunc("/logout", logout).Methods("POST")
 	router.HandleFunc("/categories", loginRequired(allCategoriesView)).Methods("GET")
 	router.HandleFunc("/categories", loginRequired(addNewCategory)).Methods("POST")
 	router.HandleFunc("/reports", loginRequired(reportsView)).Methods("GET")
+	router.HandleFunc("/reports/accounts", loginRequired(accountReportView)).Methods("GET")
+	router.HandleFunc("/reports/categories", loginRequired(categoryReportView)).Methods("GET")
+	router.HandleFunc("/reports/charts", loginRequired(chartReportView)).Methods("GET")
+	router.HandleFunc("/reports/tags", loginRequired(tagReportView)).Methods("GET")
+	router.HandleFunc("/reports/export", loginRequired(exportTransactions)).Methods("GET")
 	router.HandleFunc("/reports/delete", loginRequired(deleteTransaction)).Methods("POST")
 	router.HandleFunc("/reports/edit", loginRequired(editTransactionView)).Methods("GET")
 	router.HandleFunc("/reports/edit", loginRequired(editTransaction)).Methods("POST")
+	router.HandleFunc("/categories/delete", loginRequired(deleteCategoryView)).Methods("GET")
 	router.HandleFunc("/categories/delete", loginRequired(deleteCategory)).Methods("POST")
+	router.HandleFunc("/categories/merge", loginRequired(mergeCategories)).Methods("POST")
+	router.HandleFunc("/categories/archive", loginRequired(archiveCategory)).Methods("POST")
+	router.HandleFunc("/categories/unarchive", loginRequired(unarchiveCategory)).Methods("POST")
 	router.HandleFunc("/categories/edit", loginRequired(editCategoryView)).Methods("GET")
 	router.HandleFunc("/categories/edit", loginRequired(editCategory)).Methods("POST")
+	router.HandleFunc("/categories/move", loginRequired(moveCategory)).Methods("POST")
+	router.HandleFunc("/import", loginRequired(importView)).Methods("GET")
+	router.HandleFunc("/import", loginRequired(commitImport)).Methods("POST")
+	router.HandleFunc("/import/preview", loginRequired(previewImport)).Methods("POST")
+	router.HandleFunc("/budgets", loginRequired(budgetsView)).Methods("GET")
+	router.HandleFunc("/budgets", loginRequired(saveBudget)).Methods("POST")
+	router.HandleFunc("/budgets/delete", loginRequired(deleteBudget)).Methods("POST")
+	router.HandleFunc("/recurring", loginRequired(recurringView)).Methods("GET")
+	router.HandleFunc("/recurring", loginRequired(addRecurringTransaction)).Methods("POST")
+	router.HandleFunc("/recurring/delete", loginRequired(deleteRecurringTransaction)).Methods("POST")
+	router.HandleFunc("/recurring/skip", loginRequired(skipOccurrence)).Methods("POST")
+	router.HandleFunc("/recurring/unskip", loginRequired(unskipOccurrence)).Methods("POST")
+	router.HandleFunc("/accounts", loginRequired(allAccountsView)).Methods("GET")
+	router.HandleFunc("/accounts", loginRequired(addNewAccount)).Methods("POST")
+	router.HandleFunc("/accounts/delete", loginRequired(deleteAccount)).Methods("POST")
+	router.HandleFunc("/accounts/edit", loginRequired(editAccountView)).Methods("GET")
+	router.HandleFunc("/accounts/edit", loginRequired(editAccount)).Methods("POST")
 	router.HandleFunc("/settings", loginRequired(settingsView))
 	router.HandleFunc("/settings/change_password", loginRequired(changePassword)).Methods("POST")
 	router.HandleFunc("/settings/terminate_session", loginRequired(terminateSession)).Methods("POST")
+	router.HandleFunc("/settings/week_start", loginRequired(changeWeekStart)).Methods("POST")
+	router.HandleFunc("/settings/base_currency", loginRequired(changeBaseCurrency)).Methods("POST")
+	router.HandleFunc("/settings/backup", loginRequired(downloadBackup)).Methods("GET")
+	router.HandleFunc("/settings/restore", loginRequired(uploadBackup)).Methods("POST")
+	router.HandleFunc("/settings/two_factor/setup", loginRequired(startTwoFactorSetup)).Methods("POST")
+	router.HandleFunc("/settings/two_factor/enable", loginRequired(enableTwoFactor)).Methods("POST")
+	router.HandleFunc("/settings/two_factor/recovery_codes", loginRequired(regenerateRecoveryCodes)).Methods("POST")
+	router.HandleFunc("/settings/two_factor/disable", loginRequired(disableTwoFactor)).Methods("POST")
+	router.HandleFunc("/rates", loginRequired(ratesView)).Methods("GET")
+	router.HandleFunc("/rates", loginRequired(addExchangeRate)).Methods("POST")
+	router.HandleFunc("/rates/import", loginRequired(importExchangeRates)).Methods("POST")
+	router.HandleFunc("/rates/delete", loginRequired(deleteExchangeRate)).Methods("POST")
+	router.HandleFunc("/settings/api_tokens", loginRequired(createAPIToken)).Methods("POST")
+	router.HandleFunc("/settings/api_tokens/revoke", loginRequired(revokeAPIToken)).Methods("POST")
+	registerAPIRoutes(router)
+	router.Use(csrfProtection)
 	http.Handle("/", router)
 
 	port := os.Getenv("PORT")
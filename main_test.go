@@ -1,6 +1,9 @@
 package main
 
 import (
+	"html/template"
+	"io/ioutil"
+	"net/url"
 	"testing"
 
 	_ "github.com/lib/pq"
@@ -9,3 +12,53 @@ import (
 func TestNewTransaction(t *testing.T) {
 
 }
+
+func TestTemplatesRender(t *testing.T) {
+	pages := []struct {
+		content    string
+		navigation string
+		data       interface{}
+	}{
+		{"templates/index.html", "templates/navigation_logedin.html", IndexViewData{Accounts: []Account{{}}, Categories: []Category{{}}, Budgets: []BudgetProgress{{}}, Tags: []string{"отпуск"}, MissingRates: 2}},
+		{"templates/reports.html", "templates/navigation_logedin.html", ReportsViewData{Transactions: []TransactionNamed{{Kind: kindIncome, Tags: "дети, отпуск"}, {Currency: "EUR"}}, Categories: []Category{{}}, Query: ReportsQuery{Sort: defaultReportSort, After: "1:2020-01-01"}, Next: "2:2020-01-01", FilterValues: url.Values{"q": {"кафе"}}}},
+		{"templates/reports_editor.html", "templates/navigation_logedin.html", ReportsEditorViewData{Accounts: []Account{{}}, Categories: []Category{{}}, TransactionTags: "отпуск", Tags: []string{"отпуск"},
+			Splits: []TransactionSplit{{Category: 1, Amount: 100}, {Category: 2, Amount: 50}},
+		}},
+		{"templates/categories.html", "templates/navigation_logedin.html", CategoryViewData{Categories: []Category{{Depth: 1}, {Archived: true}}, ErrorDescription: "ошибка"}},
+		{"templates/categories_editor.html", "templates/navigation_logedin.html", CategoryEditorViewData{Category: Category{ID: 2, Parent: 1}, Parents: []Category{{ID: 1}}, Targets: []Category{{ID: 1}}}},
+		{"templates/categories_delete.html", "templates/navigation_logedin.html", CategoryDeleteViewData{Transactions: 3, Targets: []Category{{ID: 1}}}},
+		{"templates/accounts.html", "templates/navigation_logedin.html", AccountViewData{Accounts: []Account{{}, {MissingRates: 2}}}},
+		{"templates/accounts_editor.html", "templates/navigation_logedin.html", AccountEditorViewData{}},
+		{"templates/reports_accounts.html", "templates/navigation_logedin.html", AccountReportViewData{Accounts: []Account{{}}, Account: Account{MissingRates: 1}, Entries: []AccountEntry{{}}}},
+		{"templates/reports_categories.html", "templates/navigation_logedin.html", CategoryReportViewData{Kind: kindExpense, Shares: []CategoryShare{{}, {Depth: 1}}, MissingRates: 1}},
+		{"templates/reports_charts.html", "templates/navigation_logedin.html", ChartReportViewData{Unit: bucketWeek, Chart: SpendingChart{Series: []ChartSeries{{}}}}},
+		{"templates/reports_tags.html", "templates/navigation_logedin.html", TagReportViewData{Totals: []TagTotal{{Name: "отпуск", Count: 2}}}},
+		{"templates/budgets.html", "templates/navigation_logedin.html", BudgetViewData{Budgets: []BudgetProgress{{Budget: Budget{Category: 1, Rollover: true}}}, Categories: []Category{{}}}},
+		{"templates/recurring.html", "templates/navigation_logedin.html", RecurringViewData{
+			Recurring: []RecurringTransaction{{Frequency: frequencyMonthly, Every: 1}},
+			Upcoming:  []Occurrence{{}}, Skipped: []Occurrence{{}}, Accounts: []Account{{}}, Categories: []Category{{}},
+		}},
+		{"templates/settings.html", "templates/navigation_logedin.html", SettingsViewData{Sessions: []Session{{}}, APITokens: []APIToken{{}}, FailedLogins: []LoginAttempt{{}}}},
+		{"templates/settings.html", "templates/navigation_logedin.html", SettingsViewData{TwoFactorSecret: "JBSWY3DPEHPK3PXP", TwoFactorQRCode: "data:image/png;base64,AA=="}},
+		{"templates/settings.html", "templates/navigation_logedin.html", SettingsViewData{TwoFactorEnabled: true, NewRecoveryCodes: []string{"abcde-fghij"}}},
+		{"templates/rates.html", "templates/navigation_logedin.html", RatesViewData{Rates: []ExchangeRate{{}}}},
+		{"templates/import.html", "templates/navigation_logedin.html", ImportViewData{
+			Content: "ZGF0ZQ==", Header: []string{"date"}, Accounts: []Account{{}}, Categories: []Category{{}}, Rows: []ImportRow{{}},
+		}},
+		{"templates/error.html", "templates/navigation_logedin.html", ViewData{ErrorDescription: "ошибка", LayoutData: LayoutData{CSRFToken: "token"}}},
+		{"templates/login.html", "templates/navigation_logedout.html", ViewData{}},
+		{"templates/signup.html", "templates/navigation_logedout.html", ViewData{}},
+		{"templates/login_two_factor.html", "templates/navigation_logedout.html", ViewData{}},
+	}
+	for _, page := range pages {
+		tmpl, err := template.ParseFiles("templates/layout.html", page.content, page.navigation)
+		if err != nil {
+			t.Errorf("%s: %v", page.content, err)
+			continue
+		}
+		err = tmpl.ExecuteTemplate(ioutil.Discard, "layout", page.data)
+		if err != nil {
+			t.Errorf("%s: %v", page.content, err)
+		}
+	}
+}
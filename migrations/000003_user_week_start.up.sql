@@ -0,0 +1,2 @@
+ALTER TABLE users ADD COLUMN IF NOT EXISTS week_start smallint NOT NULL DEFAULT 1
+    CHECK (week_start BETWEEN 0 AND 6);
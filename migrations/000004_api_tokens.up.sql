@@ -0,0 +1,12 @@
+CREATE TABLE IF NOT EXISTS api_tokens(
+    id serial PRIMARY KEY,
+    user_id integer NOT NULL
+        REFERENCES users(id)
+        ON DELETE CASCADE
+        ON UPDATE CASCADE,
+    name varchar(64) NOT NULL,
+    scope varchar(16) NOT NULL CHECK (scope IN ('read', 'write')),
+    token_hash bytea NOT NULL UNIQUE,
+    created timestamp with time zone NOT NULL,
+    last_used timestamp with time zone
+);
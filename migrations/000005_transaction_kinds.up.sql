@@ -0,0 +1,2 @@
+ALTER TABLE transactions ADD COLUMN IF NOT EXISTS kind varchar(16) NOT NULL DEFAULT 'expense'
+    CHECK (kind IN ('expense', 'income', 'transfer'));
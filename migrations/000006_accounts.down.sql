@@ -0,0 +1,5 @@
+ALTER TABLE transactions
+    DROP CONSTRAINT IF EXISTS transfer_has_target,
+    DROP COLUMN IF EXISTS to_account,
+    DROP COLUMN IF EXISTS account;
+DROP TABLE IF EXISTS accounts;
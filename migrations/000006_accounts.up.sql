@@ -0,0 +1,42 @@
+CREATE TABLE IF NOT EXISTS accounts(
+    id serial PRIMARY KEY,
+    user_id integer NOT NULL
+        REFERENCES users(id)
+        ON DELETE CASCADE
+        ON UPDATE CASCADE,
+    name varchar(64) NOT NULL,
+    currency char(3) NOT NULL DEFAULT 'RUB',
+    opening_balance real NOT NULL DEFAULT 0,
+    UNIQUE(name, user_id)
+);
+
+ALTER TABLE transactions
+    ADD COLUMN IF NOT EXISTS account integer
+        REFERENCES accounts(id)
+        ON DELETE RESTRICT
+        ON UPDATE CASCADE,
+    ADD COLUMN IF NOT EXISTS to_account integer
+        REFERENCES accounts(id)
+        ON DELETE RESTRICT
+        ON UPDATE CASCADE;
+
+-- Transfers recorded before accounts existed have no target, so only new rows are checked
+ALTER TABLE transactions
+    ADD CONSTRAINT transfer_has_target
+        CHECK ((kind = 'transfer') = (to_account IS NOT NULL)) NOT VALID;
+
+-- Transactions of deleted users lost their user_id and belong to nobody,
+-- there is no account to give them
+DELETE FROM transactions WHERE user_id IS NULL;
+
+-- Every existing user gets a wallet holding all the previous transactions
+INSERT INTO accounts(user_id, name)
+SELECT id, 'Основной' FROM users
+ON CONFLICT DO NOTHING;
+
+UPDATE transactions t SET account = a.id
+FROM accounts a
+WHERE a.user_id = t.user_id AND a.name = 'Основной' AND t.account IS NULL;
+
+-- Balances and reports join accounts, so no transaction may stay without one
+ALTER TABLE transactions ALTER COLUMN account SET NOT NULL;
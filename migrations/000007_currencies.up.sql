@@ -0,0 +1,19 @@
+ALTER TABLE users ADD COLUMN IF NOT EXISTS base_currency char(3) NOT NULL DEFAULT 'RUB';
+
+ALTER TABLE transactions ADD COLUMN IF NOT EXISTS currency char(3) NOT NULL DEFAULT 'RUB';
+
+UPDATE transactions t SET currency = a.currency
+FROM accounts a
+WHERE t.account = a.id;
+
+CREATE TABLE IF NOT EXISTS exchange_rates(
+    user_id integer NOT NULL
+        REFERENCES users(id)
+        ON DELETE CASCADE
+        ON UPDATE CASCADE,
+    "date" date NOT NULL,
+    currency char(3) NOT NULL,
+    base_currency char(3) NOT NULL,
+    rate double precision NOT NULL CHECK (rate > 0),
+    PRIMARY KEY(user_id, date, currency, base_currency)
+);
@@ -0,0 +1,2 @@
+ALTER TABLE accounts ALTER COLUMN opening_balance TYPE real;
+ALTER TABLE transactions ALTER COLUMN amount TYPE real;
@@ -0,0 +1,6 @@
+-- Amounts below a kopeck can not be represented anymore, they become the smallest positive amount
+ALTER TABLE transactions ALTER COLUMN amount TYPE numeric(14, 2)
+    USING GREATEST(ROUND(amount::numeric, 2), 0.01);
+
+ALTER TABLE accounts ALTER COLUMN opening_balance TYPE numeric(14, 2)
+    USING ROUND(opening_balance::numeric, 2);
@@ -0,0 +1,25 @@
+CREATE TABLE IF NOT EXISTS import_profiles(
+    id serial PRIMARY KEY,
+    user_id integer NOT NULL
+        REFERENCES users(id)
+        ON DELETE CASCADE
+        ON UPDATE CASCADE,
+    name varchar(64) NOT NULL,
+    delimiter varchar(8) NOT NULL DEFAULT ',',
+    has_header boolean NOT NULL DEFAULT true,
+    date_column smallint NOT NULL,
+    date_format varchar(32) NOT NULL,
+    amount_column smallint NOT NULL,
+    comment_column smallint NOT NULL DEFAULT -1,
+    category_column smallint NOT NULL DEFAULT -1,
+    positive_is_expense boolean NOT NULL DEFAULT false,
+    account integer
+        REFERENCES accounts(id)
+        ON DELETE SET NULL
+        ON UPDATE CASCADE,
+    default_category integer
+        REFERENCES categories(id)
+        ON DELETE SET NULL
+        ON UPDATE CASCADE,
+    UNIQUE(name, user_id)
+);
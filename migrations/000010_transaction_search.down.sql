@@ -0,0 +1,2 @@
+DROP INDEX IF EXISTS transactions_user_date;
+DROP INDEX IF EXISTS transactions_comment_search;
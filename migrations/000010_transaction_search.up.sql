@@ -0,0 +1,6 @@
+-- Comments are searched with Russian stemming, the expression must match the query
+CREATE INDEX IF NOT EXISTS transactions_comment_search ON transactions
+    USING GIN (to_tsvector('russian', COALESCE(comment, '')));
+
+-- Keyset pagination of the reports page
+CREATE INDEX IF NOT EXISTS transactions_user_date ON transactions(user_id, date, id);
@@ -0,0 +1,18 @@
+CREATE TABLE IF NOT EXISTS budgets(
+    id serial PRIMARY KEY,
+    user_id integer NOT NULL
+        REFERENCES users(id)
+        ON DELETE CASCADE
+        ON UPDATE CASCADE,
+    -- NULL is the overall budget of all the expenses
+    category integer
+        REFERENCES categories(id)
+        ON DELETE CASCADE
+        ON UPDATE CASCADE,
+    amount numeric(14, 2) NOT NULL CHECK (amount > 0),
+    rollover boolean NOT NULL DEFAULT false,
+    -- First month of the budget, unspent amounts are carried starting from it
+    since date NOT NULL
+);
+
+CREATE UNIQUE INDEX IF NOT EXISTS budgets_category ON budgets(user_id, COALESCE(category, 0));
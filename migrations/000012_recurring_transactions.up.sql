@@ -0,0 +1,46 @@
+CREATE TABLE IF NOT EXISTS recurring_transactions(
+    id serial PRIMARY KEY,
+    user_id integer NOT NULL
+        REFERENCES users(id)
+        ON DELETE CASCADE
+        ON UPDATE CASCADE,
+    kind varchar(16) NOT NULL CHECK (kind IN ('expense', 'income', 'transfer')),
+    account integer NOT NULL
+        REFERENCES accounts(id)
+        ON DELETE CASCADE
+        ON UPDATE CASCADE,
+    to_account integer
+        REFERENCES accounts(id)
+        ON DELETE CASCADE
+        ON UPDATE CASCADE,
+    category integer
+        REFERENCES categories(id)
+        ON DELETE SET NULL
+        ON UPDATE CASCADE,
+    amount numeric(14, 2) NOT NULL CHECK (amount > 0),
+    currency char(3) NOT NULL,
+    comment varchar(256),
+    frequency varchar(16) NOT NULL CHECK (frequency IN ('daily', 'weekly', 'monthly', 'yearly', 'cron')),
+    every smallint NOT NULL DEFAULT 1 CHECK (every > 0),
+    cron varchar(64) NOT NULL DEFAULT '',
+    starts date NOT NULL,
+    ends date,
+    -- All the occurrences up to this date are materialized or skipped
+    processed date,
+    CHECK ((kind = 'transfer') = (to_account IS NOT NULL))
+);
+
+-- Every occurrence is materialized at most once, even by several instances
+CREATE TABLE IF NOT EXISTS recurring_occurrences(
+    recurring_id integer NOT NULL
+        REFERENCES recurring_transactions(id)
+        ON DELETE CASCADE
+        ON UPDATE CASCADE,
+    "date" date NOT NULL,
+    status varchar(16) NOT NULL CHECK (status IN ('created', 'skipped')),
+    transaction_id integer
+        REFERENCES transactions(id)
+        ON DELETE SET NULL
+        ON UPDATE CASCADE,
+    PRIMARY KEY(recurring_id, date)
+);
@@ -0,0 +1,2 @@
+DROP INDEX IF EXISTS categories_parent;
+ALTER TABLE categories DROP COLUMN IF EXISTS parent;
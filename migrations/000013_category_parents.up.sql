@@ -0,0 +1,8 @@
+-- NULL is a top level category, subcategories of a deleted one become top level
+ALTER TABLE categories ADD COLUMN IF NOT EXISTS parent integer
+    REFERENCES categories(id)
+    ON DELETE SET NULL
+    ON UPDATE CASCADE
+    CHECK (parent <> id);
+
+CREATE INDEX IF NOT EXISTS categories_parent ON categories(parent);
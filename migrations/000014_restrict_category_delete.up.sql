@@ -0,0 +1,12 @@
+-- Categories are deleted only after their transactions are moved to another one
+ALTER TABLE transactions DROP CONSTRAINT IF EXISTS transactions_category_fkey;
+ALTER TABLE transactions ADD CONSTRAINT transactions_category_fkey FOREIGN KEY (category)
+    REFERENCES categories(id)
+    ON DELETE RESTRICT
+    ON UPDATE CASCADE;
+
+ALTER TABLE recurring_transactions DROP CONSTRAINT IF EXISTS recurring_transactions_category_fkey;
+ALTER TABLE recurring_transactions ADD CONSTRAINT recurring_transactions_category_fkey FOREIGN KEY (category)
+    REFERENCES categories(id)
+    ON DELETE RESTRICT
+    ON UPDATE CASCADE;
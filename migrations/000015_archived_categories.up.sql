@@ -0,0 +1,2 @@
+-- Archived categories are hidden from entry forms and stay in reports
+ALTER TABLE categories ADD COLUMN IF NOT EXISTS archived boolean NOT NULL DEFAULT false;
@@ -0,0 +1,24 @@
+CREATE TABLE IF NOT EXISTS tags(
+    id serial PRIMARY KEY,
+    user_id integer NOT NULL
+        REFERENCES users(id)
+        ON DELETE CASCADE
+        ON UPDATE CASCADE,
+    name varchar(64) NOT NULL,
+    UNIQUE(user_id, name)
+);
+
+CREATE TABLE IF NOT EXISTS transaction_tags(
+    transaction_id integer NOT NULL
+        REFERENCES transactions(id)
+        ON DELETE CASCADE
+        ON UPDATE CASCADE,
+    tag_id integer NOT NULL
+        REFERENCES tags(id)
+        ON DELETE CASCADE
+        ON UPDATE CASCADE,
+    PRIMARY KEY (transaction_id, tag_id)
+);
+
+-- Transactions of a tag are found by the tag for the filter and totals
+CREATE INDEX IF NOT EXISTS transaction_tags_tag ON transaction_tags(tag_id);
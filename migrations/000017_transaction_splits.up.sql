@@ -0,0 +1,16 @@
+CREATE TABLE IF NOT EXISTS transaction_splits(
+    id serial PRIMARY KEY,
+    transaction_id integer NOT NULL
+        REFERENCES transactions(id)
+        ON DELETE CASCADE
+        ON UPDATE CASCADE,
+    category integer NOT NULL
+        REFERENCES categories(id)
+        ON DELETE RESTRICT
+        ON UPDATE CASCADE,
+    amount numeric(14, 2) NOT NULL CHECK (amount > 0)
+);
+
+-- Lines are read by their transaction for every category aggregation
+CREATE INDEX IF NOT EXISTS transaction_splits_transaction ON transaction_splits(transaction_id);
+CREATE INDEX IF NOT EXISTS transaction_splits_category ON transaction_splits(category);
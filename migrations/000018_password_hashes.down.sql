@@ -0,0 +1,8 @@
+-- Users with argon2id hashes can not be converted back, they have to reset
+-- their passwords after the downgrade
+UPDATE users SET sha = ''::bytea, salt = '' WHERE sha IS NULL OR salt IS NULL;
+ALTER TABLE users ALTER COLUMN salt SET NOT NULL;
+ALTER TABLE users ALTER COLUMN sha SET NOT NULL;
+
+ALTER TABLE users DROP COLUMN IF EXISTS hash_version;
+ALTER TABLE users DROP COLUMN IF EXISTS password_hash;
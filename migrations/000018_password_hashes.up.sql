@@ -0,0 +1,7 @@
+-- Version 1 is sha256(password + salt) in sha and salt, version 2 is an
+-- encoded argon2id hash in password_hash. Legacy rows are rehashed on login.
+ALTER TABLE users ADD COLUMN IF NOT EXISTS password_hash varchar(256);
+ALTER TABLE users ADD COLUMN IF NOT EXISTS hash_version smallint NOT NULL DEFAULT 1;
+
+ALTER TABLE users ALTER COLUMN sha DROP NOT NULL;
+ALTER TABLE users ALTER COLUMN salt DROP NOT NULL;
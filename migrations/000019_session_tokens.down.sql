@@ -0,0 +1,8 @@
+DELETE FROM sessions;
+
+DROP INDEX IF EXISTS sessions_user;
+ALTER TABLE sessions DROP COLUMN IF EXISTS expires;
+ALTER TABLE sessions DROP COLUMN IF EXISTS token_hash;
+ALTER TABLE sessions DROP COLUMN IF EXISTS id;
+ALTER TABLE sessions ADD COLUMN IF NOT EXISTS token varchar(256) NOT NULL;
+ALTER TABLE sessions ADD PRIMARY KEY(user_id, token);
@@ -0,0 +1,11 @@
+-- Tokens were signed cookies of keys generated on every start, the sessions
+-- are invalid anyway and are dropped
+DELETE FROM sessions;
+
+ALTER TABLE sessions DROP CONSTRAINT IF EXISTS sessions_pkey;
+ALTER TABLE sessions DROP COLUMN IF EXISTS token;
+ALTER TABLE sessions ADD COLUMN IF NOT EXISTS id serial PRIMARY KEY;
+ALTER TABLE sessions ADD COLUMN IF NOT EXISTS token_hash bytea NOT NULL UNIQUE;
+ALTER TABLE sessions ADD COLUMN IF NOT EXISTS expires timestamp with time zone NOT NULL;
+
+CREATE INDEX IF NOT EXISTS sessions_user ON sessions(user_id);
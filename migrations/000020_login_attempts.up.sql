@@ -0,0 +1,18 @@
+CREATE TABLE IF NOT EXISTS login_attempts(
+    id serial PRIMARY KEY,
+    attempted timestamp with time zone NOT NULL DEFAULT NOW(),
+    email varchar(256) NOT NULL,
+    -- Set when the email belongs to a user, so the user sees failed attempts
+    user_id integer
+        REFERENCES users(id)
+        ON DELETE CASCADE
+        ON UPDATE CASCADE,
+    ip varchar(128) NOT NULL,
+    user_agent varchar(256),
+    succeeded boolean NOT NULL
+);
+
+-- Recent attempts are counted by email and by address before every login
+CREATE INDEX IF NOT EXISTS login_attempts_email ON login_attempts(email, attempted);
+CREATE INDEX IF NOT EXISTS login_attempts_ip ON login_attempts(ip, attempted);
+CREATE INDEX IF NOT EXISTS login_attempts_user ON login_attempts(user_id, attempted);
@@ -0,0 +1,19 @@
+-- The secret is set when the setup starts and the second factor is required
+-- only after the first code is confirmed. Codes of steps up to totp_last_step
+-- were used already and are not accepted again.
+ALTER TABLE users ADD COLUMN IF NOT EXISTS totp_secret varchar(64);
+ALTER TABLE users ADD COLUMN IF NOT EXISTS totp_enabled boolean NOT NULL DEFAULT false;
+ALTER TABLE users ADD COLUMN IF NOT EXISTS totp_last_step bigint NOT NULL DEFAULT 0;
+
+CREATE TABLE IF NOT EXISTS recovery_codes(
+    id serial PRIMARY KEY,
+    user_id integer NOT NULL
+        REFERENCES users(id)
+        ON DELETE CASCADE
+        ON UPDATE CASCADE,
+    -- Only sha256 of a code is stored, a code is shown once when it is made
+    code_hash bytea NOT NULL,
+    used timestamp with time zone
+);
+
+CREATE INDEX IF NOT EXISTS recovery_codes_user ON recovery_codes(user_id);
@@ -0,0 +1,7 @@
+ALTER TABLE transactions
+    DROP CONSTRAINT IF EXISTS only_transfer_has_target,
+    DROP CONSTRAINT IF EXISTS transfer_has_target,
+    ADD CONSTRAINT transfer_has_target
+        CHECK ((kind = 'transfer') = (to_account IS NOT NULL)) NOT VALID;
+
+ALTER TABLE transactions DROP COLUMN IF EXISTS legacy_transfer;
@@ -0,0 +1,13 @@
+-- Transfers recorded before accounts existed have no target. They are marked,
+-- so the check holds for every row and restored backups may bring them back.
+ALTER TABLE transactions ADD COLUMN IF NOT EXISTS legacy_transfer boolean NOT NULL DEFAULT false;
+
+UPDATE transactions SET legacy_transfer = true
+WHERE kind = 'transfer' AND to_account IS NULL;
+
+ALTER TABLE transactions
+    DROP CONSTRAINT IF EXISTS transfer_has_target,
+    ADD CONSTRAINT transfer_has_target
+        CHECK (kind <> 'transfer' OR to_account IS NOT NULL OR legacy_transfer),
+    ADD CONSTRAINT only_transfer_has_target
+        CHECK (kind = 'transfer' OR to_account IS NULL);
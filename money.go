@@ -0,0 +1,188 @@
+package main
+
+import (
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// Money - amount in minor units (kopecks, cents), stored as numeric(14, 2)
+type Money int64
+
+const minorUnitsInMajor = 100
+
+var errInvalidMoney = errors.New("invalid money amount")
+
+// ParseMoney accepts amounts typed by people: "1 234,56", "1234.56",
+// "1,234.56" and "-10". The last separator followed by one or two digits is
+// the decimal one, the other separators have to split thousands.
+func ParseMoney(value string) (Money, error) {
+	value = strings.Map(func(r rune) rune {
+		switch r {
+		case ' ', '\u00a0', '\u202f', '\'':
+			return -1
+		}
+		return r
+	}, strings.TrimSpace(value))
+
+	negative := strings.HasPrefix(value, "-")
+	if negative || strings.HasPrefix(value, "+") {
+		value = value[1:]
+	}
+	if value == "" {
+		return 0, errInvalidMoney
+	}
+
+	integer, fraction := value, ""
+	var decimal byte
+	if i := strings.LastIndexAny(value, ",."); i >= 0 && len(value)-i-1 <= 2 {
+		integer, fraction, decimal = value[:i], value[i+1:], value[i]
+		if fraction == "" {
+			return 0, errInvalidMoney
+		}
+	}
+	integer, ok := ungroupDigits(integer, decimal)
+	if !ok {
+		return 0, errInvalidMoney
+	}
+	if integer == "" {
+		integer = "0"
+	}
+	for len(fraction) < 2 {
+		fraction += "0"
+	}
+
+	for _, part := range []string{integer, fraction} {
+		for _, r := range part {
+			if r < '0' || r > '9' {
+				return 0, errInvalidMoney
+			}
+		}
+	}
+	major, err := strconv.ParseInt(integer, 10, 64)
+	if err != nil || major > math.MaxInt64/minorUnitsInMajor-1 {
+		return 0, errInvalidMoney
+	}
+	minor, _ := strconv.ParseInt(fraction, 10, 64)
+
+	amount := Money(major*minorUnitsInMajor + minor)
+	if negative {
+		amount = -amount
+	}
+	return amount, nil
+}
+
+// ungroupDigits removes separators of thousands from the integer part, all of
+// them have to be the same character other than the decimal one and split
+// the digits into groups of three
+func ungroupDigits(integer string, decimal byte) (string, bool) {
+	i := strings.IndexAny(integer, ",.")
+	if i < 0 {
+		return integer, true
+	}
+	separator := integer[i]
+	if separator == decimal {
+		return "", false
+	}
+	groups := strings.Split(integer, string(separator))
+	if len(groups[0]) == 0 || len(groups[0]) > 3 {
+		return "", false
+	}
+	for _, group := range groups[1:] {
+		if len(group) != 3 {
+			return "", false
+		}
+	}
+	return strings.Join(groups, ""), true
+}
+
+// String formats the amount with exactly two decimals, so it can be parsed back
+func (m Money) String() string {
+	sign := ""
+	value := int64(m)
+	if value < 0 {
+		sign = "-"
+		value = -value
+	}
+	return fmt.Sprintf("%s%d.%02d", sign, value/minorUnitsInMajor, value%minorUnitsInMajor)
+}
+
+// IsNegative is used by templates to highlight losses
+func (m Money) IsNegative() bool {
+	return m < 0
+}
+
+// IsPositive reports whether the amount can be used for a transaction
+func (m Money) IsPositive() bool {
+	return m > 0
+}
+
+// Value implements driver.Valuer, numeric columns accept the decimal string
+func (m Money) Value() (driver.Value, error) {
+	return m.String(), nil
+}
+
+// Scan implements sql.Scanner for numeric columns and aggregates
+func (m *Money) Scan(src interface{}) error {
+	switch value := src.(type) {
+	case nil:
+		*m = 0
+	case []byte:
+		return m.scanString(string(value))
+	case string:
+		return m.scanString(value)
+	case int64:
+		*m = Money(value * minorUnitsInMajor)
+	case float64:
+		*m = Money(math.Round(value * minorUnitsInMajor))
+	default:
+		return fmt.Errorf("cannot scan %T into Money", src)
+	}
+	return nil
+}
+
+func (m *Money) scanString(value string) error {
+	// Postgres may return more decimals for computed values, they are rounded
+	if i := strings.IndexByte(value, '.'); i >= 0 && len(value)-i-1 > 2 {
+		parsed, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			return err
+		}
+		*m = Money(math.Round(parsed * minorUnitsInMajor))
+		return nil
+	}
+	parsed, err := ParseMoney(value)
+	if err != nil {
+		return fmt.Errorf("cannot scan %q into Money", value)
+	}
+	*m = parsed
+	return nil
+}
+
+// MarshalJSON writes the amount as a JSON number with two decimals
+func (m Money) MarshalJSON() ([]byte, error) {
+	return []byte(m.String()), nil
+}
+
+// UnmarshalJSON accepts both JSON numbers and strings
+func (m *Money) UnmarshalJSON(data []byte) error {
+	value := string(data)
+	if value == "null" {
+		return nil
+	}
+	if strings.HasPrefix(value, `"`) {
+		value = strings.Trim(value, `"`)
+	} else if i := strings.IndexByte(value, '.'); strings.ContainsAny(value, "eE,") || (i >= 0 && len(value)-i-1 > 2) {
+		// JSON numbers are never written with thousands separators
+		return errInvalidMoney
+	}
+	parsed, err := ParseMoney(value)
+	if err != nil {
+		return err
+	}
+	*m = parsed
+	return nil
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestParseMoney(t *testing.T) {
+	cases := map[string]Money{
+		"0.1":          10,
+		"0,2":          20,
+		"1234.56":      123456,
+		"1 234,56":     123456,
+		"1\u00a0234,5": 123450,
+		"1,234.56":     123456,
+		"1.234.567,89": 123456789,
+		"1,234":        123400,
+		"1.234.567":    123456700,
+		"12,345,678.9": 1234567890,
+		"-10":          -1000,
+		"+7":           700,
+		".5":           50,
+	}
+	for input, expected := range cases {
+		amount, err := ParseMoney(input)
+		if err != nil {
+			t.Errorf("%q: %v", input, err)
+			continue
+		}
+		if amount != expected {
+			t.Errorf("%q parsed as %v, expected %v", input, amount, expected)
+		}
+	}
+
+	for _, input := range []string{"", "-", "abc", "10.", "1.2.3a", "12e3", "99999999999999999999",
+		"1.2.3", "10,5.25", "1,234,56", "1.234.56", "1,23.45", "1234,567.8", ",123.45", "1,234.567"} {
+		if amount, err := ParseMoney(input); err == nil {
+			t.Errorf("%q is accepted as %v", input, amount)
+		}
+	}
+}
+
+func TestMoneySum(t *testing.T) {
+	var total Money
+	for _, input := range []string{"0.1", "0.2"} {
+		amount, _ := ParseMoney(input)
+		total += amount
+	}
+	if total.String() != "0.30" {
+		t.Errorf("0.1 + 0.2 = %v", total)
+	}
+	if (-total).String() != "-0.30" {
+		t.Errorf("negative amount is formatted as %v", -total)
+	}
+}
+
+func TestMoneyScan(t *testing.T) {
+	cases := []struct {
+		src      interface{}
+		expected Money
+	}{
+		{[]byte("12345678901.23"), 1234567890123},
+		{[]byte("0.005000"), 1},
+		{"-3.10", -310},
+		{int64(5), 500},
+		{nil, 0},
+	}
+	for _, c := range cases {
+		var m Money
+		err := m.Scan(c.src)
+		if err != nil {
+			t.Errorf("%v: %v", c.src, err)
+			continue
+		}
+		if m != c.expected {
+			t.Errorf("%v scanned as %v, expected %v", c.src, m, c.expected)
+		}
+	}
+}
+
+func TestMoneyJSON(t *testing.T) {
+	var value struct {
+		Amount Money `json:"amount"`
+	}
+	for input, expected := range map[string]Money{
+		`{"amount": 12.5}`:       1250,
+		`{"amount": "1 000,01"}`: 100001,
+		`{"amount": 3}`:          300,
+	} {
+		err := json.Unmarshal([]byte(input), &value)
+		if err != nil || value.Amount != expected {
+			t.Errorf("%s decoded as %v (%v)", input, value.Amount, err)
+		}
+	}
+	if err := json.Unmarshal([]byte(`{"amount": 12.345}`), &value); err == nil {
+		t.Error("three decimals are accepted")
+	}
+
+	encoded, _ := json.Marshal(struct {
+		Amount Money `json:"amount"`
+	}{1250})
+	if string(encoded) != `{"amount":12.50}` {
+		t.Errorf("encoded as %s", encoded)
+	}
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+
+	"golang.org/x/crypto/argon2"
+)
+
+// Versions of the hash_version column of users
+const (
+	hashVersionSHA256   = 1
+	hashVersionArgon2id = 2
+)
+
+var errInvalidPasswordHash = errors.New("invalid password hash")
+
+// Argon2Parameters - cost of argon2id, the parameters are encoded into every
+// hash, so they can be raised without breaking stored hashes
+type Argon2Parameters struct {
+	Memory     uint32
+	Iterations uint32
+	Threads    uint8
+	SaltLength int
+	KeyLength  uint32
+}
+
+// Parameters of new hashes, RFC 9106 recommends them for memory constrained
+// servers
+var argon2Parameters = Argon2Parameters{
+	Memory:     64 * 1024,
+	Iterations: 3,
+	Threads:    4,
+	SaltLength: 16,
+	KeyLength:  32,
+}
+
+// hashPassword returns the argon2id hash of the password with a random salt
+// in the PHC string format: $argon2id$v=19$m=65536,t=3,p=4$salt$key
+func hashPassword(password string) (string, error) {
+	salt := make([]byte, argon2Parameters.SaltLength)
+	_, err := rand.Read(salt)
+	if err != nil {
+		return "", err
+	}
+	return encodeArgon2Hash(argon2Parameters, salt, deriveArgon2Key(password, salt, argon2Parameters)), nil
+}
+
+func deriveArgon2Key(password string, salt []byte, p Argon2Parameters) []byte {
+	return argon2.IDKey([]byte(password), salt, p.Iterations, p.Memory, p.Threads, p.KeyLength)
+}
+
+func encodeArgon2Hash(p Argon2Parameters, salt []byte, key []byte) string {
+	return fmt.Sprintf(
+		"$argon2id$v=%d$m=%d,t=%d,p=%d$%s$%s",
+		argon2.Version, p.Memory, p.Iterations, p.Threads,
+		base64.RawStdEncoding.EncodeToString(salt), base64.RawStdEncoding.EncodeToString(key),
+	)
+}
+
+func decodeArgon2Hash(encoded string) (p Argon2Parameters, salt []byte, key []byte, err error) {
+	parts := strings.Split(encoded, "$")
+	if len(parts) != 6 || parts[0] != "" || parts[1] != "argon2id" {
+		return p, nil, nil, errInvalidPasswordHash
+	}
+	var version int
+	_, err = fmt.Sscanf(parts[2], "v=%d", &version)
+	if err != nil || version != argon2.Version {
+		return p, nil, nil, errInvalidPasswordHash
+	}
+	_, err = fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &p.Memory, &p.Iterations, &p.Threads)
+	if err != nil || p.Memory == 0 || p.Iterations == 0 || p.Threads == 0 {
+		return p, nil, nil, errInvalidPasswordHash
+	}
+	salt, err = base64.RawStdEncoding.DecodeString(parts[4])
+	if err != nil {
+		return p, nil, nil, errInvalidPasswordHash
+	}
+	key, err = base64.RawStdEncoding.DecodeString(parts[5])
+	if err != nil || len(key) == 0 {
+		return p, nil, nil, errInvalidPasswordHash
+	}
+	p.SaltLength = len(salt)
+	p.KeyLength = uint32(len(key))
+	return p, salt, key, nil
+}
+
+// passwordMatches checks the password against the stored hash of the user,
+// legacy sha256 hashes are still accepted until they are upgraded
+func passwordMatches(dbUser User, password string) bool {
+	switch dbUser.HashVersion {
+	case hashVersionSHA256:
+		sha := sha256.Sum256([]byte(password + dbUser.Salt))
+		return len(dbUser.Sha) > 0 && subtle.ConstantTimeCompare(sha[:], dbUser.Sha) == 1
+	case hashVersionArgon2id:
+		p, salt, key, err := decodeArgon2Hash(dbUser.PasswordHash)
+		if err != nil {
+			return false
+		}
+		return subtle.ConstantTimeCompare(deriveArgon2Key(password, salt, p), key) == 1
+	}
+	return false
+}
+
+// needsRehash reports whether the hash of the user is a legacy one or was
+// made with other parameters than new hashes
+func needsRehash(dbUser User) bool {
+	if dbUser.HashVersion != hashVersionArgon2id {
+		return true
+	}
+	p, _, _, err := decodeArgon2Hash(dbUser.PasswordHash)
+	return err != nil || p != argon2Parameters
+}
+
+// setUserPassword stores the argon2id hash of the password and removes the
+// legacy hash
+func setUserPassword(userID int, password string) error {
+	hash, err := hashPassword(password)
+	if err != nil {
+		return err
+	}
+	_, err = database.Exec(
+		"UPDATE users SET password_hash = $1, hash_version = $2, sha = NULL, salt = NULL WHERE id = $3",
+		hash, hashVersionArgon2id, userID,
+	)
+	return err
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"crypto/sha256"
+	"strings"
+	"testing"
+)
+
+func TestHashPassword(t *testing.T) {
+	hash, err := hashPassword("секрет")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(hash, "$argon2id$v=19$m=65536,t=3,p=4$") {
+		t.Errorf("unexpected hash %s", hash)
+	}
+	other, _ := hashPassword("секрет")
+	if other == hash {
+		t.Errorf("hashes of the same password are equal")
+	}
+
+	user := User{HashVersion: hashVersionArgon2id, PasswordHash: hash}
+	if !passwordMatches(user, "секрет") || passwordMatches(user, "Секрет") {
+		t.Errorf("password is not checked")
+	}
+	if needsRehash(user) {
+		t.Errorf("current hash needs rehash")
+	}
+
+	// Hashes with older parameters are still checked, but upgraded
+	p := argon2Parameters
+	p.Iterations = 1
+	salt := []byte("0123456789abcdef")
+	weaker := User{HashVersion: hashVersionArgon2id, PasswordHash: encodeArgon2Hash(p, salt, deriveArgon2Key("секрет", salt, p))}
+	if !passwordMatches(weaker, "секрет") || !needsRehash(weaker) {
+		t.Errorf("hash with older parameters is not upgraded")
+	}
+}
+
+func TestLegacyPassword(t *testing.T) {
+	sha := sha256.Sum256([]byte("секрет" + "aB3dE"))
+	user := User{HashVersion: hashVersionSHA256, Sha: sha[:], Salt: "aB3dE"}
+	if !passwordMatches(user, "секрет") || passwordMatches(user, "другой") {
+		t.Errorf("legacy password is not checked")
+	}
+	if !needsRehash(user) {
+		t.Errorf("legacy hash is not upgraded")
+	}
+	if passwordMatches(User{HashVersion: hashVersionSHA256}, "") {
+		t.Errorf("empty legacy hash matches")
+	}
+}
+
+func TestDecodeArgon2Hash(t *testing.T) {
+	for _, encoded := range []string{
+		"",
+		"$argon2i$v=19$m=65536,t=3,p=4$c2FsdA$a2V5",
+		"$argon2id$v=16$m=65536,t=3,p=4$c2FsdA$a2V5",
+		"$argon2id$v=19$m=0,t=3,p=4$c2FsdA$a2V5",
+		"$argon2id$v=19$m=65536,t=3,p=4$c2FsdA$",
+		"$argon2id$v=19$m=65536,t=3,p=4$!!$a2V5",
+	} {
+		if _, _, _, err := decodeArgon2Hash(encoded); err == nil {
+			t.Errorf("%q is decoded", encoded)
+		}
+		if passwordMatches(User{HashVersion: hashVersionArgon2id, PasswordHash: encoded}, "") {
+			t.Errorf("%q matches", encoded)
+		}
+	}
+}
@@ -0,0 +1,288 @@
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"fmt"
+	"html/template"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// ExchangeRate - element of corresponding table, one unit of Currency costs
+// Rate units of BaseCurrency starting from Date
+type ExchangeRate struct {
+	Date         time.Time
+	Currency     string
+	BaseCurrency string
+	Rate         float64
+}
+
+// RatesViewData - information to display on page
+type RatesViewData struct {
+	LayoutData
+	Title              string
+	Rates              []ExchangeRate
+	BaseCurrency       string
+	ErrorDescription   string
+	SuccessDescription string
+}
+
+// convertedAmountSQL returns the expression converting t.amount into the
+// currency given by the SQL expression target. The latest rate known on the
+// transaction date is used, either direct or inverse one. When no rate is
+// known the result is NULL: sums leave the transaction out and pages warn
+// about it with countUnconvertedTransactions.
+func convertedAmountSQL(target string) string {
+	return `ROUND(t.amount * COALESCE(
+		CASE WHEN t.currency = ` + target + ` THEN 1 END,
+		(
+			SELECT CASE WHEN r.currency = t.currency THEN r.rate ELSE 1 / r.rate END
+			FROM exchange_rates r
+			WHERE r.user_id = t.user_id AND r.date <= t.date AND (
+				(r.currency = t.currency AND r.base_currency = ` + target + `) OR
+				(r.currency = ` + target + ` AND r.base_currency = t.currency)
+			)
+			ORDER BY r.date DESC LIMIT 1
+		)::numeric
+	), 2)`
+}
+
+// countUnconvertedTransactions returns the number of transactions of the user
+// between the dates without a rate to the base currency, they are missing
+// from totals
+func countUnconvertedTransactions(db *sqlx.DB, userID int, from time.Time, to time.Time) (count int, err error) {
+	err = db.QueryRowx(`
+	SELECT COUNT(*)
+	FROM transactions t
+	JOIN users u
+	ON t.user_id = u.id
+	WHERE t.user_id = $1 AND t.date >= $2::date AND t.date <= $3::date
+		AND `+convertedAmountSQL("u.base_currency")+` IS NULL
+	`, userID, from.Format(dateLayout), to.Format(dateLayout)).Scan(&count)
+	return count, err
+}
+
+func getUserBaseCurrency(db *sqlx.DB, userID int) (baseCurrency string, err error) {
+	err = db.QueryRowx("SELECT base_currency FROM users WHERE id = $1", userID).Scan(&baseCurrency)
+	if err != nil {
+		return defaultCurrency, err
+	}
+	return baseCurrency, nil
+}
+
+// parseCurrency normalizes the currency code, the fallback is used for empty values
+func parseCurrency(value string, fallback string) (currency string, ok bool) {
+	currency = strings.ToUpper(strings.TrimSpace(value))
+	if currency == "" {
+		currency = fallback
+	}
+	return currency, currencyCodePattern.MatchString(currency)
+}
+
+// parseExchangeRatesCSV reads rows "date,currency,base currency,rate", the
+// header row and ";" delimited files exported by spreadsheets are accepted
+func parseExchangeRatesCSV(input io.Reader) (rates []ExchangeRate, err error) {
+	content, err := ioutil.ReadAll(input)
+	if err != nil {
+		return nil, err
+	}
+	reader := csv.NewReader(bytes.NewReader(content))
+	reader.FieldsPerRecord = 4
+	reader.TrimLeadingSpace = true
+	firstLine := content
+	if end := bytes.IndexByte(content, '\n'); end >= 0 {
+		firstLine = content[:end]
+	}
+	if bytes.IndexByte(firstLine, ';') >= 0 {
+		reader.Comma = ';'
+	}
+	records, err := reader.ReadAll()
+	if err != nil {
+		return nil, err
+	}
+
+	rates = []ExchangeRate{}
+	for i, record := range records {
+		date, err := time.Parse(dateLayout, record[0])
+		if err != nil {
+			if i == 0 {
+				// header
+				continue
+			}
+			return nil, fmt.Errorf("line %d: %v", i+1, err)
+		}
+		currency, ok := parseCurrency(record[1], "")
+		if !ok {
+			return nil, fmt.Errorf("line %d: invalid currency %q", i+1, record[1])
+		}
+		baseCurrency, ok := parseCurrency(record[2], "")
+		if !ok || baseCurrency == currency {
+			return nil, fmt.Errorf("line %d: invalid base currency %q", i+1, record[2])
+		}
+		rate, err := strconv.ParseFloat(strings.Replace(record[3], ",", ".", 1), 64)
+		if err != nil || rate <= 0 {
+			return nil, fmt.Errorf("line %d: invalid rate %q", i+1, record[3])
+		}
+		rates = append(rates, ExchangeRate{date, currency, baseCurrency, rate})
+	}
+	return rates, nil
+}
+
+func ratesView(w http.ResponseWriter, r *http.Request, userID int) {
+	rates := []ExchangeRate{}
+	err := database.Select(
+		&rates,
+		"SELECT date, currency, base_currency AS basecurrency, rate FROM exchange_rates WHERE user_id = $1 ORDER BY date DESC, currency",
+		userID,
+	)
+	if err != nil {
+		log.Println("Query exchange rates failed", err)
+	}
+	baseCurrency, err := getUserBaseCurrency(database, userID)
+	if err != nil {
+		log.Println(err)
+	}
+
+	data := RatesViewData{
+		Title:              "Курсы валют",
+		Rates:              rates,
+		BaseCurrency:       baseCurrency,
+		ErrorDescription:   allErrors[getErrorCode(r)],
+		SuccessDescription: allNotifications[getSuccessCode(r)],
+	}
+	tmpl, err := template.ParseFiles("templates/layout.html", "templates/rates.html", "templates/navigation_logedin.html")
+	if err != nil {
+		log.Println(err)
+	}
+	renderLayout(w, r, tmpl, &data)
+}
+
+// saveExchangeRates stores all the rates or none of them, known rates are replaced
+func saveExchangeRates(userID int, rates []ExchangeRate) error {
+	tx, err := database.Beginx()
+	if err != nil {
+		return err
+	}
+	for _, rate := range rates {
+		_, err = tx.Exec(`
+		INSERT INTO exchange_rates(user_id, date, currency, base_currency, rate) VALUES ($1, $2, $3, $4, $5)
+		ON CONFLICT (user_id, date, currency, base_currency) DO UPDATE SET rate = EXCLUDED.rate
+		`,
+			userID, rate.Date.Format(dateLayout), rate.Currency, rate.BaseCurrency, rate.Rate,
+		)
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+func addExchangeRate(w http.ResponseWriter, r *http.Request, userID int) {
+	err := r.ParseForm()
+	if err != nil {
+		log.Println(err)
+		http.Redirect(w, r, "/rates?error=3", 302)
+		return
+	}
+	date, err := time.Parse(dateLayout, r.FormValue("date"))
+	if err != nil {
+		log.Println(err)
+		http.Redirect(w, r, "/rates?error=14", 302)
+		return
+	}
+	currency, ok := parseCurrency(r.FormValue("currency"), "")
+	baseCurrency, baseOK := parseCurrency(r.FormValue("base-currency"), "")
+	if !ok || !baseOK || currency == baseCurrency {
+		http.Redirect(w, r, "/rates?error=20", 302)
+		return
+	}
+	rate, err := strconv.ParseFloat(strings.Replace(r.FormValue("rate"), ",", ".", 1), 64)
+	if err != nil || rate <= 0 {
+		log.Println("Invalid rate", r.FormValue("rate"))
+		http.Redirect(w, r, "/rates?error=23", 302)
+		return
+	}
+
+	err = saveExchangeRates(userID, []ExchangeRate{{date, currency, baseCurrency, rate}})
+	if err != nil {
+		log.Println(err)
+		http.Redirect(w, r, "/rates?error=6", 302)
+		return
+	}
+	http.Redirect(w, r, "/rates", 302)
+}
+
+func importExchangeRates(w http.ResponseWriter, r *http.Request, userID int) {
+	file, _, err := r.FormFile("rates-file")
+	if err != nil {
+		log.Println(err)
+		http.Redirect(w, r, "/rates?error=3", 302)
+		return
+	}
+	defer file.Close()
+
+	rates, err := parseExchangeRatesCSV(io.LimitReader(file, 10<<20))
+	if err != nil {
+		log.Println("Parsing exchange rates failed", err)
+		http.Redirect(w, r, "/rates?error=24", 302)
+		return
+	}
+
+	err = saveExchangeRates(userID, rates)
+	if err != nil {
+		log.Println(err)
+		http.Redirect(w, r, "/rates?error=6", 302)
+		return
+	}
+	log.Println("Imported exchange rates", len(rates))
+	http.Redirect(w, r, "/rates?success=4", 302)
+}
+
+func deleteExchangeRate(w http.ResponseWriter, r *http.Request, userID int) {
+	err := r.ParseForm()
+	if err != nil {
+		log.Println(err)
+	}
+	_, err = database.Exec(
+		"DELETE FROM exchange_rates WHERE user_id = $1 AND date = $2 AND currency = $3 AND base_currency = $4",
+		userID, r.FormValue("date"), r.FormValue("currency"), r.FormValue("base-currency"),
+	)
+	if err != nil {
+		log.Println(err)
+	}
+	http.Redirect(w, r, "/rates", 302)
+}
+
+func changeBaseCurrency(w http.ResponseWriter, r *http.Request, userID int) {
+	err := r.ParseForm()
+	if err != nil {
+		log.Println("Form parse failed", err)
+		http.Redirect(w, r, "/settings?error=9", 302)
+		return
+	}
+	baseCurrency, ok := parseCurrency(r.FormValue("base-currency"), defaultCurrency)
+	if !ok {
+		http.Redirect(w, r, "/settings?error=20", 302)
+		return
+	}
+
+	_, err = database.Exec(
+		"UPDATE users SET base_currency = $1 WHERE id = $2",
+		baseCurrency, userID,
+	)
+	if err != nil {
+		log.Println("Updating failed", err)
+		http.Redirect(w, r, "/settings?error=9", 302)
+		return
+	}
+	http.Redirect(w, r, "/settings?success=2", 302)
+}
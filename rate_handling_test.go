@@ -0,0 +1,46 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseExchangeRatesCSV(t *testing.T) {
+	rates, err := parseExchangeRatesCSV(strings.NewReader("date,currency,base,rate\n2026-03-01,usd,RUB,92.5\n2026-03-02, EUR, RUB, 100\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []ExchangeRate{
+		{time.Date(2026, time.March, 1, 0, 0, 0, 0, time.UTC), "USD", "RUB", 92.5},
+		{time.Date(2026, time.March, 2, 0, 0, 0, 0, time.UTC), "EUR", "RUB", 100},
+	}
+	if len(rates) != len(expected) {
+		t.Fatalf("got %d rates, expected %d", len(rates), len(expected))
+	}
+	for i := range rates {
+		if rates[i] != expected[i] {
+			t.Errorf("got %+v, expected %+v", rates[i], expected[i])
+		}
+	}
+
+	rates, err = parseExchangeRatesCSV(strings.NewReader("2026-03-01;USD;RUB;92,5\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rates) != 1 || rates[0].Rate != 92.5 {
+		t.Errorf("semicolon delimited file parsed as %+v", rates)
+	}
+
+	for _, input := range []string{
+		"2026-03-01,USD,USD,1\n",
+		"2026-03-01,USD,RUB,-1\n",
+		"2026-03-01,US,RUB,1\n",
+		"2026-03-01,USD,RUB,1\nyesterday,USD,RUB,1\n",
+	} {
+		_, err = parseExchangeRatesCSV(strings.NewReader(input))
+		if err == nil {
+			t.Errorf("%q is accepted", input)
+		}
+	}
+}
@@ -0,0 +1,240 @@
+package main
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Frequencies of recurring transactions
+const (
+	frequencyDaily   = "daily"
+	frequencyWeekly  = "weekly"
+	frequencyMonthly = "monthly"
+	frequencyYearly  = "yearly"
+	frequencyCron    = "cron"
+)
+
+var errInvalidCron = errors.New("invalid cron expression")
+
+// RecurrenceRule - schedule of a recurring transaction. Every Interval days,
+// weeks, months or years starting from Starts, or days matching Cron. Ends is
+// the last possible date, zero for endless ones.
+type RecurrenceRule struct {
+	Frequency string
+	Interval  int
+	Cron      string
+	Starts    time.Time
+	Ends      time.Time
+}
+
+// CronSchedule - days matching a cron-like expression. Transactions have no
+// time, so only "day-of-month month day-of-week" fields are used, minute and
+// hour fields of the classic five field form are ignored.
+type CronSchedule struct {
+	days      [32]bool
+	months    [13]bool
+	weekdays  [7]bool
+	matchBoth bool
+}
+
+func isValidFrequency(frequency string) bool {
+	switch frequency {
+	case frequencyDaily, frequencyWeekly, frequencyMonthly, frequencyYearly, frequencyCron:
+		return true
+	}
+	return false
+}
+
+// parseCronField fills the allowed values of one field: "*", "5", "1-5",
+// "1,15", "*/2" and "1-10/3" are accepted
+func parseCronField(field string, min int, max int, allowed []bool) (any bool, err error) {
+	for _, part := range strings.Split(field, ",") {
+		step := 1
+		if i := strings.IndexByte(part, '/'); i >= 0 {
+			step, err = strconv.Atoi(part[i+1:])
+			if err != nil || step < 1 {
+				return false, errInvalidCron
+			}
+			part = part[:i]
+		}
+		from, to := min, max
+		switch {
+		case part == "*":
+			any = any || step == 1
+		case strings.Contains(part, "-"):
+			bounds := strings.SplitN(part, "-", 2)
+			from, err = strconv.Atoi(bounds[0])
+			if err != nil {
+				return false, errInvalidCron
+			}
+			to, err = strconv.Atoi(bounds[1])
+			if err != nil {
+				return false, errInvalidCron
+			}
+		default:
+			from, err = strconv.Atoi(part)
+			if err != nil {
+				return false, errInvalidCron
+			}
+			to = from
+			if step > 1 {
+				to = max
+			}
+		}
+		if from < min || to > max || from > to {
+			return false, errInvalidCron
+		}
+		for value := from; value <= to; value += step {
+			allowed[value] = true
+		}
+	}
+	return any, nil
+}
+
+// ParseCron reads "day-of-month month day-of-week" or the classic five
+// field expression. Sunday is 0 or 7.
+func ParseCron(expression string) (schedule CronSchedule, err error) {
+	fields := strings.Fields(expression)
+	if len(fields) == 5 {
+		fields = fields[2:]
+	}
+	if len(fields) != 3 {
+		return schedule, errInvalidCron
+	}
+	anyDay, err := parseCronField(fields[0], 1, 31, schedule.days[:])
+	if err != nil {
+		return schedule, err
+	}
+	_, err = parseCronField(fields[1], 1, 12, schedule.months[:])
+	if err != nil {
+		return schedule, err
+	}
+	var weekdays [8]bool
+	anyWeekday, err := parseCronField(fields[2], 0, 7, weekdays[:])
+	if err != nil {
+		return schedule, err
+	}
+	copy(schedule.weekdays[:], weekdays[:7])
+	schedule.weekdays[0] = schedule.weekdays[0] || weekdays[7]
+	// As in cron, restricted day of month and day of week match either of them
+	schedule.matchBoth = anyDay || anyWeekday
+	return schedule, nil
+}
+
+// Matches reports whether the day is in the schedule
+func (s CronSchedule) Matches(date time.Time) bool {
+	if !s.months[date.Month()] {
+		return false
+	}
+	day, weekday := s.days[date.Day()], s.weekdays[date.Weekday()]
+	if s.matchBoth {
+		return day && weekday
+	}
+	return day || weekday
+}
+
+// Validate checks the rule before it is saved
+func (r RecurrenceRule) Validate() error {
+	if !isValidFrequency(r.Frequency) {
+		return errors.New("invalid frequency")
+	}
+	if r.Starts.IsZero() || (!r.Ends.IsZero() && r.Ends.Before(r.Starts)) {
+		return errors.New("invalid dates")
+	}
+	if r.Frequency == frequencyCron {
+		_, err := ParseCron(r.Cron)
+		return err
+	}
+	if r.Interval < 1 {
+		return errors.New("invalid interval")
+	}
+	return nil
+}
+
+// nth returns the n-th date of the rule counting from zero. Days of months
+// missing in shorter months are moved to their last day.
+func (r RecurrenceRule) nth(n int) time.Time {
+	switch r.Frequency {
+	case frequencyWeekly:
+		return r.Starts.AddDate(0, 0, 7*n*r.Interval)
+	case frequencyMonthly, frequencyYearly:
+		months := n * r.Interval
+		if r.Frequency == frequencyYearly {
+			months *= 12
+		}
+		first := time.Date(r.Starts.Year(), r.Starts.Month()+time.Month(months), 1, 0, 0, 0, 0, time.UTC)
+		lastDay := first.AddDate(0, 1, -1).Day()
+		day := r.Starts.Day()
+		if day > lastDay {
+			day = lastDay
+		}
+		return first.AddDate(0, 0, day-1)
+	}
+	return r.Starts.AddDate(0, 0, n*r.Interval)
+}
+
+// Occurrences returns the dates of the rule between from and to inclusive
+func (r RecurrenceRule) Occurrences(from time.Time, to time.Time) []time.Time {
+	dates := []time.Time{}
+	if from.Before(r.Starts) {
+		from = r.Starts
+	}
+	if !r.Ends.IsZero() && r.Ends.Before(to) {
+		to = r.Ends
+	}
+	if to.Before(from) {
+		return dates
+	}
+
+	if r.Frequency == frequencyCron {
+		schedule, err := ParseCron(r.Cron)
+		if err != nil {
+			return dates
+		}
+		for date := from; !date.After(to); date = date.AddDate(0, 0, 1) {
+			if schedule.Matches(date) {
+				dates = append(dates, date)
+			}
+		}
+		return dates
+	}
+
+	// The first occurrence not before from is estimated and then corrected
+	n := 0
+	switch r.Frequency {
+	case frequencyDaily:
+		n = int(from.Sub(r.Starts).Hours()/24) / r.Interval
+	case frequencyWeekly:
+		n = int(from.Sub(r.Starts).Hours()/24) / (7 * r.Interval)
+	case frequencyMonthly:
+		n = ((from.Year()-r.Starts.Year())*12 + int(from.Month()) - int(r.Starts.Month())) / r.Interval
+	case frequencyYearly:
+		n = (from.Year() - r.Starts.Year()) / r.Interval
+	}
+	for n > 0 && !r.nth(n-1).Before(from) {
+		n--
+	}
+	for date := r.nth(n); !date.After(to); date = r.nth(n) {
+		if !date.Before(from) {
+			dates = append(dates, date)
+		}
+		n++
+	}
+	return dates
+}
+
+// Description - human readable rule for pages
+func (r RecurrenceRule) Description() string {
+	if r.Frequency == frequencyCron {
+		return "По расписанию " + r.Cron
+	}
+	units := map[string]string{
+		frequencyDaily:   "дн.",
+		frequencyWeekly:  "нед.",
+		frequencyMonthly: "мес.",
+		frequencyYearly:  "г.",
+	}
+	return "Каждые " + strconv.Itoa(r.Interval) + " " + units[r.Frequency]
+}
@@ -0,0 +1,189 @@
+package main
+
+import (
+	"database/sql"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func date(year int, month time.Month, day int) time.Time {
+	return time.Date(year, month, day, 0, 0, 0, 0, time.UTC)
+}
+
+func formatDates(dates []time.Time) []string {
+	formatted := make([]string, len(dates))
+	for i, d := range dates {
+		formatted[i] = d.Format(dateLayout)
+	}
+	return formatted
+}
+
+func equalStrings(a []string, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func TestRecurrenceOccurrences(t *testing.T) {
+	cases := []struct {
+		name     string
+		rule     RecurrenceRule
+		from, to time.Time
+		expected []string
+	}{
+		{
+			"monthly on the last days",
+			RecurrenceRule{Frequency: frequencyMonthly, Interval: 1, Starts: date(2020, time.January, 31)},
+			date(2020, time.January, 1), date(2020, time.April, 30),
+			[]string{"2020-01-31", "2020-02-29", "2020-03-31", "2020-04-30"},
+		},
+		{
+			"every second week from the middle",
+			RecurrenceRule{Frequency: frequencyWeekly, Interval: 2, Starts: date(2020, time.March, 2)},
+			date(2020, time.March, 10), date(2020, time.April, 1),
+			[]string{"2020-03-16", "2020-03-30"},
+		},
+		{
+			"daily till the end",
+			RecurrenceRule{Frequency: frequencyDaily, Interval: 3, Starts: date(2020, time.March, 1), Ends: date(2020, time.March, 8)},
+			date(2020, time.January, 1), date(2020, time.December, 31),
+			[]string{"2020-03-01", "2020-03-04", "2020-03-07"},
+		},
+		{
+			"yearly on leap day",
+			RecurrenceRule{Frequency: frequencyYearly, Interval: 1, Starts: date(2020, time.February, 29)},
+			date(2020, time.March, 1), date(2024, time.December, 31),
+			[]string{"2021-02-28", "2022-02-28", "2023-02-28", "2024-02-29"},
+		},
+		{
+			"cron on the 1st and 15th of odd months",
+			RecurrenceRule{Frequency: frequencyCron, Cron: "0 9 1,15 */2 *", Starts: date(2020, time.January, 10)},
+			date(2020, time.January, 1), date(2020, time.March, 31),
+			[]string{"2020-01-15", "2020-03-01", "2020-03-15"},
+		},
+		{
+			"before the start",
+			RecurrenceRule{Frequency: frequencyMonthly, Interval: 1, Starts: date(2020, time.May, 1)},
+			date(2020, time.January, 1), date(2020, time.April, 30),
+			[]string{},
+		},
+	}
+	for _, c := range cases {
+		actual := formatDates(c.rule.Occurrences(c.from, c.to))
+		if !equalStrings(actual, c.expected) {
+			t.Errorf("%s: expected %v, got %v", c.name, c.expected, actual)
+		}
+	}
+}
+
+func TestParseCron(t *testing.T) {
+	valid := []struct {
+		expression string
+		matches    time.Time
+		misses     time.Time
+	}{
+		{"1 * *", date(2020, time.March, 1), date(2020, time.March, 2)},
+		{"* * 1-5", date(2020, time.March, 2), date(2020, time.March, 1)},
+		{"* * 7", date(2020, time.March, 1), date(2020, time.March, 2)},
+		// Restricted day of month and day of week match either of them
+		{"13 * 5", date(2020, time.March, 6), date(2020, time.March, 7)},
+		{"0 0 1-10/3 6 *", date(2020, time.June, 7), date(2020, time.June, 8)},
+	}
+	for _, c := range valid {
+		schedule, err := ParseCron(c.expression)
+		if err != nil {
+			t.Errorf("%q: %v", c.expression, err)
+			continue
+		}
+		if !schedule.Matches(c.matches) || schedule.Matches(c.misses) {
+			t.Errorf("%q: unexpected schedule", c.expression)
+		}
+	}
+	for _, expression := range []string{"", "* *", "32 * *", "* 13 *", "* * 8", "5-1 * *", "*/0 * *", "a * *"} {
+		if _, err := ParseCron(expression); err == nil {
+			t.Errorf("%q: expected an error", expression)
+		}
+	}
+}
+
+func TestRecurrenceValidate(t *testing.T) {
+	invalid := []RecurrenceRule{
+		{Frequency: "hourly", Interval: 1, Starts: date(2020, time.March, 1)},
+		{Frequency: frequencyDaily, Interval: 0, Starts: date(2020, time.March, 1)},
+		{Frequency: frequencyDaily, Interval: 1},
+		{Frequency: frequencyDaily, Interval: 1, Starts: date(2020, time.March, 1), Ends: date(2020, time.February, 1)},
+		{Frequency: frequencyCron, Cron: "* *", Starts: date(2020, time.March, 1)},
+	}
+	for _, rule := range invalid {
+		if rule.Validate() == nil {
+			t.Errorf("expected %+v to be invalid", rule)
+		}
+	}
+	if err := (RecurrenceRule{Frequency: frequencyCron, Cron: "1 * *", Starts: date(2020, time.March, 1)}).Validate(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestDueOccurrences(t *testing.T) {
+	recurring := RecurringTransaction{
+		Frequency: frequencyMonthly,
+		Every:     1,
+		Starts:    date(2020, time.January, 15),
+	}
+	today := date(2020, time.April, 20)
+	expected := []string{"2020-01-15", "2020-02-15", "2020-03-15", "2020-04-15"}
+	if actual := formatDates(dueOccurrences(recurring, today)); !equalStrings(actual, expected) {
+		t.Errorf("expected %v, got %v", expected, actual)
+	}
+	// After downtime only the occurrences missed since the last run are due
+	recurring.Processed = sql.NullTime{Time: date(2020, time.February, 20), Valid: true}
+	expected = []string{"2020-03-15", "2020-04-15"}
+	if actual := formatDates(dueOccurrences(recurring, today)); !equalStrings(actual, expected) {
+		t.Errorf("expected %v, got %v", expected, actual)
+	}
+}
+
+func TestParseRecurrenceRuleBackfill(t *testing.T) {
+	today := date(2020, time.May, 10)
+	cases := map[string]int{
+		"2019-05-10": 0,
+		"2019-05-09": 42,
+		"2020-06-01": 0,
+	}
+	for starts, expected := range cases {
+		r := httptest.NewRequest("POST", "/recurring/add?frequency=monthly&starts="+starts, nil)
+		_, errorCode := parseRecurrenceRule(r, today)
+		if errorCode != expected {
+			t.Errorf("%s: expected error %d, got %d", starts, expected, errorCode)
+		}
+	}
+}
+
+func TestUpcomingOccurrences(t *testing.T) {
+	templates := []RecurringTransaction{
+		{ID: 1, Frequency: frequencyWeekly, Every: 1, Starts: date(2020, time.March, 2)},
+		{ID: 2, Frequency: frequencyMonthly, Every: 1, Starts: date(2020, time.January, 5)},
+	}
+	skipped := map[int][]time.Time{1: {date(2020, time.March, 9)}}
+	upcoming, skippedOccurrences := upcomingOccurrences(templates, skipped, date(2020, time.March, 3), 14)
+
+	var actual []string
+	for _, occurrence := range upcoming {
+		actual = append(actual, occurrence.Date.Format(dateLayout)+"/"+strconv.Itoa(occurrence.Recurring.ID))
+	}
+	expected := []string{"2020-03-05/2", "2020-03-16/1"}
+	if !equalStrings(actual, expected) {
+		t.Errorf("expected %v, got %v", expected, actual)
+	}
+	if len(skippedOccurrences) != 1 || skippedOccurrences[0].Recurring.ID != 1 {
+		t.Errorf("unexpected skipped occurrences %+v", skippedOccurrences)
+	}
+}
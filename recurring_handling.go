@@ -0,0 +1,503 @@
+package main
+
+import (
+	"database/sql"
+	"html/template"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+)
+
+const (
+	schedulerInterval = time.Hour
+	// Upcoming occurrences are shown for this number of days
+	upcomingDays = 31
+	// New templates start at most this number of years ago, all the past
+	// occurrences are created right away
+	maxBackfillYears = 1
+)
+
+// RecurringTransaction - element of corresponding table, the recurring of
+// transactions created by the scheduler
+type RecurringTransaction struct {
+	ID           int
+	UserID       int
+	Kind         string
+	Account      int32
+	ToAccount    sql.NullInt32
+	Category     sql.NullInt32
+	AccountName  string
+	CategoryName string
+	Amount       Money
+	Currency     string
+	Comment      string
+	Frequency    string
+	Every        int
+	Cron         string
+	Starts       time.Time
+	Ends         sql.NullTime
+	Processed    sql.NullTime
+}
+
+// Rule - schedule of the recurring
+func (t RecurringTransaction) Rule() RecurrenceRule {
+	rule := RecurrenceRule{
+		Frequency: t.Frequency,
+		Interval:  t.Every,
+		Cron:      t.Cron,
+		Starts:    truncateToDay(t.Starts),
+	}
+	if t.Ends.Valid {
+		rule.Ends = truncateToDay(t.Ends.Time)
+	}
+	return rule
+}
+
+// Occurrence - date of a recurring transaction
+type Occurrence struct {
+	Recurring RecurringTransaction
+	Date      time.Time
+}
+
+// RecurringViewData - information to display on page
+type RecurringViewData struct {
+	LayoutData
+	Title            string
+	Recurring        []RecurringTransaction
+	Upcoming         []Occurrence
+	Skipped          []Occurrence
+	Accounts         []Account
+	Categories       []Category
+	ErrorDescription string
+}
+
+func truncateToDay(date time.Time) time.Time {
+	return time.Date(date.Year(), date.Month(), date.Day(), 0, 0, 0, 0, time.UTC)
+}
+
+// getRecurringTransactions returns templates of the user or of all the users
+// when userID is zero
+func getRecurringTransactions(db sqlx.Queryer, userID int) (templates []RecurringTransaction, err error) {
+	templates = []RecurringTransaction{}
+	err = sqlx.Select(db, &templates, `
+	SELECT r.id, r.user_id AS userid, r.kind, r.account, r.to_account AS toaccount, r.category,
+		a.name AS accountname, COALESCE(c.name, '') AS categoryname, r.amount, r.currency,
+		COALESCE(r.comment, '') AS comment, r.frequency, r.every, r.cron, r.starts, r.ends, r.processed
+	FROM recurring_transactions r
+	JOIN accounts a
+	ON r.account = a.id
+	LEFT JOIN categories c
+	ON r.category = c.id
+	WHERE $1 = 0 OR r.user_id = $1
+	ORDER BY r.starts, r.id
+	`, userID)
+	return templates, err
+}
+
+// dueOccurrences returns dates of the recurring which are not processed yet
+// up to today, all the missed ones are returned after downtime
+func dueOccurrences(recurring RecurringTransaction, today time.Time) []time.Time {
+	rule := recurring.Rule()
+	from := rule.Starts
+	if recurring.Processed.Valid {
+		from = truncateToDay(recurring.Processed.Time).AddDate(0, 0, 1)
+	}
+	return rule.Occurrences(from, today)
+}
+
+// materializeOccurrence creates the transaction of the occurrence unless it
+// was created or skipped before
+func materializeOccurrence(db *sqlx.DB, recurring RecurringTransaction, date time.Time) (created bool, err error) {
+	tx, err := db.Beginx()
+	if err != nil {
+		return false, err
+	}
+	defer func() {
+		if err != nil {
+			tx.Rollback()
+		}
+	}()
+
+	result, err := tx.Exec(
+		"INSERT INTO recurring_occurrences(recurring_id, date, status) VALUES ($1, $2, 'created') ON CONFLICT DO NOTHING",
+		recurring.ID, date.Format(dateLayout),
+	)
+	if err != nil {
+		return false, err
+	}
+	inserted, err := result.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	if inserted == 0 {
+		return false, tx.Commit()
+	}
+
+	var transactionID int
+	err = tx.QueryRowx(`
+	INSERT INTO transactions(date, kind, account, to_account, category, amount, currency, comment, user_id)
+	VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)
+	RETURNING id
+	`,
+		date.Format(dateLayout), recurring.Kind, recurring.Account, recurring.ToAccount, recurring.Category,
+		recurring.Amount, recurring.Currency, recurring.Comment, recurring.UserID,
+	).Scan(&transactionID)
+	if err != nil {
+		return false, err
+	}
+	_, err = tx.Exec(
+		"UPDATE recurring_occurrences SET transaction_id = $1 WHERE recurring_id = $2 AND date = $3",
+		transactionID, recurring.ID, date.Format(dateLayout),
+	)
+	if err != nil {
+		return false, err
+	}
+	return true, tx.Commit()
+}
+
+// materializeRecurringTransactions creates transactions of all the due
+// occurrences. It is safe to run it again or from several instances: every
+// occurrence is recorded and created once.
+func materializeRecurringTransactions(db *sqlx.DB, today time.Time) (created int, err error) {
+	templates, err := getRecurringTransactions(db, 0)
+	if err != nil {
+		return 0, err
+	}
+	today = truncateToDay(today)
+	for _, recurring := range templates {
+		ok, err := materializeDueOccurrences(db, recurring, today)
+		created += ok
+		if err != nil {
+			return created, err
+		}
+	}
+	return created, nil
+}
+
+// materializeRecurringTransaction creates due occurrences of one template of
+// the user, so the handlers do not process the templates of all the users
+func materializeRecurringTransaction(db *sqlx.DB, userID int, recurringID int, today time.Time) (created int, err error) {
+	templates, err := getRecurringTransactions(db, userID)
+	if err != nil {
+		return 0, err
+	}
+	for _, recurring := range templates {
+		if recurring.ID == recurringID {
+			return materializeDueOccurrences(db, recurring, truncateToDay(today))
+		}
+	}
+	return 0, nil
+}
+
+// materializeDueOccurrences creates due occurrences of the template and marks
+// them processed. A failed occurrence is logged and retried by the next run.
+func materializeDueOccurrences(db *sqlx.DB, recurring RecurringTransaction, today time.Time) (created int, err error) {
+	for _, date := range dueOccurrences(recurring, today) {
+		ok, err := materializeOccurrence(db, recurring, date)
+		if err != nil {
+			log.Println("Creating recurring transaction failed", recurring.ID, date.Format(dateLayout), err)
+			return created, nil
+		}
+		if ok {
+			created++
+		}
+	}
+	_, err = db.Exec(
+		"UPDATE recurring_transactions SET processed = $1 WHERE id = $2 AND (processed IS NULL OR processed < $1)",
+		today.Format(dateLayout), recurring.ID,
+	)
+	return created, err
+}
+
+// runRecurringScheduler materializes due occurrences right away and then
+// every interval, it never returns
+func runRecurringScheduler(db *sqlx.DB, interval time.Duration) {
+	for {
+		created, err := materializeRecurringTransactions(db, time.Now())
+		if err != nil {
+			log.Println("Recurring transactions scheduler failed", err)
+		} else if created > 0 {
+			log.Println("Created recurring transactions", created)
+		}
+		time.Sleep(interval)
+	}
+}
+
+func getSkippedOccurrences(db *sqlx.DB, userID int) (map[int][]time.Time, error) {
+	rows, err := db.Queryx(`
+	SELECT o.recurring_id, o.date
+	FROM recurring_occurrences o
+	JOIN recurring_transactions r
+	ON o.recurring_id = r.id
+	WHERE r.user_id = $1 AND o.status = 'skipped'
+	ORDER BY o.date
+	`, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	skipped := map[int][]time.Time{}
+	for rows.Next() {
+		var (
+			recurringID int
+			date        time.Time
+		)
+		err = rows.Scan(&recurringID, &date)
+		if err != nil {
+			return nil, err
+		}
+		skipped[recurringID] = append(skipped[recurringID], truncateToDay(date))
+	}
+	return skipped, rows.Err()
+}
+
+// upcomingOccurrences lists occurrences of the templates from today, skipped
+// ones are returned separately
+func upcomingOccurrences(templates []RecurringTransaction, skipped map[int][]time.Time, today time.Time, days int) (upcoming []Occurrence, skippedOccurrences []Occurrence) {
+	upcoming, skippedOccurrences = []Occurrence{}, []Occurrence{}
+	for _, recurring := range templates {
+		isSkipped := map[time.Time]bool{}
+		for _, date := range skipped[recurring.ID] {
+			isSkipped[date] = true
+			skippedOccurrences = append(skippedOccurrences, Occurrence{recurring, date})
+		}
+		for _, date := range recurring.Rule().Occurrences(today, today.AddDate(0, 0, days-1)) {
+			if !isSkipped[date] {
+				upcoming = append(upcoming, Occurrence{recurring, date})
+			}
+		}
+	}
+	sort.SliceStable(upcoming, func(i, j int) bool {
+		return upcoming[i].Date.Before(upcoming[j].Date)
+	})
+	sort.SliceStable(skippedOccurrences, func(i, j int) bool {
+		return skippedOccurrences[i].Date.Before(skippedOccurrences[j].Date)
+	})
+	return upcoming, skippedOccurrences
+}
+
+func recurringView(w http.ResponseWriter, r *http.Request, userID int) {
+	templates, err := getRecurringTransactions(database, userID)
+	if err != nil {
+		log.Println("Query recurring transactions failed", err)
+	}
+	skipped, err := getSkippedOccurrences(database, userID)
+	if err != nil {
+		log.Println("Query skipped occurrences failed", err)
+	}
+	accounts, err := getAllAccountsOfUser(database, userID)
+	if err != nil {
+		log.Println(err)
+	}
+
+	data := RecurringViewData{
+		Title:            "Регулярные операции",
+		Recurring:        templates,
+		Accounts:         accounts,
+		Categories:       getAllCategoriesOfUser(database, userID),
+		ErrorDescription: allErrors[getErrorCode(r)],
+	}
+	data.Upcoming, data.Skipped = upcomingOccurrences(templates, skipped, truncateToDay(time.Now()), upcomingDays)
+	tmpl, err := template.ParseFiles("templates/layout.html", "templates/recurring.html", "templates/navigation_logedin.html")
+	if err != nil {
+		log.Println(err)
+	}
+	renderLayout(w, r, tmpl, &data)
+}
+
+// parseRecurrenceRule reads the schedule of the recurring transaction form,
+// the start is limited by maxBackfillYears before today
+func parseRecurrenceRule(r *http.Request, today time.Time) (rule RecurrenceRule, errorCode int) {
+	rule.Frequency = r.FormValue("frequency")
+	rule.Cron = strings.TrimSpace(r.FormValue("cron"))
+	rule.Interval = 1
+	if value := r.FormValue("every"); value != "" {
+		every, err := strconv.Atoi(value)
+		if err != nil {
+			return rule, 29
+		}
+		rule.Interval = every
+	}
+	var err error
+	rule.Starts, err = time.Parse(dateLayout, r.FormValue("starts"))
+	if err != nil {
+		return rule, 14
+	}
+	if value := r.FormValue("ends"); value != "" {
+		rule.Ends, err = time.Parse(dateLayout, value)
+		if err != nil {
+			return rule, 14
+		}
+	}
+	if rule.Validate() != nil {
+		return rule, 29
+	}
+	if rule.Starts.Before(truncateToDay(today).AddDate(-maxBackfillYears, 0, 0)) {
+		return rule, 42
+	}
+	return rule, 0
+}
+
+func addRecurringTransaction(w http.ResponseWriter, r *http.Request, userID int) {
+	err := r.ParseForm()
+	if err != nil {
+		log.Println(err)
+		http.Redirect(w, r, "/recurring?error=3", 302)
+		return
+	}
+	kind := r.FormValue("kind")
+	if !isValidKind(kind) {
+		http.Redirect(w, r, "/recurring?error=17", 302)
+		return
+	}
+	account, toAccount, errorCode := parseTransactionAccounts(r, kind, userID)
+	if errorCode != 0 {
+		http.Redirect(w, r, "/recurring?error="+strconv.Itoa(errorCode), 302)
+		return
+	}
+	currency, errorCode := parseTransactionCurrency(r.FormValue("currency"), account)
+	if errorCode != 0 {
+		http.Redirect(w, r, "/recurring?error="+strconv.Itoa(errorCode), 302)
+		return
+	}
+	categoryID, err := strconv.ParseInt(r.FormValue("category-id"), 10, 32)
+	if err != nil {
+		log.Println(err)
+		http.Redirect(w, r, "/recurring?error=4", 302)
+		return
+	}
+	exists, err := isCategoryOfUser(int32(categoryID), userID)
+	if err != nil {
+		log.Println(err)
+	}
+	if !exists {
+		http.Redirect(w, r, "/recurring?error=4", 302)
+		return
+	}
+	amount, err := ParseMoney(r.FormValue("amount"))
+	if err != nil || !amount.IsPositive() {
+		log.Println("Invalid amount", r.FormValue("amount"))
+		http.Redirect(w, r, "/recurring?error=5", 302)
+		return
+	}
+	rule, errorCode := parseRecurrenceRule(r, time.Now())
+	if errorCode != 0 {
+		http.Redirect(w, r, "/recurring?error="+strconv.Itoa(errorCode), 302)
+		return
+	}
+	var ends interface{}
+	if !rule.Ends.IsZero() {
+		ends = rule.Ends.Format(dateLayout)
+	}
+
+	var recurringID int
+	err = database.QueryRowx(`
+	INSERT INTO recurring_transactions(user_id, kind, account, to_account, category, amount, currency, comment, frequency, every, cron, starts, ends)
+	VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13)
+	RETURNING id
+	`,
+		userID, kind, account, toAccount, categoryID, amount, currency, r.FormValue("comment"),
+		rule.Frequency, rule.Interval, rule.Cron, rule.Starts.Format(dateLayout), ends,
+	).Scan(&recurringID)
+	if err != nil {
+		log.Println(err)
+		http.Redirect(w, r, "/recurring?error=6", 302)
+		return
+	}
+	// Occurrences which are already due are created right away
+	_, err = materializeRecurringTransaction(database, userID, recurringID, time.Now())
+	if err != nil {
+		log.Println(err)
+	}
+	http.Redirect(w, r, "/recurring", 302)
+}
+
+func deleteRecurringTransaction(w http.ResponseWriter, r *http.Request, userID int) {
+	err := r.ParseForm()
+	if err != nil {
+		log.Println(err)
+	}
+	// Transactions created before stay in the history
+	_, err = database.Exec(
+		"DELETE FROM recurring_transactions WHERE id = $1 AND user_id = $2",
+		r.FormValue("recurring-id"), userID,
+	)
+	if err != nil {
+		log.Println(err)
+	}
+	http.Redirect(w, r, "/recurring", 302)
+}
+
+// skipOccurrence marks the upcoming occurrence, so the scheduler never creates it
+func skipOccurrence(w http.ResponseWriter, r *http.Request, userID int) {
+	err := r.ParseForm()
+	if err != nil {
+		log.Println(err)
+	}
+	_, err = database.Exec(`
+	INSERT INTO recurring_occurrences(recurring_id, date, status)
+	SELECT id, $2, 'skipped' FROM recurring_transactions WHERE id = $1 AND user_id = $3
+	ON CONFLICT DO NOTHING
+	`, r.FormValue("recurring-id"), r.FormValue("date"), userID)
+	if err != nil {
+		log.Println(err)
+	}
+	http.Redirect(w, r, "/recurring", 302)
+}
+
+// unskipOccurrence returns the skipped occurrence, the past ones are created
+// right away
+func unskipOccurrence(w http.ResponseWriter, r *http.Request, userID int) {
+	err := r.ParseForm()
+	if err != nil {
+		log.Println(err)
+	}
+	tx, err := database.Beginx()
+	if err != nil {
+		log.Println(err)
+		http.Redirect(w, r, "/recurring?error=6", 302)
+		return
+	}
+	result, err := tx.Exec(`
+	DELETE FROM recurring_occurrences o
+	USING recurring_transactions r
+	WHERE o.recurring_id = r.id AND r.id = $1 AND o.date = $2 AND r.user_id = $3 AND o.status = 'skipped'
+	`, r.FormValue("recurring-id"), r.FormValue("date"), userID)
+	if err == nil {
+		var deleted int64
+		deleted, err = result.RowsAffected()
+		if err == nil && deleted > 0 {
+			_, err = tx.Exec(
+				"UPDATE recurring_transactions SET processed = $2::date - 1 WHERE id = $1 AND processed >= $2::date",
+				r.FormValue("recurring-id"), r.FormValue("date"),
+			)
+		}
+	}
+	if err != nil {
+		log.Println(err)
+		tx.Rollback()
+		http.Redirect(w, r, "/recurring?error=6", 302)
+		return
+	}
+	err = tx.Commit()
+	if err != nil {
+		log.Println(err)
+	}
+	recurringID, err := strconv.Atoi(r.FormValue("recurring-id"))
+	if err != nil {
+		log.Println(err)
+		http.Redirect(w, r, "/recurring", 302)
+		return
+	}
+	_, err = materializeRecurringTransaction(database, userID, recurringID, time.Now())
+	if err != nil {
+		log.Println(err)
+	}
+	http.Redirect(w, r, "/recurring", 302)
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gorilla/securecookie"
+)
+
+// Sessions end on the server after these periods, a remembered one lives as
+// long as its cookie
+const (
+	sessionLifetime           = 24 * time.Hour
+	rememberedSessionLifetime = 365 * 24 * time.Hour
+)
+
+// cookieCodecs sign and encrypt the session cookie, the first one encodes
+// new cookies and all of them decode, so keys can be rotated without logging
+// everybody out
+var cookieCodecs []securecookie.Codec
+
+// parseCookieKeys reads key pairs separated by spaces, newest first. A pair
+// is a base64 hash key of 32 or 64 bytes and an optional base64 block key of
+// 16, 24 or 32 bytes after a colon.
+func parseCookieKeys(value string) (codecs []securecookie.Codec, err error) {
+	pairs := [][]byte{}
+	for i, pair := range strings.Fields(value) {
+		keys := strings.SplitN(pair, ":", 2)
+		hashKey, err := base64.StdEncoding.DecodeString(keys[0])
+		if err != nil || (len(hashKey) != 32 && len(hashKey) != 64) {
+			return nil, fmt.Errorf("invalid hash key of cookie key pair %d", i+1)
+		}
+		var blockKey []byte
+		if len(keys) > 1 {
+			blockKey, err = base64.StdEncoding.DecodeString(keys[1])
+			if err != nil || (len(blockKey) != 16 && len(blockKey) != 24 && len(blockKey) != 32) {
+				return nil, fmt.Errorf("invalid block key of cookie key pair %d", i+1)
+			}
+		}
+		pairs = append(pairs, hashKey, blockKey)
+	}
+	if len(pairs) == 0 {
+		return nil, fmt.Errorf("no cookie keys")
+	}
+	return newCookieCodecs(pairs...), nil
+}
+
+// randomCookieCodecs are used without configured keys, sessions do not
+// survive a restart then
+func randomCookieCodecs() []securecookie.Codec {
+	return newCookieCodecs(securecookie.GenerateRandomKey(64), securecookie.GenerateRandomKey(32))
+}
+
+func newCookieCodecs(pairs ...[]byte) []securecookie.Codec {
+	codecs := securecookie.CodecsFromPairs(pairs...)
+	for _, codec := range codecs {
+		// The server side expiry is checked for every request, the cookie
+		// itself may be as old as the longest session
+		if s, ok := codec.(*securecookie.SecureCookie); ok {
+			s.MaxAge(int(rememberedSessionLifetime.Seconds()))
+		}
+	}
+	return codecs
+}
+
+func loadCookieKeys(value string) []securecookie.Codec {
+	if value == "" {
+		log.Println("COOKIE_KEYS is not set, sessions end on restart")
+		return randomCookieCodecs()
+	}
+	codecs, err := parseCookieKeys(value)
+	if err != nil {
+		log.Fatal(err)
+	}
+	return codecs
+}
+
+// generateSessionToken returns a random token, only its hash is stored
+func generateSessionToken() (token string, err error) {
+	b := make([]byte, 32)
+	_, err = rand.Read(b)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// getSessionToken returns the token of the session cookie of the request,
+// empty for missing or forged cookies
+func getSessionToken(r *http.Request) string {
+	cookie, err := r.Cookie("cookie")
+	if err != nil {
+		return ""
+	}
+	var token string
+	err = securecookie.DecodeMulti("cookie", cookie.Value, &token, cookieCodecs...)
+	if err != nil {
+		log.Println("Invalid session cookie", err)
+		return ""
+	}
+	return token
+}
+
+// getSessionID returns the identifier of the current session to mark it in
+// the list of sessions
+func getSessionID(r *http.Request) (sessionID int) {
+	token := getSessionToken(r)
+	if token == "" {
+		return 0
+	}
+	err := database.QueryRowx(
+		"SELECT id FROM sessions WHERE token_hash = $1::bytea AND expires > NOW()", hashToken(token),
+	).Scan(&sessionID)
+	if err != nil {
+		log.Println("Session id by token failed", err)
+	}
+	return sessionID
+}
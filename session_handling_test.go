@@ -0,0 +1,63 @@
+package main
+
+import (
+	"encoding/base64"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/securecookie"
+)
+
+func TestParseCookieKeys(t *testing.T) {
+	key := func(length int) string {
+		return base64.StdEncoding.EncodeToString(securecookie.GenerateRandomKey(length))
+	}
+	oldPair := key(64) + ":" + key(32)
+	newPair := key(32) + ":" + key(16)
+
+	oldCodecs, err := parseCookieKeys(oldPair)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rotated, err := parseCookieKeys(newPair + "  " + oldPair + "\n" + key(64))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rotated) != 3 {
+		t.Fatalf("%d codecs", len(rotated))
+	}
+
+	// Cookies of the old key are still accepted, new cookies use the new key
+	encoded, err := securecookie.EncodeMulti("cookie", "token", oldCodecs...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var token string
+	if err = securecookie.DecodeMulti("cookie", encoded, &token, rotated...); err != nil || token != "token" {
+		t.Errorf("old cookie is rejected: %v", err)
+	}
+	encoded, _ = securecookie.EncodeMulti("cookie", "token", rotated...)
+	if securecookie.DecodeMulti("cookie", encoded, &token, oldCodecs...) == nil {
+		t.Errorf("new cookie is signed with the old key")
+	}
+	if securecookie.DecodeMulti("cookie", encoded, &token, randomCookieCodecs()...) == nil {
+		t.Errorf("cookie is accepted with other keys")
+	}
+
+	for _, value := range []string{"", "  ", "c2hvcnQ=", key(64) + ":c2hvcnQ=", "!!!", key(64) + ":" + key(20)} {
+		if _, err = parseCookieKeys(value); err == nil {
+			t.Errorf("%q is accepted", value)
+		}
+	}
+}
+
+func TestGenerateSessionToken(t *testing.T) {
+	first, err := generateSessionToken()
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, _ := generateSessionToken()
+	if first == second || len(first) != 64 || strings.Trim(first, "0123456789abcdef") != "" {
+		t.Errorf("unexpected tokens %s %s", first, second)
+	}
+}
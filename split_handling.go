@@ -0,0 +1,129 @@
+package main
+
+import (
+	"strconv"
+	"strings"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// TransactionSplit - one line of a split transaction, the amount is in the
+// currency of the transaction
+type TransactionSplit struct {
+	Category     int32
+	CategoryName string
+	Amount       Money
+}
+
+// transactionLinesSQL replaces the transactions table in category
+// aggregations: a split transaction becomes one row per line with the
+// category and the amount of the line, other transactions are kept as is
+const transactionLinesSQL = `(
+		SELECT t.id, t.user_id, t.date, t.kind, t.account, t.to_account,
+			COALESCE(s.category, t.category) AS category, COALESCE(s.amount, t.amount) AS amount,
+			t.currency, t.comment
+		FROM transactions t
+		LEFT JOIN transaction_splits s
+		ON s.transaction_id = t.id
+	)`
+
+// transactionCategoryNameSQL is the expression of the category name of
+// transaction t joined with category c, a split transaction lists
+// categories of all its lines
+const transactionCategoryNameSQL = `COALESCE((
+			SELECT string_agg(sc.name, ', ' ORDER BY s.id)
+			FROM transaction_splits s
+			JOIN categories sc
+			ON s.category = sc.id
+			WHERE s.transaction_id = t.id
+		), c.name, '')`
+
+// parseSplits reads lines of the editor form, rows without an amount are
+// skipped, so the form may have spare empty rows
+func parseSplits(categoryIDs []string, amounts []string) (splits []TransactionSplit, errorCode int) {
+	splits = []TransactionSplit{}
+	for i, value := range amounts {
+		if strings.TrimSpace(value) == "" {
+			continue
+		}
+		amount, err := ParseMoney(value)
+		if err != nil || !amount.IsPositive() {
+			return nil, 5
+		}
+		if i >= len(categoryIDs) {
+			return nil, 4
+		}
+		categoryID, err := strconv.ParseInt(categoryIDs[i], 10, 32)
+		if err != nil {
+			return nil, 4
+		}
+		splits = append(splits, TransactionSplit{Category: int32(categoryID), Amount: amount})
+	}
+	return splits, 0
+}
+
+// checkSplits returns the error code when the lines can not make up the
+// transaction, no lines mean the transaction is not split
+func checkSplits(splits []TransactionSplit, kind string, total Money) int {
+	if len(splits) == 0 {
+		return 0
+	}
+	if len(splits) < 2 || kind == kindTransfer {
+		return 33
+	}
+	var sum Money
+	for _, split := range splits {
+		sum += split.Amount
+	}
+	if sum != total {
+		return 34
+	}
+	return 0
+}
+
+// setTransactionSplits replaces lines of the transaction, categories of
+// other users are not found
+func setTransactionSplits(tx *sqlx.Tx, userID int, transactionID int, splits []TransactionSplit) error {
+	_, err := tx.Exec("DELETE FROM transaction_splits WHERE transaction_id = $1", transactionID)
+	if err != nil {
+		return err
+	}
+	for _, split := range splits {
+		result, err := tx.Exec(`
+		INSERT INTO transaction_splits(transaction_id, category, amount)
+		SELECT $1, id, $2 FROM categories WHERE id = $3 AND user_id = $4
+		`, transactionID, split.Amount, split.Category, userID)
+		if err != nil {
+			return err
+		}
+		if affected, _ := result.RowsAffected(); affected == 0 {
+			return errCategoryNotFound
+		}
+	}
+	return nil
+}
+
+// getTransactionSplits returns lines of the transaction in the order they
+// were entered
+func getTransactionSplits(db sqlx.Queryer, transactionID int) (splits []TransactionSplit, err error) {
+	splits = []TransactionSplit{}
+	err = sqlx.Select(db, &splits, `
+	SELECT s.category, c.name AS categoryname, s.amount
+	FROM transaction_splits s
+	JOIN categories c
+	ON s.category = c.id
+	WHERE s.transaction_id = $1
+	ORDER BY s.id
+	`, transactionID)
+	return splits, err
+}
+
+// SplitRows - lines of the editor form, the saved ones and empty rows to add
+// more of them
+func (data ReportsEditorViewData) SplitRows() []TransactionSplit {
+	rows := append([]TransactionSplit{}, data.Splits...)
+	for len(rows) < 2 || len(rows) == len(data.Splits) {
+		rows = append(rows, TransactionSplit{})
+	}
+	return rows
+}
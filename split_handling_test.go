@@ -0,0 +1,59 @@
+package main
+
+import "testing"
+
+func TestParseSplits(t *testing.T) {
+	splits, errorCode := parseSplits([]string{"1", "2", "3"}, []string{"300,50", " ", "200"})
+	if errorCode != 0 {
+		t.Fatal(errorCode)
+	}
+	if len(splits) != 2 || splits[0].Amount != 30050 || splits[1].Category != 3 {
+		t.Errorf("unexpected splits %+v", splits)
+	}
+
+	cases := []struct {
+		categoryIDs, amounts []string
+		expected             int
+	}{
+		{[]string{"1"}, []string{"-5"}, 5},
+		{[]string{"food"}, []string{"5"}, 4},
+		{[]string{}, []string{"5"}, 4},
+	}
+	for _, c := range cases {
+		if _, errorCode = parseSplits(c.categoryIDs, c.amounts); errorCode != c.expected {
+			t.Errorf("%v %v: error %d, expected %d", c.categoryIDs, c.amounts, errorCode, c.expected)
+		}
+	}
+}
+
+func TestCheckSplits(t *testing.T) {
+	splits := []TransactionSplit{{Category: 1, Amount: 30050}, {Category: 2, Amount: 19950}}
+	cases := []struct {
+		splits   []TransactionSplit
+		kind     string
+		total    Money
+		expected int
+	}{
+		{nil, kindTransfer, 100, 0},
+		{splits, kindExpense, 50000, 0},
+		{splits, kindIncome, 50000, 0},
+		{splits, kindExpense, 50001, 34},
+		{splits, kindTransfer, 50000, 33},
+		{splits[:1], kindExpense, 30050, 33},
+	}
+	for i, c := range cases {
+		if errorCode := checkSplits(c.splits, c.kind, c.total); errorCode != c.expected {
+			t.Errorf("case %d: error %d, expected %d", i, errorCode, c.expected)
+		}
+	}
+}
+
+func TestSplitRows(t *testing.T) {
+	if rows := (ReportsEditorViewData{}).SplitRows(); len(rows) != 2 {
+		t.Errorf("transaction without lines has %d rows", len(rows))
+	}
+	data := ReportsEditorViewData{Splits: []TransactionSplit{{Category: 1}, {Category: 2}, {Category: 3}}}
+	if rows := data.SplitRows(); len(rows) != 4 || rows[3].Category != 0 {
+		t.Errorf("unexpected rows %+v", rows)
+	}
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"database/sql"
+	"html/template"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/lib/pq"
+)
+
+const maxTagLength = 64
+
+// transactionTagsSQL is the expression of comma separated tags of transaction t
+const transactionTagsSQL = `COALESCE((
+		SELECT string_agg(g.name, ', ' ORDER BY g.name)
+		FROM transaction_tags tt
+		JOIN tags g
+		ON tt.tag_id = g.id
+		WHERE tt.transaction_id = t.id
+	), '')`
+
+// TagTotal - sums of transactions with the tag over the period in the base
+// currency
+type TagTotal struct {
+	Name     string
+	Count    int
+	Expenses Money
+	Income   Money
+}
+
+// TagReportViewData - information to display on page
+type TagReportViewData struct {
+	LayoutData
+	Title            string
+	BaseCurrency     string
+	From             time.Time
+	To               time.Time
+	Totals           []TagTotal
+	MissingRates     int
+	ErrorDescription string
+}
+
+// TagNames - tags of the transaction for links in the table
+func (t TransactionNamed) TagNames() []string {
+	return parseTags(t.Tags)
+}
+
+// parseTags splits the comma separated tags of a form field. Tags are lower
+// cased, so "Отпуск" and "отпуск" are the same tag.
+func parseTags(value string) []string {
+	tags := []string{}
+	seen := map[string]bool{}
+	for _, tag := range strings.Split(value, ",") {
+		tag = strings.ToLower(strings.Join(strings.Fields(tag), " "))
+		if runes := []rune(tag); len(runes) > maxTagLength {
+			tag = string(runes[:maxTagLength])
+		}
+		if tag == "" || seen[tag] {
+			continue
+		}
+		seen[tag] = true
+		tags = append(tags, tag)
+	}
+	return tags
+}
+
+// setTransactionTags replaces tags of the transaction, new tags of the user
+// are created
+func setTransactionTags(tx *sqlx.Tx, userID int, transactionID int, tags []string) error {
+	_, err := tx.Exec("DELETE FROM transaction_tags WHERE transaction_id = $1", transactionID)
+	if err != nil || len(tags) == 0 {
+		return err
+	}
+	_, err = tx.Exec(
+		"INSERT INTO tags(user_id, name) SELECT $1, unnest($2::text[]) ON CONFLICT DO NOTHING",
+		userID, pq.Array(tags),
+	)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec(`
+	INSERT INTO transaction_tags(transaction_id, tag_id)
+	SELECT $1, id FROM tags WHERE user_id = $2 AND name = ANY($3::text[])
+	`, transactionID, userID, pq.Array(tags))
+	return err
+}
+
+// getTagsOfUser returns names of all the tags of the user for autocomplete
+func getTagsOfUser(db *sqlx.DB, userID int) []string {
+	tags := []string{}
+	err := db.Select(&tags, "SELECT name FROM tags WHERE user_id = $1 ORDER BY name", userID)
+	if err != nil {
+		log.Println("Query tags failed", err)
+	}
+	return tags
+}
+
+// getTransactionTags returns tags of the transaction for the form field
+func getTransactionTags(db *sqlx.DB, transactionID int) (tags string, err error) {
+	err = db.QueryRowx("SELECT "+transactionTagsSQL+" FROM transactions t WHERE t.id = $1", transactionID).Scan(&tags)
+	if err == sql.ErrNoRows {
+		return "", nil
+	}
+	return tags, err
+}
+
+// getTagTotals sums expenses and income of every tag, a transaction with
+// several tags is counted in each of them
+func getTagTotals(db *sqlx.DB, userID int, from time.Time, to time.Time) (totals []TagTotal, err error) {
+	totals = []TagTotal{}
+	err = db.Select(&totals, `
+	SELECT g.name, COUNT(DISTINCT p.id) AS count,
+		COALESCE(SUM(p.amount) FILTER (WHERE p.kind = 'expense'), 0) AS expenses,
+		COALESCE(SUM(p.amount) FILTER (WHERE p.kind = 'income'), 0) AS income
+	FROM (`+convertedTransactionsSQL()+`) AS p
+	JOIN transaction_tags tt
+	ON tt.transaction_id = p.id
+	JOIN tags g
+	ON tt.tag_id = g.id
+	GROUP BY g.name
+	ORDER BY expenses DESC, income DESC, g.name
+	`, userID, from.Format(dateLayout), to.Format(dateLayout))
+	return totals, err
+}
+
+func tagReportView(w http.ResponseWriter, r *http.Request, userID int) {
+	weekStart, err := getUserWeekStart(database, userID)
+	if err != nil {
+		log.Println("Query week start failed", err)
+	}
+	filter, errorCode := parseTransactionFilter(r)
+	if filter.From.IsZero() {
+		filter.From = getPeriodStarts(time.Now(), weekStart).Year
+	}
+	if filter.To.IsZero() {
+		filter.To = getPeriodStarts(time.Now(), weekStart).Day
+	}
+	baseCurrency, err := getUserBaseCurrency(database, userID)
+	if err != nil {
+		log.Println(err)
+	}
+
+	data := TagReportViewData{
+		Title:            "Отчеты",
+		BaseCurrency:     baseCurrency,
+		From:             filter.From,
+		To:               filter.To,
+		ErrorDescription: allErrors[errorCode],
+	}
+	data.Totals, err = getTagTotals(database, userID, data.From, data.To)
+	if err != nil {
+		log.Println("Query tag totals failed", err)
+		data.ErrorDescription = allErrors[13]
+	}
+	data.MissingRates, err = countUnconvertedTransactions(database, userID, data.From, data.To)
+	if err != nil {
+		log.Println("Query unconverted transactions failed", err)
+	}
+	tmpl, err := template.ParseFiles("templates/layout.html", "templates/reports_tags.html", "templates/navigation_logedin.html")
+	if err != nil {
+		log.Println(err)
+	}
+	err = renderLayout(w, r, tmpl, &data)
+	if err != nil {
+		log.Println(err)
+	}
+}
@@ -0,0 +1,21 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestParseTags(t *testing.T) {
+	tags := parseTags(" Отпуск, дети ,,отпуск,  летний   отдых ")
+	expected := []string{"отпуск", "дети", "летний отдых"}
+	if strings.Join(tags, "|") != strings.Join(expected, "|") {
+		t.Errorf("unexpected tags %q", tags)
+	}
+	if len(parseTags("")) != 0 {
+		t.Errorf("empty value has tags")
+	}
+	long := parseTags(strings.Repeat("я", maxTagLength+10))
+	if len(long) != 1 || len([]rune(long[0])) != maxTagLength {
+		t.Errorf("long tag is not truncated")
+	}
+}
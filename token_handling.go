@@ -0,0 +1,145 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const apiTokenPrefix = "egt_"
+
+// tokenScopeErrorCode is returned for write requests with read-only tokens
+const tokenScopeErrorCode = 41
+
+var (
+	errInvalidAPIToken = errors.New("invalid API token")
+	errAPITokenScope   = errors.New("API token scope does not allow the method")
+)
+
+// APIToken - element of corresponding table, the token itself is never stored
+type APIToken struct {
+	ID       int
+	Name     string
+	Scope    string
+	Created  time.Time
+	LastUsed sql.NullTime
+}
+
+func generateAPIToken() (token string, err error) {
+	b := make([]byte, 32)
+	_, err = rand.Read(b)
+	if err != nil {
+		return "", err
+	}
+	return apiTokenPrefix + hex.EncodeToString(b), nil
+}
+
+func hashToken(token string) []byte {
+	sha := sha256.Sum256([]byte(token))
+	return sha[:]
+}
+
+// isReadOnlyMethod reports whether the request can be served with a token of
+// the read scope
+func isReadOnlyMethod(method string) bool {
+	return method == "GET" || method == "HEAD" || method == "OPTIONS"
+}
+
+// getAPITokenUserID resolves the Authorization header, errAPITokenScope is
+// returned for write requests made with read-only tokens, so they are told
+// apart from unknown tokens
+func getAPITokenUserID(r *http.Request, authorization string) (userID int, err error) {
+	const bearer = "Bearer "
+	if len(authorization) <= len(bearer) || !strings.EqualFold(authorization[:len(bearer)], bearer) {
+		log.Println("Unsupported authorization scheme")
+		return 0, errInvalidAPIToken
+	}
+	token := strings.TrimSpace(authorization[len(bearer):])
+
+	var scope string
+	err = database.QueryRowx(
+		"UPDATE api_tokens SET last_used = NOW() WHERE token_hash = $1::bytea RETURNING user_id, scope",
+		hashToken(token),
+	).Scan(&userID, &scope)
+	if err != nil {
+		log.Println("User id by API token failed", err)
+		return 0, errInvalidAPIToken
+	}
+	if scope != "write" && !isReadOnlyMethod(r.Method) {
+		log.Println("API token scope does not allow", r.Method)
+		return 0, errAPITokenScope
+	}
+	return userID, nil
+}
+
+func getAllAPITokensOfUser(userID int) (apiTokens []APIToken, err error) {
+	apiTokens = []APIToken{}
+	err = database.Select(
+		&apiTokens,
+		"SELECT id, name, scope, created, last_used AS lastused FROM api_tokens WHERE user_id = $1 ORDER BY created",
+		userID,
+	)
+	return apiTokens, err
+}
+
+func createAPIToken(w http.ResponseWriter, r *http.Request, userID int) {
+	err := r.ParseForm()
+	if err != nil {
+		log.Println("Form parse failed", err)
+		http.Redirect(w, r, "/settings?error=16", 302)
+		return
+	}
+	name := strings.TrimSpace(r.FormValue("token-name"))
+	scope := r.FormValue("token-scope")
+	if name == "" || len(name) > 64 || (scope != "read" && scope != "write") {
+		log.Println("Invalid API token parameters", name, scope)
+		http.Redirect(w, r, "/settings?error=16", 302)
+		return
+	}
+
+	token, err := generateAPIToken()
+	if err != nil {
+		log.Println("Generating API token failed", err)
+		http.Redirect(w, r, "/settings?error=16", 302)
+		return
+	}
+	_, err = database.Exec(
+		"INSERT INTO api_tokens(user_id, name, scope, token_hash, created) VALUES ($1, $2, $3, $4::bytea, NOW())",
+		userID, name, scope, hashToken(token),
+	)
+	if err != nil {
+		log.Println("Inserting API token failed", err)
+		http.Redirect(w, r, "/settings?error=16", 302)
+		return
+	}
+	log.Println("New API token", name)
+
+	// The token is shown only once, so the page is rendered instead of redirect
+	renderSettings(w, r, userID, SettingsViewData{
+		SuccessDescription: allNotifications[3],
+		NewAPIToken:        token,
+	})
+}
+
+func revokeAPIToken(w http.ResponseWriter, r *http.Request, userID int) {
+	err := r.ParseForm()
+	if err != nil {
+		log.Println(err)
+	}
+	tokenID := r.FormValue("token-id")
+
+	_, err = database.Exec(
+		"DELETE FROM api_tokens WHERE id = $1 AND user_id = $2",
+		tokenID, userID,
+	)
+	if err != nil {
+		log.Println(err)
+	}
+	http.Redirect(w, r, "/settings", 302)
+}
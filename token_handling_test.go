@@ -0,0 +1,36 @@
+package main
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestGenerateAPIToken(t *testing.T) {
+	first, err := generateAPIToken()
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := generateAPIToken()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(first, apiTokenPrefix) || len(first) != len(apiTokenPrefix)+64 {
+		t.Errorf("unexpected token format %q", first)
+	}
+	if first == second {
+		t.Error("tokens are not random")
+	}
+	if string(hashToken(first)) == string(hashToken(second)) {
+		t.Error("different tokens have the same hash")
+	}
+}
+
+func TestGetAPITokenUserIDRejectsOtherSchemes(t *testing.T) {
+	r := httptest.NewRequest("GET", "/api/v1/transactions", nil)
+	for _, authorization := range []string{"Basic dXNlcjpwYXNz", "Bearer", "Bearer "} {
+		if userID, err := getAPITokenUserID(r, authorization); userID != 0 || err != errInvalidAPIToken {
+			t.Errorf("%q resolved to user %d", authorization, userID)
+		}
+	}
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"time"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// ISO 8601 weeks start on Monday, weeks in the ru/us style locales may start
+// on Sunday or Saturday
+const defaultWeekStart = time.Monday
+
+// PeriodTotals - sums of user's expenses over calendar periods ending today
+// and the income of the current month
+type PeriodTotals struct {
+	Daily         Money
+	Weekly        Money
+	Monthly       Money
+	Quarterly     Money
+	YearToDate    Money
+	MonthlyIncome Money
+}
+
+// MonthlyNet - difference between income and expenses of the current month
+func (t PeriodTotals) MonthlyNet() Money {
+	return t.MonthlyIncome - t.Monthly
+}
+
+// PeriodStarts - first days of the calendar periods containing some date
+type PeriodStarts struct {
+	Day     time.Time
+	Week    time.Time
+	Month   time.Time
+	Quarter time.Time
+	Year    time.Time
+}
+
+func getPeriodStarts(now time.Time, weekStart time.Weekday) PeriodStarts {
+	year, month, day := now.Date()
+	loc := now.Location()
+	today := time.Date(year, month, day, 0, 0, 0, 0, loc)
+	daysSinceWeekStart := (int(today.Weekday()) - int(weekStart) + 7) % 7
+	quarterMonth := time.Month((int(month)-1)/3*3 + 1)
+	return PeriodStarts{
+		Day:     today,
+		Week:    today.AddDate(0, 0, -daysSinceWeekStart),
+		Month:   time.Date(year, month, 1, 0, 0, 0, 0, loc),
+		Quarter: time.Date(year, quarterMonth, 1, 0, 0, 0, 0, loc),
+		Year:    time.Date(year, time.January, 1, 0, 0, 0, 0, loc),
+	}
+}
+
+func (s PeriodStarts) earliest() time.Time {
+	earliest := s.Day
+	for _, t := range []time.Time{s.Week, s.Month, s.Quarter, s.Year} {
+		if t.Before(earliest) {
+			earliest = t
+		}
+	}
+	return earliest
+}
+
+// convertedTransactionsSQL returns the query of transactions of the user $1
+// between dates $2 and $3 with amounts converted to the base currency. Totals
+// of the main page, budgets and tags aggregate it. Transactions without a
+// rate are left out.
+func convertedTransactionsSQL() string {
+	return `
+		SELECT * FROM (
+			SELECT t.id, t.kind, t.date, t.category, ` + convertedAmountSQL("u.base_currency") + ` AS amount
+			FROM ` + transactionLinesSQL + ` t
+			JOIN users u
+			ON t.user_id = u.id
+			WHERE t.user_id = $1 AND t.date >= $2::date AND t.date <= $3::date
+		) AS lines
+		WHERE amount IS NOT NULL
+	`
+}
+
+func getPeriodTotals(db *sqlx.DB, userID int, now time.Time, weekStart time.Weekday) (totals PeriodTotals, err error) {
+	starts := getPeriodStarts(now, weekStart)
+	// The week may begin in the previous year, so all periods are limited
+	// by the earliest start instead of the beginning of the year
+	// Amounts are converted to the base currency of the user
+	err = db.QueryRowx(`
+	SELECT
+		COALESCE(SUM(CASE WHEN kind = 'expense' AND date >= $3::date THEN amount END), 0) AS daily,
+		COALESCE(SUM(CASE WHEN kind = 'expense' AND date >= $4::date THEN amount END), 0) AS weekly,
+		COALESCE(SUM(CASE WHEN kind = 'expense' AND date >= $5::date THEN amount END), 0) AS monthly,
+		COALESCE(SUM(CASE WHEN kind = 'expense' AND date >= $6::date THEN amount END), 0) AS quarterly,
+		COALESCE(SUM(CASE WHEN kind = 'expense' AND date >= $7::date THEN amount END), 0) AS year_to_date,
+		COALESCE(SUM(CASE WHEN kind = 'income' AND date >= $5::date THEN amount END), 0) AS monthly_income
+	FROM (`+convertedTransactionsSQL()+`) AS converted
+	`,
+		userID,
+		starts.earliest().Format(dateLayout),
+		starts.Day.Format(dateLayout),
+		starts.Week.Format(dateLayout),
+		starts.Month.Format(dateLayout),
+		starts.Quarter.Format(dateLayout),
+		starts.Year.Format(dateLayout),
+	).Scan(&totals.Daily, &totals.Weekly, &totals.Monthly, &totals.Quarterly, &totals.YearToDate, &totals.MonthlyIncome)
+	return totals, err
+}
+
+func getUserWeekStart(db *sqlx.DB, userID int) (weekStart time.Weekday, err error) {
+	err = db.QueryRowx("SELECT week_start FROM users WHERE id = $1", userID).Scan(&weekStart)
+	if err != nil {
+		return defaultWeekStart, err
+	}
+	return weekStart, nil
+}
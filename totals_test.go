@@ -0,0 +1,37 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestGetPeriodStarts(t *testing.T) {
+	// Thursday
+	now := time.Date(2026, time.January, 1, 15, 30, 0, 0, time.UTC)
+	starts := getPeriodStarts(now, time.Monday)
+	expected := PeriodStarts{
+		Day:     time.Date(2026, time.January, 1, 0, 0, 0, 0, time.UTC),
+		Week:    time.Date(2025, time.December, 29, 0, 0, 0, 0, time.UTC),
+		Month:   time.Date(2026, time.January, 1, 0, 0, 0, 0, time.UTC),
+		Quarter: time.Date(2026, time.January, 1, 0, 0, 0, 0, time.UTC),
+		Year:    time.Date(2026, time.January, 1, 0, 0, 0, 0, time.UTC),
+	}
+	if starts != expected {
+		t.Errorf("got %+v, expected %+v", starts, expected)
+	}
+	if !starts.earliest().Equal(expected.Week) {
+		t.Errorf("earliest is %v, expected %v", starts.earliest(), expected.Week)
+	}
+
+	// Sunday
+	now = time.Date(2026, time.August, 16, 0, 0, 0, 0, time.UTC)
+	if week := getPeriodStarts(now, time.Monday).Week; week.Day() != 10 {
+		t.Errorf("ISO week starts on %v", week)
+	}
+	if week := getPeriodStarts(now, time.Sunday).Week; week.Day() != 16 {
+		t.Errorf("Sunday week starts on %v", week)
+	}
+	if quarter := getPeriodStarts(now, time.Monday).Quarter; quarter.Month() != time.July {
+		t.Errorf("quarter starts on %v", quarter)
+	}
+}
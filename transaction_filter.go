@@ -0,0 +1,347 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/lib/pq"
+)
+
+// TransactionFilter - conditions on transactions shown in reports and exports,
+// zero values mean no condition
+type TransactionFilter struct {
+	From       time.Time
+	To         time.Time
+	Categories []int32
+	MinAmount  Money
+	MaxAmount  Money
+	Search     string
+	Tags       []string
+}
+
+// TagList - tags of the filter for the form field
+func (f TransactionFilter) TagList() string {
+	return strings.Join(f.Tags, ", ")
+}
+
+// Query parameters of the filter, they are kept in links of the reports page
+var transactionFilterParameters = []string{"from", "to", "category-id", "min-amount", "max-amount", "q", "tag"}
+
+// parseTransactionFilter reads from, to, category-id, min-amount, max-amount,
+// q and tag query parameters
+func parseTransactionFilter(r *http.Request) (filter TransactionFilter, errorCode int) {
+	query := r.URL.Query()
+	var err error
+	if value := query.Get("from"); value != "" {
+		filter.From, err = time.Parse(dateLayout, value)
+		if err != nil {
+			return filter, 14
+		}
+	}
+	if value := query.Get("to"); value != "" {
+		filter.To, err = time.Parse(dateLayout, value)
+		if err != nil {
+			return filter, 14
+		}
+	}
+	for _, value := range query["category-id"] {
+		if value == "" {
+			continue
+		}
+		categoryID, err := strconv.ParseInt(value, 10, 32)
+		if err != nil {
+			return filter, 4
+		}
+		filter.Categories = append(filter.Categories, int32(categoryID))
+	}
+	if value := query.Get("min-amount"); value != "" {
+		filter.MinAmount, err = ParseMoney(value)
+		if err != nil {
+			return filter, 5
+		}
+	}
+	if value := query.Get("max-amount"); value != "" {
+		filter.MaxAmount, err = ParseMoney(value)
+		if err != nil {
+			return filter, 5
+		}
+	}
+	filter.Search = strings.TrimSpace(query.Get("q"))
+	filter.Tags = parseTags(strings.Join(query["tag"], ","))
+	return filter, 0
+}
+
+// where returns the conditions of the filter on transactions t to be appended
+// to a WHERE clause, the values are appended to args
+func (f TransactionFilter) where(args []interface{}) (string, []interface{}) {
+	var conditions strings.Builder
+	add := func(condition string, value interface{}) {
+		args = append(args, value)
+		conditions.WriteString(" AND ")
+		conditions.WriteString(strings.Replace(condition, "?", "$"+strconv.Itoa(len(args)), -1))
+	}
+	if !f.From.IsZero() {
+		add("t.date >= ?::date", f.From.Format(dateLayout))
+	}
+	if !f.To.IsZero() {
+		add("t.date <= ?::date", f.To.Format(dateLayout))
+	}
+	if len(f.Categories) > 0 {
+		categories := make([]int64, len(f.Categories))
+		for i, category := range f.Categories {
+			categories[i] = int64(category)
+		}
+		// Subcategories of the selected categories are matched too, a split
+		// transaction is matched by any of its lines
+		selected := "(WITH RECURSIVE selected(id) AS (" +
+			"SELECT id FROM categories WHERE id = ANY(?::integer[]) " +
+			"UNION SELECT c.id FROM categories c JOIN selected s ON c.parent = s.id" +
+			") SELECT id FROM selected)"
+		add("(t.category IN "+selected+" OR t.id IN "+
+			"(SELECT ts.transaction_id FROM transaction_splits ts WHERE ts.category IN "+selected+"))", pq.Array(categories))
+	}
+	if f.MinAmount > 0 {
+		add("t.amount >= ?", f.MinAmount)
+	}
+	if f.MaxAmount > 0 {
+		add("t.amount <= ?", f.MaxAmount)
+	}
+	if f.Search != "" {
+		// The expression matches the index of migration 000010
+		add("to_tsvector('russian', COALESCE(t.comment, '')) @@ plainto_tsquery('russian', ?)", f.Search)
+	}
+	if len(f.Tags) > 0 {
+		add("EXISTS (SELECT 1 FROM transaction_tags tt JOIN tags g ON tt.tag_id = g.id "+
+			"WHERE tt.transaction_id = t.id AND g.name = ANY(?::text[]))", pq.Array(f.Tags))
+	}
+	return conditions.String(), args
+}
+
+// Columns the reports page can be sorted by, the cast makes the keyset
+// parameter comparable with the column. Every expression has to select the
+// value cursorOf writes, so split transactions are sorted by the names of
+// all their categories.
+var reportSortColumns = map[string]struct{ expression, cast string }{
+	"date":     {"t.date", "date"},
+	"kind":     {"t.kind", "text"},
+	"account":  {"a.name", "text"},
+	"category": {transactionCategoryNameSQL, "text"},
+	"amount":   {"t.amount", "numeric"},
+}
+
+const defaultReportSort = "date"
+
+var errInvalidCursor = errors.New("invalid cursor")
+
+// ReportsQuery - filter, order and page of the reports page. After is the
+// cursor of the last transaction of the previous page: its id and the value
+// of the sort column.
+type ReportsQuery struct {
+	Filter     TransactionFilter
+	Sort       string
+	Descending bool
+	After      string
+	Limit      int
+}
+
+// parseReportsQuery reads the filter with sort, dir and after query parameters
+func parseReportsQuery(r *http.Request) (query ReportsQuery, errorCode int) {
+	query.Filter, errorCode = parseTransactionFilter(r)
+	if errorCode != 0 {
+		return query, errorCode
+	}
+	values := r.URL.Query()
+	query.Sort = values.Get("sort")
+	if _, ok := reportSortColumns[query.Sort]; !ok {
+		query.Sort = defaultReportSort
+	}
+	query.Descending = values.Get("dir") != "asc"
+	query.After = values.Get("after")
+	if query.After != "" {
+		if _, _, err := splitCursor(query.After); err != nil {
+			return query, 12
+		}
+	}
+	query.Limit = defaultPageLimit
+	return query, 0
+}
+
+func splitCursor(cursor string) (id int, value string, err error) {
+	parts := strings.SplitN(cursor, ":", 2)
+	if len(parts) != 2 {
+		return 0, "", errInvalidCursor
+	}
+	id, err = strconv.Atoi(parts[0])
+	if err != nil {
+		return 0, "", errInvalidCursor
+	}
+	return id, parts[1], nil
+}
+
+// cursorOf returns the cursor pointing right after the transaction
+func cursorOf(t TransactionNamed, sort string) string {
+	var value string
+	switch sort {
+	case "kind":
+		value = t.Kind
+	case "account":
+		value = t.AccountName
+	case "category":
+		value = t.CategoryName
+	case "amount":
+		value = t.Amount.String()
+	default:
+		value = t.Date.Format(dateLayout)
+	}
+	return strconv.Itoa(t.ID) + ":" + value
+}
+
+// getTransactionsPage returns one page of transactions matching the query
+// and the cursor of the next page, which is empty on the last one. Keyset
+// pagination keeps deep pages as fast as the first one.
+func getTransactionsPage(db *sqlx.DB, userID int, query ReportsQuery) (transactions []TransactionNamed, next string, err error) {
+	column := reportSortColumns[query.Sort]
+	direction, comparison := "ASC", ">"
+	if query.Descending {
+		direction, comparison = "DESC", "<"
+	}
+
+	conditions, args := query.Filter.where([]interface{}{userID})
+	if query.After != "" {
+		id, value, err := splitCursor(query.After)
+		if err != nil {
+			return nil, "", err
+		}
+		args = append(args, value, id)
+		conditions += " AND (" + column.expression + ", t.id) " + comparison +
+			" ($" + strconv.Itoa(len(args)-1) + "::" + column.cast + ", $" + strconv.Itoa(len(args)) + "::integer)"
+	}
+	args = append(args, query.Limit+1)
+
+	transactions = []TransactionNamed{}
+	err = db.Select(&transactions, `
+	SELECT t.id, t.date, t.kind, a.name AS accountname, `+transactionCategoryNameSQL+` AS categoryname,
+		t.amount, t.currency, `+convertedAmountSQL("u.base_currency")+` AS baseamount,
+		COALESCE(t.comment, '') AS comment, `+transactionTagsSQL+` AS tags
+	FROM transactions t
+	LEFT JOIN categories c
+	ON t.category = c.id
+	JOIN accounts a
+	ON t.account = a.id
+	JOIN users u
+	ON t.user_id = u.id
+	WHERE t.user_id = $1`+conditions+`
+	ORDER BY `+column.expression+` `+direction+`, t.id `+direction+`
+	LIMIT $`+strconv.Itoa(len(args)), args...)
+	if err != nil {
+		return nil, "", err
+	}
+	if len(transactions) > query.Limit {
+		transactions = transactions[:query.Limit]
+		next = cursorOf(transactions[len(transactions)-1], query.Sort)
+	}
+	return transactions, next, nil
+}
+
+// filterValues returns the query parameters of the filter from the request,
+// so links keep the filter while changing the order or the page
+func filterValues(r *http.Request) url.Values {
+	values := url.Values{}
+	query := r.URL.Query()
+	for _, name := range transactionFilterParameters {
+		for _, value := range query[name] {
+			if value != "" {
+				values.Add(name, value)
+			}
+		}
+	}
+	return values
+}
+
+// reportsURL returns the address of the reports page with the state given
+// by the raw query of the page, error code is added when it is not zero
+func reportsURL(state string, errorCode int) string {
+	values, err := url.ParseQuery(state)
+	if err != nil {
+		values = url.Values{}
+	}
+	values.Del("error")
+	values.Del("success")
+	if errorCode != 0 {
+		values.Set("error", strconv.Itoa(errorCode))
+	}
+	if len(values) == 0 {
+		return "/reports"
+	}
+	return "/reports?" + values.Encode()
+}
+
+// pageValues returns the query parameters of the filter and the order
+func (d ReportsViewData) pageValues(sort string, descending bool) url.Values {
+	values := url.Values{}
+	for name, value := range d.FilterValues {
+		values[name] = value
+	}
+	values.Set("sort", sort)
+	if !descending {
+		values.Set("dir", "asc")
+	}
+	return values
+}
+
+// SortURL - link ordering the page by the column, the order is reversed when
+// it is already used
+func (d ReportsViewData) SortURL(column string) string {
+	// Dates and amounts are mostly looked from the largest, names from A
+	descending := column == "date" || column == "amount"
+	if column == d.Query.Sort {
+		descending = !d.Query.Descending
+	}
+	return "/reports?" + d.pageValues(column, descending).Encode()
+}
+
+// SortMark - arrow shown next to the column the page is ordered by
+func (d ReportsViewData) SortMark(column string) string {
+	if column != d.Query.Sort {
+		return ""
+	}
+	if d.Query.Descending {
+		return "▼"
+	}
+	return "▲"
+}
+
+// NextURL - link to the next page, empty on the last one
+func (d ReportsViewData) NextURL() string {
+	if d.Next == "" {
+		return ""
+	}
+	values := d.pageValues(d.Query.Sort, d.Query.Descending)
+	values.Set("after", d.Next)
+	return "/reports?" + values.Encode()
+}
+
+// FirstPageURL - link to the first page with the same filter and order
+func (d ReportsViewData) FirstPageURL() string {
+	return "/reports?" + d.pageValues(d.Query.Sort, d.Query.Descending).Encode()
+}
+
+// IsCategorySelected is used by the filter form
+func (d ReportsViewData) IsCategorySelected(categoryID int) bool {
+	for _, id := range d.Query.Filter.Categories {
+		if int(id) == categoryID {
+			return true
+		}
+	}
+	return false
+}
+
+// BackURL - the reports page as it was left for the editor
+func (d ReportsEditorViewData) BackURL() string {
+	return reportsURL(d.State, 0)
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseTransactionFilter(t *testing.T) {
+	request, _ := http.NewRequest("GET", "/reports?from=2020-01-01&category-id=3&category-id=&category-id=7&min-amount=1+000,50&q=+кафе+&tag=Отпуск,+дети&tag=отпуск", nil)
+	filter, errorCode := parseTransactionFilter(request)
+	if errorCode != 0 {
+		t.Fatal(errorCode)
+	}
+	if filter.From.Format(dateLayout) != "2020-01-01" || !filter.To.IsZero() {
+		t.Errorf("unexpected dates %s %s", filter.From, filter.To)
+	}
+	if len(filter.Categories) != 2 || filter.Categories[1] != 7 {
+		t.Errorf("unexpected categories %v", filter.Categories)
+	}
+	if filter.MinAmount != 100050 || filter.MaxAmount != 0 || filter.Search != "кафе" {
+		t.Errorf("unexpected filter %+v", filter)
+	}
+	if filter.TagList() != "отпуск, дети" {
+		t.Errorf("unexpected tags %v", filter.Tags)
+	}
+
+	for query, expected := range map[string]int{"to=yesterday": 14, "category-id=food": 4, "max-amount=lots": 5} {
+		request, _ = http.NewRequest("GET", "/reports?"+query, nil)
+		if _, errorCode = parseTransactionFilter(request); errorCode != expected {
+			t.Errorf("%s: error %d, expected %d", query, errorCode, expected)
+		}
+	}
+}
+
+func TestTransactionFilterWhere(t *testing.T) {
+	filter := TransactionFilter{
+		To:         time.Date(2020, time.March, 1, 0, 0, 0, 0, time.UTC),
+		Categories: []int32{3},
+		MaxAmount:  500,
+		Search:     "кафе",
+		Tags:       []string{"отпуск"},
+	}
+	conditions, args := filter.where([]interface{}{1})
+	selected := "(WITH RECURSIVE selected(id) AS (" +
+		"SELECT id FROM categories WHERE id = ANY($3::integer[]) " +
+		"UNION SELECT c.id FROM categories c JOIN selected s ON c.parent = s.id) SELECT id FROM selected)"
+	expected := " AND t.date <= $2::date AND (t.category IN " + selected +
+		" OR t.id IN (SELECT ts.transaction_id FROM transaction_splits ts WHERE ts.category IN " + selected + "))" +
+		" AND t.amount <= $4" +
+		" AND to_tsvector('russian', COALESCE(t.comment, '')) @@ plainto_tsquery('russian', $5)" +
+		" AND EXISTS (SELECT 1 FROM transaction_tags tt JOIN tags g ON tt.tag_id = g.id " +
+		"WHERE tt.transaction_id = t.id AND g.name = ANY($6::text[]))"
+	if conditions != expected {
+		t.Errorf("conditions are %q", conditions)
+	}
+	if len(args) != 6 || args[1] != "2020-03-01" || args[4] != "кафе" {
+		t.Errorf("unexpected args %v", args)
+	}
+
+	conditions, args = TransactionFilter{}.where([]interface{}{1})
+	if conditions != "" || len(args) != 1 {
+		t.Errorf("empty filter has conditions %q", conditions)
+	}
+}
+
+func TestParseReportsQuery(t *testing.T) {
+	request, _ := http.NewRequest("GET", "/reports?sort=amount&dir=asc&after=15:12.50", nil)
+	query, errorCode := parseReportsQuery(request)
+	if errorCode != 0 || query.Sort != "amount" || query.Descending || query.After != "15:12.50" {
+		t.Errorf("unexpected query %+v %d", query, errorCode)
+	}
+	id, value, err := splitCursor(query.After)
+	if err != nil || id != 15 || value != "12.50" {
+		t.Errorf("cursor split into %d %q %v", id, value, err)
+	}
+
+	request, _ = http.NewRequest("GET", "/reports?sort=password", nil)
+	if query, _ = parseReportsQuery(request); query.Sort != defaultReportSort || !query.Descending {
+		t.Errorf("unknown column accepted %+v", query)
+	}
+	request, _ = http.NewRequest("GET", "/reports?after=last", nil)
+	if _, errorCode = parseReportsQuery(request); errorCode != 12 {
+		t.Errorf("invalid cursor accepted")
+	}
+
+	transaction := TransactionNamed{ID: 3, Date: time.Date(2020, time.May, 1, 0, 0, 0, 0, time.UTC), CategoryName: "Еда: кафе", Amount: 1250}
+	for sort, expected := range map[string]string{"date": "3:2020-05-01", "amount": "3:12.50", "category": "3:Еда: кафе"} {
+		if cursor := cursorOf(transaction, sort); cursor != expected {
+			t.Errorf("cursor by %s is %q", sort, cursor)
+		}
+	}
+}
+
+func TestCategoryCursorOfSplitTransaction(t *testing.T) {
+	// The page is sorted by the names of all the categories of the split
+	// transaction, which are also written into its cursor
+	if reportSortColumns["category"].expression != transactionCategoryNameSQL {
+		t.Fatal("category is sorted not by the selected name")
+	}
+	transactions := []TransactionNamed{
+		{ID: 4, CategoryName: "Дом"},
+		{ID: 2, CategoryName: "Еда, Транспорт"},
+		{ID: 3, CategoryName: "Еда, Транспорт"},
+		{ID: 1, CategoryName: "Кафе"},
+	}
+	// Pages of one transaction continue right after the cursor, as the
+	// keyset condition of getTransactionsPage does
+	var paged []int
+	after := ""
+	for range transactions {
+		for _, transaction := range transactions {
+			if after != "" {
+				id, value, _ := splitCursor(after)
+				if transaction.CategoryName < value || (transaction.CategoryName == value && transaction.ID <= id) {
+					continue
+				}
+			}
+			paged = append(paged, transaction.ID)
+			after = cursorOf(transaction, "category")
+			break
+		}
+	}
+	if len(paged) != 4 || paged[0] != 4 || paged[1] != 2 || paged[2] != 3 || paged[3] != 1 {
+		t.Errorf("pages are %v", paged)
+	}
+}
+
+func TestReportsURLs(t *testing.T) {
+	data := ReportsViewData{
+		Query:        ReportsQuery{Sort: "date", Descending: true},
+		FilterValues: url.Values{"q": {"кафе"}},
+		Next:         "3:2020-05-01",
+	}
+	if sortURL := data.SortURL("date"); !strings.Contains(sortURL, "dir=asc") || !strings.Contains(sortURL, "q=") {
+		t.Errorf("sorting by the same column should reverse the order: %s", sortURL)
+	}
+	if sortURL := data.SortURL("account"); !strings.Contains(sortURL, "dir=asc") || !strings.Contains(sortURL, "sort=account") {
+		t.Errorf("names should be sorted from A: %s", sortURL)
+	}
+	if nextURL := data.NextURL(); !strings.Contains(nextURL, "after=3%3A2020-05-01") || strings.Contains(nextURL, "dir=") {
+		t.Errorf("unexpected next page %s", nextURL)
+	}
+
+	if back := reportsURL("q=%D0%BA&after=3%3A2020-05-01&error=5", 4); back != "/reports?after=3%3A2020-05-01&error=4&q=%D0%BA" {
+		t.Errorf("unexpected back address %s", back)
+	}
+	if back := reportsURL("", 0); back != "/reports" {
+		t.Errorf("unexpected back address %s", back)
+	}
+}
@@ -0,0 +1,514 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"html/template"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/securecookie"
+	"rsc.io/qr"
+)
+
+// Error codes of the second factor
+const (
+	invalidCodeErrorCode      = 37
+	expiredChallengeErrorCode = 38
+	missingCodeErrorCode      = 39
+	wrongPasswordErrorCode    = 40
+)
+
+// Codes of RFC 6238 as authenticator apps make them by default: HMAC-SHA1,
+// 6 digits, a new code every 30 seconds. Codes of the neighbouring steps are
+// accepted too, clocks of phones drift.
+const (
+	totpPeriod = 30
+	totpDigits = 6
+	totpSkew   = 1
+)
+
+// totpIssuer is shown by authenticator apps next to the email
+const totpIssuer = "Эгономика"
+
+// recoveryCodesCount codes are made at once, each of them logs in one time
+const recoveryCodesCount = 10
+
+// loginChallengeLifetime is the time to enter the code after the password
+const loginChallengeLifetime = 5 * time.Minute
+
+var totpEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+var errInvalidTOTPSecret = errors.New("invalid TOTP secret")
+
+// TwoFactorState - second factor columns of users
+type TwoFactorState struct {
+	Email   string
+	Secret  string
+	Enabled bool
+}
+
+// LoginChallenge - user who entered the password and has to enter the code,
+// it is kept in a signed cookie until the second step
+type LoginChallenge struct {
+	UserID     int
+	Email      string
+	RememberMe bool
+	Expires    time.Time
+}
+
+// generateTOTPSecret returns 160 random bits in base32, the length RFC 4226
+// recommends for HMAC-SHA1
+func generateTOTPSecret() (secret string, err error) {
+	b := make([]byte, 20)
+	_, err = rand.Read(b)
+	if err != nil {
+		return "", err
+	}
+	return totpEncoding.EncodeToString(b), nil
+}
+
+func decodeTOTPSecret(secret string) ([]byte, error) {
+	key, err := totpEncoding.DecodeString(strings.ToUpper(strings.TrimRight(secret, "=")))
+	if err != nil || len(key) == 0 {
+		return nil, errInvalidTOTPSecret
+	}
+	return key, nil
+}
+
+// totpStep returns the number of the period the moment belongs to
+func totpStep(t time.Time) int64 {
+	return t.Unix() / totpPeriod
+}
+
+// totpCode returns the code of the step by RFC 4226 with the step as the
+// counter
+func totpCode(key []byte, step int64) string {
+	counter := make([]byte, 8)
+	binary.BigEndian.PutUint64(counter, uint64(step))
+	mac := hmac.New(sha1.New, key)
+	mac.Write(counter)
+	sum := mac.Sum(nil)
+	offset := sum[len(sum)-1] & 0x0f
+	value := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+	modulo := uint32(1)
+	for i := 0; i < totpDigits; i++ {
+		modulo *= 10
+	}
+	return fmt.Sprintf("%0*d", totpDigits, value%modulo)
+}
+
+// verifyTOTP returns the step of the matching code, codes of steps up to
+// lastStep were used already and do not match
+func verifyTOTP(secret string, code string, t time.Time, lastStep int64) (step int64, ok bool) {
+	key, err := decodeTOTPSecret(secret)
+	if err != nil || len(code) != totpDigits {
+		return 0, false
+	}
+	current := totpStep(t)
+	for s := current - totpSkew; s <= current+totpSkew; s++ {
+		if s > lastStep && subtle.ConstantTimeCompare([]byte(totpCode(key, s)), []byte(code)) == 1 {
+			return s, true
+		}
+	}
+	return 0, false
+}
+
+// totpURI is the key URI format of authenticator apps, the QR code of the
+// setup carries it
+func totpURI(secret string, email string) string {
+	query := url.Values{}
+	query.Set("secret", secret)
+	query.Set("issuer", totpIssuer)
+	query.Set("algorithm", "SHA1")
+	query.Set("digits", strconv.Itoa(totpDigits))
+	query.Set("period", strconv.Itoa(totpPeriod))
+	return "otpauth://totp/" + url.PathEscape(totpIssuer+":"+email) + "?" + query.Encode()
+}
+
+// qrCodeImage renders the text as a PNG QR code embedded into the page, so
+// the secret does not leave the server
+func qrCodeImage(text string) (template.URL, error) {
+	code, err := qr.Encode(text, qr.M)
+	if err != nil {
+		return "", err
+	}
+	code.Scale = 4
+	return template.URL("data:image/png;base64," + base64.StdEncoding.EncodeToString(code.PNG())), nil
+}
+
+// normalizeCode drops separators users copy with codes, recovery codes are
+// case insensitive
+func normalizeCode(code string) string {
+	return strings.Map(func(r rune) rune {
+		if r == ' ' || r == '-' {
+			return -1
+		}
+		return r
+	}, strings.ToLower(strings.TrimSpace(code)))
+}
+
+// generateRecoveryCodes returns codes of 10 base32 characters split in two
+// for reading
+func generateRecoveryCodes() (codes []string, err error) {
+	codes = make([]string, 0, recoveryCodesCount)
+	for i := 0; i < recoveryCodesCount; i++ {
+		b := make([]byte, 10)
+		_, err = rand.Read(b)
+		if err != nil {
+			return nil, err
+		}
+		code := strings.ToLower(totpEncoding.EncodeToString(b))[:10]
+		codes = append(codes, code[:5]+"-"+code[5:])
+	}
+	return codes, nil
+}
+
+func getTwoFactorState(userID int) (state TwoFactorState, err error) {
+	err = database.QueryRowx(
+		"SELECT email, COALESCE(totp_secret, '') AS secret, totp_enabled AS enabled FROM users WHERE id = $1", userID,
+	).StructScan(&state)
+	return state, err
+}
+
+func countRecoveryCodes(userID int) (count int, err error) {
+	err = database.QueryRowx(
+		"SELECT COUNT(*) FROM recovery_codes WHERE user_id = $1 AND used IS NULL", userID,
+	).Scan(&count)
+	return count, err
+}
+
+// replaceRecoveryCodes makes new codes of the user, the old ones stop working
+func replaceRecoveryCodes(userID int) (codes []string, err error) {
+	codes, err = generateRecoveryCodes()
+	if err != nil {
+		return nil, err
+	}
+	tx, err := database.Beginx()
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if err != nil {
+			tx.Rollback()
+		}
+	}()
+
+	_, err = tx.Exec("DELETE FROM recovery_codes WHERE user_id = $1", userID)
+	if err != nil {
+		return nil, err
+	}
+	for _, code := range codes {
+		_, err = tx.Exec(
+			"INSERT INTO recovery_codes(user_id, code_hash) VALUES ($1, $2::bytea)",
+			userID, hashToken(normalizeCode(code)),
+		)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return codes, tx.Commit()
+}
+
+// useRecoveryCode marks the code used, it matches only once
+func useRecoveryCode(userID int, code string) bool {
+	result, err := database.Exec(
+		"UPDATE recovery_codes SET used = NOW() WHERE user_id = $1 AND code_hash = $2::bytea AND used IS NULL",
+		userID, hashToken(normalizeCode(code)),
+	)
+	if err != nil {
+		log.Println("Using recovery code failed", err)
+		return false
+	}
+	affected, _ := result.RowsAffected()
+	return affected == 1
+}
+
+// useTOTPCode checks the code of the enabled second factor, the step of the
+// code is stored so the code can not be replayed
+func useTOTPCode(userID int, code string) bool {
+	var (
+		secret   string
+		lastStep int64
+	)
+	err := database.QueryRowx(
+		"SELECT totp_secret, totp_last_step FROM users WHERE id = $1 AND totp_enabled", userID,
+	).Scan(&secret, &lastStep)
+	if err != nil {
+		log.Println("Query TOTP secret failed", err)
+		return false
+	}
+	step, ok := verifyTOTP(secret, code, time.Now(), lastStep)
+	if !ok {
+		return false
+	}
+	// Two requests with the same code can pass the check above, only one
+	// of them moves the step
+	result, err := database.Exec(
+		"UPDATE users SET totp_last_step = $1 WHERE id = $2 AND totp_last_step < $1", step, userID,
+	)
+	if err != nil {
+		log.Println("Updating TOTP step failed", err)
+		return false
+	}
+	affected, _ := result.RowsAffected()
+	return affected == 1
+}
+
+// checkSecondFactor accepts a code of the authenticator app or an unused
+// recovery code
+func checkSecondFactor(userID int, code string) bool {
+	code = normalizeCode(code)
+	if len(code) == totpDigits {
+		return useTOTPCode(userID, code)
+	}
+	return useRecoveryCode(userID, code)
+}
+
+// authenticateSecondFactor checks the code unless logins are locked and
+// records the attempt, wrong codes are counted as failed logins
+func authenticateSecondFactor(r *http.Request, email string, userID int, code string) (errorCode int) {
+	if isLoginLocked(email, clientIP(r)) {
+		return lockedErrorCode
+	}
+	ok := checkSecondFactor(userID, code)
+	if recordLoginAttempt(r, email, userID, ok) != nil {
+		return 6
+	}
+	if !ok {
+		return invalidCodeErrorCode
+	}
+	return 0
+}
+
+// setLoginChallenge remembers the user between the password and the code,
+// no session is opened until the code is checked
+func setLoginChallenge(w http.ResponseWriter, r *http.Request, dbUser User, rememberMe bool) error {
+	challenge := LoginChallenge{
+		UserID:     dbUser.ID,
+		Email:      dbUser.Email,
+		RememberMe: rememberMe,
+		Expires:    time.Now().Add(loginChallengeLifetime),
+	}
+	encoded, err := securecookie.EncodeMulti("login-challenge", challenge, cookieCodecs...)
+	if err != nil {
+		return err
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:     "login-challenge",
+		Value:    encoded,
+		Path:     "/login",
+		MaxAge:   int(loginChallengeLifetime.Seconds()),
+		HttpOnly: true,
+		Secure:   isSecureRequest(r),
+		SameSite: http.SameSiteLaxMode,
+	})
+	return nil
+}
+
+// getLoginChallenge returns the challenge of the request unless it is missing,
+// forged or expired
+func getLoginChallenge(r *http.Request) (challenge LoginChallenge, ok bool) {
+	cookie, err := r.Cookie("login-challenge")
+	if err != nil {
+		return challenge, false
+	}
+	err = securecookie.DecodeMulti("login-challenge", cookie.Value, &challenge, cookieCodecs...)
+	if err != nil {
+		log.Println("Invalid login challenge", err)
+		return challenge, false
+	}
+	return challenge, challenge.UserID != 0 && time.Now().Before(challenge.Expires)
+}
+
+func clearLoginChallenge(w http.ResponseWriter, r *http.Request) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     "login-challenge",
+		Value:    "",
+		Path:     "/login",
+		MaxAge:   -1,
+		HttpOnly: true,
+		Secure:   isSecureRequest(r),
+		SameSite: http.SameSiteLaxMode,
+	})
+}
+
+// loginSecondFactor is the second step of login for users with the second
+// factor, the session is opened only after a valid code
+func loginSecondFactor(w http.ResponseWriter, r *http.Request) {
+	challenge, ok := getLoginChallenge(r)
+	if !ok {
+		clearLoginChallenge(w, r)
+		http.Redirect(w, r, "/login?error="+strconv.Itoa(expiredChallengeErrorCode), 302)
+		return
+	}
+
+	if r.Method == "POST" {
+		err := r.ParseForm()
+		if err != nil {
+			log.Println(err)
+		}
+
+		errorCode := authenticateSecondFactor(r, challenge.Email, challenge.UserID, r.FormValue("code"))
+		switch errorCode {
+		case 0:
+			log.Println("User logged in with second factor", challenge.Email)
+			clearLoginChallenge(w, r)
+			setCookie(w, r, challenge.UserID, challenge.RememberMe)
+			http.Redirect(w, r, "/", 302)
+		case lockedErrorCode:
+			clearLoginChallenge(w, r)
+			http.Redirect(w, r, "/login?error="+strconv.Itoa(errorCode), 302)
+		default:
+			log.Println("Invalid second factor code", challenge.Email)
+			http.Redirect(w, r, "/login/two_factor?error="+strconv.Itoa(errorCode), 302)
+		}
+		return
+	}
+
+	data := ViewData{
+		Title:            "Вход",
+		ErrorDescription: allErrors[getErrorCode(r)],
+	}
+	tmpl, err := template.ParseFiles("templates/layout.html", "templates/login_two_factor.html", "templates/navigation_logedout.html")
+	if err != nil {
+		log.Println(err)
+	}
+	renderLayout(w, r, tmpl, &data)
+}
+
+// startTwoFactorSetup stores a new secret, the settings page shows it until
+// a code confirms the app got it
+func startTwoFactorSetup(w http.ResponseWriter, r *http.Request, userID int) {
+	secret, err := generateTOTPSecret()
+	if err != nil {
+		log.Println(err)
+		http.Redirect(w, r, "/settings?error=9", 302)
+		return
+	}
+	_, err = database.Exec(
+		"UPDATE users SET totp_secret = $1, totp_last_step = 0 WHERE id = $2 AND NOT totp_enabled", secret, userID,
+	)
+	if err != nil {
+		log.Println("Storing TOTP secret failed", err)
+		http.Redirect(w, r, "/settings?error=9", 302)
+		return
+	}
+	http.Redirect(w, r, "/settings#two-factor", 302)
+}
+
+// enableTwoFactor turns the second factor on after the first valid code and
+// shows recovery codes once
+func enableTwoFactor(w http.ResponseWriter, r *http.Request, userID int) {
+	err := r.ParseForm()
+	if err != nil {
+		log.Println(err)
+	}
+	state, err := getTwoFactorState(userID)
+	if err != nil || state.Secret == "" || state.Enabled {
+		log.Println("No second factor setup", err)
+		http.Redirect(w, r, "/settings?error=9", 302)
+		return
+	}
+	step, ok := verifyTOTP(state.Secret, normalizeCode(r.FormValue("code")), time.Now(), 0)
+	if !ok {
+		http.Redirect(w, r, "/settings?error="+strconv.Itoa(invalidCodeErrorCode)+"#two-factor", 302)
+		return
+	}
+
+	codes, err := replaceRecoveryCodes(userID)
+	if err != nil {
+		log.Println("Creating recovery codes failed", err)
+		http.Redirect(w, r, "/settings?error=6", 302)
+		return
+	}
+	_, err = database.Exec(
+		"UPDATE users SET totp_enabled = true, totp_last_step = $1 WHERE id = $2 AND totp_secret = $3",
+		step, userID, state.Secret,
+	)
+	if err != nil {
+		log.Println("Enabling second factor failed", err)
+		http.Redirect(w, r, "/settings?error=6", 302)
+		return
+	}
+	log.Println("Second factor enabled", state.Email)
+	renderSettings(w, r, userID, SettingsViewData{
+		NewRecoveryCodes:   codes,
+		SuccessDescription: allNotifications[7],
+	})
+}
+
+// regenerateRecoveryCodes replaces codes of the user, for example when most
+// of them are used or the list was lost
+func regenerateRecoveryCodes(w http.ResponseWriter, r *http.Request, userID int) {
+	state, err := getTwoFactorState(userID)
+	if err != nil || !state.Enabled {
+		log.Println("Second factor is not enabled", err)
+		http.Redirect(w, r, "/settings?error=9", 302)
+		return
+	}
+	codes, err := replaceRecoveryCodes(userID)
+	if err != nil {
+		log.Println("Creating recovery codes failed", err)
+		http.Redirect(w, r, "/settings?error=6", 302)
+		return
+	}
+	renderSettings(w, r, userID, SettingsViewData{
+		NewRecoveryCodes:   codes,
+		SuccessDescription: allNotifications[8],
+	})
+}
+
+// disableTwoFactor turns the second factor off, a stolen session is not
+// enough for it, so the current password is required
+func disableTwoFactor(w http.ResponseWriter, r *http.Request, userID int) {
+	err := r.ParseForm()
+	if err != nil {
+		log.Println(err)
+	}
+	var dbUser User
+	err = database.QueryRowx("SELECT "+userPasswordColumns+" FROM users WHERE id = $1", userID).StructScan(&dbUser)
+	if err != nil {
+		log.Println("Query failed", err)
+	}
+	if !passwordMatches(dbUser, r.FormValue("password")) {
+		log.Println("Invalid password", dbUser.Email)
+		http.Redirect(w, r, "/settings?error="+strconv.Itoa(wrongPasswordErrorCode)+"#two-factor", 302)
+		return
+	}
+
+	tx, err := database.Beginx()
+	if err != nil {
+		log.Println(err)
+		http.Redirect(w, r, "/settings?error=6", 302)
+		return
+	}
+	defer tx.Rollback()
+	_, err = tx.Exec("DELETE FROM recovery_codes WHERE user_id = $1", userID)
+	if err == nil {
+		_, err = tx.Exec(
+			"UPDATE users SET totp_enabled = false, totp_secret = NULL, totp_last_step = 0 WHERE id = $1", userID,
+		)
+	}
+	if err == nil {
+		err = tx.Commit()
+	}
+	if err != nil {
+		log.Println("Disabling second factor failed", err)
+		http.Redirect(w, r, "/settings?error=6", 302)
+		return
+	}
+	log.Println("Second factor disabled", dbUser.Email)
+	http.Redirect(w, r, "/settings?success=9", 302)
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"encoding/base32"
+	"strings"
+	"testing"
+	"time"
+)
+
+// rfc6238Secret is the SHA1 key of the test vectors of RFC 6238
+var rfc6238Secret = base32.StdEncoding.EncodeToString([]byte("12345678901234567890"))
+
+func TestTOTPCode(t *testing.T) {
+	key, err := decodeTOTPSecret(rfc6238Secret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The RFC lists 8 digit codes, the 6 digit ones are their endings
+	cases := []struct {
+		unix     int64
+		expected string
+	}{
+		{59, "287082"},
+		{1111111109, "081804"},
+		{1111111111, "050471"},
+		{1234567890, "005924"},
+		{2000000000, "279037"},
+		{20000000000, "353130"},
+	}
+	for _, c := range cases {
+		if code := totpCode(key, totpStep(time.Unix(c.unix, 0))); code != c.expected {
+			t.Errorf("%d: code %s, expected %s", c.unix, code, c.expected)
+		}
+	}
+}
+
+func TestVerifyTOTP(t *testing.T) {
+	now := time.Unix(1111111111, 0)
+	key, _ := decodeTOTPSecret(rfc6238Secret)
+	current := totpStep(now)
+
+	if step, ok := verifyTOTP(rfc6238Secret, totpCode(key, current-1), now, 0); !ok || step != current-1 {
+		t.Errorf("code of the previous step is rejected")
+	}
+	if _, ok := verifyTOTP(rfc6238Secret, totpCode(key, current+2), now, 0); ok {
+		t.Errorf("code of a distant step is accepted")
+	}
+	if _, ok := verifyTOTP(rfc6238Secret, totpCode(key, current), now, current); ok {
+		t.Errorf("used code is accepted again")
+	}
+	if _, ok := verifyTOTP("not base32!", "050471", now, 0); ok {
+		t.Errorf("code of an invalid secret is accepted")
+	}
+}
+
+func TestRecoveryCodes(t *testing.T) {
+	codes, err := generateRecoveryCodes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(codes) != recoveryCodesCount {
+		t.Fatalf("%d codes, expected %d", len(codes), recoveryCodesCount)
+	}
+	seen := map[string]bool{}
+	for _, code := range codes {
+		if len(code) != 11 || code[5] != '-' {
+			t.Errorf("unexpected format of %s", code)
+		}
+		if seen[code] {
+			t.Errorf("code %s is repeated", code)
+		}
+		seen[code] = true
+	}
+	if normalizeCode(" "+strings.ToUpper(codes[0])+" ") != normalizeCode(strings.Replace(codes[0], "-", "", 1)) {
+		t.Errorf("typed forms of %s differ", codes[0])
+	}
+}
+
+func TestTOTPURI(t *testing.T) {
+	uri := totpURI("JBSWY3DPEHPK3PXP", "user@example.com")
+	if !strings.HasPrefix(uri, "otpauth://totp/") || !strings.Contains(uri, "secret=JBSWY3DPEHPK3PXP") {
+		t.Errorf("unexpected URI %s", uri)
+	}
+	image, err := qrCodeImage(uri)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(string(image), "data:image/png;base64,") {
+		t.Errorf("unexpected image %.40s", image)
+	}
+}
@@ -1,11 +1,8 @@
 package main
 
 import (
-	"bytes"
-	"crypto/sha256"
 	"html/template"
 	"log"
-	"math/rand"
 	"net/http"
 	"strconv"
 	"strings"
@@ -17,32 +14,59 @@ import (
 
 // User - element of corresponding table
 type User struct {
-	ID    int
-	Email string
-	Sha   []byte
-	Salt  string
+	ID           int
+	Email        string
+	Sha          []byte
+	Salt         string
+	PasswordHash string
+	HashVersion  int
+	TOTPEnabled  bool
 }
 
+// userPasswordColumns are selected into User, legacy and new hashes are read
+// together, so the user is verified with the stored version, and the flag of
+// the second factor tells whether the password is enough to log in
+const userPasswordColumns = `id, email, sha, COALESCE(salt, '') AS salt,
+	COALESCE(password_hash, '') AS passwordhash, hash_version AS hashversion,
+	totp_enabled AS totpenabled`
+
 // Session - element of corresponding table
 type Session struct {
+	ID        int
 	Initiated time.Time
+	Expires   time.Time
 	UserID    int
 	IP        string
 	UserAgent string
-	Token     string
 }
 
+// sessionColumns are selected into Session, expired sessions are not listed
+const sessionColumns = `id, initiated, expires, user_id AS userid,
+	COALESCE(ip, '') AS ip, COALESCE(user_agent, '') AS useragent`
+
 // ViewData - information to display on page
 type ViewData struct {
+	LayoutData
 	Title            string
 	ErrorDescription string
 }
 
 // SettingsViewData - information to display on page
 type SettingsViewData struct {
+	LayoutData
 	Title              string
 	Sessions           []Session
-	CurrentSessionID   string
+	CurrentSessionID   int
+	WeekStart          int
+	BaseCurrency       string
+	APITokens          []APIToken
+	NewAPIToken        string
+	FailedLogins       []LoginAttempt
+	TwoFactorEnabled   bool
+	TwoFactorSecret    string
+	TwoFactorQRCode    template.URL
+	RecoveryCodesLeft  int
+	NewRecoveryCodes   []string
 	ErrorDescription   string
 	SuccessDescription string
 }
@@ -57,20 +81,23 @@ func login(w http.ResponseWriter, r *http.Request) {
 		email := strings.ToLower(r.FormValue("user-email"))
 		password := r.FormValue("user-password")
 		rememberMe := r.FormValue("remember-me") == "on"
-		var dbUser User
-		err = database.QueryRowx("select id, email, sha, salt from users where email = $1", email).StructScan(&dbUser)
-		if err != nil {
-			log.Println(err)
-		}
-
-		sha := sha256.Sum256([]byte(password + dbUser.Salt))
-		if bytes.Compare(sha[:], dbUser.Sha) == 0 {
+		dbUser, errorCode := authenticate(r, email, password)
+		if errorCode == 0 && dbUser.TOTPEnabled {
+			log.Println("Password accepted, code required", email)
+			err = setLoginChallenge(w, r, dbUser, rememberMe)
+			if err != nil {
+				log.Println(err)
+				http.Redirect(w, r, "/login?error=6", 302)
+				return
+			}
+			http.Redirect(w, r, "/login/two_factor", 302)
+		} else if errorCode == 0 {
 			log.Println("User logged in", email)
-			setCookie(dbUser.ID, r.RemoteAddr, r.Header.Get("User-Agent"), rememberMe, w)
+			setCookie(w, r, dbUser.ID, rememberMe)
 			http.Redirect(w, r, "/", 302)
 		} else {
-			log.Println("Invalid password", email)
-			http.Redirect(w, r, "/login?error=2", 302)
+			log.Println("Login failed", email)
+			http.Redirect(w, r, "/login?error="+strconv.Itoa(errorCode), 302)
 		}
 	} else {
 		userID := getUserID(r)
@@ -95,7 +122,7 @@ func login(w http.ResponseWriter, r *http.Request) {
 			if err != nil {
 				log.Println(err)
 			}
-			tmpl.ExecuteTemplate(w, "layout", data)
+			renderLayout(w, r, tmpl, &data)
 		}
 	}
 }
@@ -109,18 +136,30 @@ func signup(w http.ResponseWriter, r *http.Request) {
 
 		email := strings.ToLower(r.FormValue("user-email"))
 		password := r.FormValue("user-password")
-		salt := stringWithCharset(saltLength, saltCharset)
-		sha := sha256.Sum256([]byte(password + salt))
+		hash, err := hashPassword(password)
+		if err != nil {
+			log.Println("Hashing password failed", err)
+			http.Redirect(w, r, "/login?error=8", 302)
+			return
+		}
 
-		_, err = database.Exec(
-			"INSERT INTO users(email, sha, salt) VALUES ($1, $2::bytea, $3)",
-			email, sha[:], salt,
-		)
+		var userID int
+		err = database.QueryRowx(
+			"INSERT INTO users(email, password_hash, hash_version) VALUES ($1, $2, $3) RETURNING id",
+			email, hash, hashVersionArgon2id,
+		).Scan(&userID)
 		if err != nil {
 			log.Println(err)
 			http.Redirect(w, r, "/login?error=8", 302)
 			return
 		}
+		_, err = database.Exec(
+			"INSERT INTO accounts(name, currency, user_id) VALUES ($1, $2, $3)",
+			"Основной", defaultCurrency, userID,
+		)
+		if err != nil {
+			log.Println("Creating default account failed", err)
+		}
 		log.Println("New user signed up", email)
 		http.Redirect(w, r, "/login", 302)
 	} else {
@@ -132,13 +171,46 @@ func signup(w http.ResponseWriter, r *http.Request) {
 				Title: "Регистрация",
 			}
 			tmpl, _ := template.ParseFiles("templates/layout.html", "templates/signup.html", "templates/navigation_logedout.html")
-			tmpl.ExecuteTemplate(w, "layout", data)
+			renderLayout(w, r, tmpl, &data)
+		}
+	}
+}
+
+// dummyPasswordHash is checked for unknown emails, so they take as long as
+// wrong passwords
+var dummyPasswordHash, _ = hashPassword("")
+
+func checkPassword(email string, password string) (dbUser User, ok bool) {
+	err := database.QueryRowx("SELECT "+userPasswordColumns+" FROM users WHERE email = $1", email).StructScan(&dbUser)
+	if err != nil {
+		log.Println(err)
+		passwordMatches(User{HashVersion: hashVersionArgon2id, PasswordHash: dummyPasswordHash}, password)
+		return dbUser, false
+	}
+
+	if !passwordMatches(dbUser, password) {
+		return dbUser, false
+	}
+	// The password is known only now, so legacy hashes are upgraded on login
+	if needsRehash(dbUser) {
+		err = setUserPassword(dbUser.ID, password)
+		if err != nil {
+			log.Println("Rehashing password failed", err)
+		} else {
+			log.Println("Password rehashed", dbUser.Email)
 		}
 	}
+	return dbUser, true
 }
 
 func logout(w http.ResponseWriter, r *http.Request) {
-	clearCookie(w)
+	if token := getSessionToken(r); token != "" {
+		_, err := database.Exec("DELETE FROM sessions WHERE token_hash = $1::bytea", hashToken(token))
+		if err != nil {
+			log.Println(err)
+		}
+	}
+	clearCookie(w, r)
 	http.Redirect(w, r, "/login", 302)
 }
 
@@ -164,7 +236,16 @@ func settingsView(w http.ResponseWriter, r *http.Request, userID int) {
 		}
 	}
 
-	rows, err := database.Queryx("SELECT initiated AS Initiated, user_id AS UserID, ip AS IP, user_agent AS UserAgent, token AS Token FROM sessions WHERE user_id = $1 ORDER BY initiated", userID)
+	renderSettings(w, r, userID, SettingsViewData{
+		ErrorDescription:   allErrors[int(errorCode)],
+		SuccessDescription: allNotifications[int(successCode)],
+	})
+}
+
+// renderSettings fills the page data with the user's settings and renders it,
+// the caller supplies only messages and one-time values
+func renderSettings(w http.ResponseWriter, r *http.Request, userID int, data SettingsViewData) {
+	rows, err := database.Queryx("SELECT "+sessionColumns+" FROM sessions WHERE user_id = $1 AND expires > NOW() ORDER BY initiated", userID)
 	if err != nil {
 		log.Fatal("Query sessions failed", err)
 	}
@@ -185,26 +266,59 @@ func settingsView(w http.ResponseWriter, r *http.Request, userID int) {
 		log.Fatal(err)
 	}
 
-	var currentSessionID string
-	cookie, err := r.Cookie("cookie")
-	if err == nil {
-		currentSessionID = cookie.Value
-	} else {
-		log.Println("No cookie")
+	currentSessionID := getSessionID(r)
+
+	weekStart, err := getUserWeekStart(database, userID)
+	if err != nil {
+		log.Println("Query week start failed", err)
 	}
 
-	data := SettingsViewData{
-		Title:              "Настройки",
-		Sessions:           sessions,
-		CurrentSessionID:   currentSessionID,
-		ErrorDescription:   allErrors[int(errorCode)],
-		SuccessDescription: allNotifications[int(successCode)],
+	baseCurrency, err := getUserBaseCurrency(database, userID)
+	if err != nil {
+		log.Println("Query base currency failed", err)
+	}
+
+	apiTokens, err := getAllAPITokensOfUser(userID)
+	if err != nil {
+		log.Println("Query API tokens failed", err)
+	}
+
+	failedLogins, err := getFailedLoginAttempts(userID)
+	if err != nil {
+		log.Println("Query login attempts failed", err)
+	}
+
+	twoFactor, err := getTwoFactorState(userID)
+	if err != nil {
+		log.Println("Query second factor failed", err)
 	}
+	if twoFactor.Enabled {
+		data.RecoveryCodesLeft, err = countRecoveryCodes(userID)
+		if err != nil {
+			log.Println("Query recovery codes failed", err)
+		}
+	} else if twoFactor.Secret != "" {
+		// The setup is not confirmed yet, the secret is shown to scan it
+		data.TwoFactorSecret = twoFactor.Secret
+		data.TwoFactorQRCode, err = qrCodeImage(totpURI(twoFactor.Secret, twoFactor.Email))
+		if err != nil {
+			log.Println("Rendering QR code failed", err)
+		}
+	}
+
+	data.Title = "Настройки"
+	data.Sessions = sessions
+	data.CurrentSessionID = currentSessionID
+	data.WeekStart = int(weekStart)
+	data.BaseCurrency = baseCurrency
+	data.APITokens = apiTokens
+	data.FailedLogins = failedLogins
+	data.TwoFactorEnabled = twoFactor.Enabled
 	tmpl, err := template.ParseFiles("templates/layout.html", "templates/settings.html", "templates/navigation_logedin.html")
 	if err != nil {
 		log.Println(err)
 	}
-	tmpl.ExecuteTemplate(w, "layout", data)
+	renderLayout(w, r, tmpl, &data)
 }
 
 func changePassword(w http.ResponseWriter, r *http.Request, userID int) {
@@ -219,23 +333,18 @@ func changePassword(w http.ResponseWriter, r *http.Request, userID int) {
 	newPassword := r.FormValue("new-password")
 
 	var dbUser User
-	err = database.QueryRowx("select id, email, sha, salt from users where id = $1", userID).StructScan(&dbUser)
+	err = database.QueryRowx("SELECT "+userPasswordColumns+" FROM users WHERE id = $1", userID).StructScan(&dbUser)
 	if err != nil {
 		log.Println("Query failed", err)
 	}
 
-	sha := sha256.Sum256([]byte(oldPassword + dbUser.Salt))
-	if bytes.Compare(sha[:], dbUser.Sha) != 0 {
+	if !passwordMatches(dbUser, oldPassword) {
 		log.Println("Invalid password", dbUser.Email)
 		http.Redirect(w, r, "/settings?error=7", 302)
 		return
 	}
 
-	sha = sha256.Sum256([]byte(newPassword + dbUser.Salt))
-	_, err = database.Exec(
-		"UPDATE users SET sha = $1::bytea WHERE id = $2",
-		sha[:], userID,
-	)
+	err = setUserPassword(userID, newPassword)
 	if err != nil {
 		log.Println("Updating failed", err)
 		http.Redirect(w, r, "/settings?error=7", 302)
@@ -250,105 +359,115 @@ func terminateSession(w http.ResponseWriter, r *http.Request, userID int) {
 	if err != nil {
 		log.Println(err)
 	}
-	token := r.FormValue("token")
+	sessionID := r.FormValue("session-id")
 
-	var sessionUserID int
-	err = database.QueryRowx("select user_id FROM sessions where token = $1", token).Scan(&sessionUserID)
+	log.Println("Terminate session")
+	_, err = database.Exec(
+		"DELETE FROM sessions WHERE id = $1 AND user_id = $2",
+		sessionID, userID,
+	)
 	if err != nil {
-		log.Println("Query failed", err)
-	}
-
-	if userID == sessionUserID {
-		log.Println("Terminate session")
-		_, err = database.Exec(
-			"DELETE FROM sessions WHERE token = $1 AND user_id = $2",
-			token, userID,
-		)
-		if err != nil {
-			log.Println(err)
-		}
-	} else {
-		log.Println("Wrong user")
+		log.Println(err)
 	}
 	http.Redirect(w, r, "/settings", 302)
 }
 
-func setCookie(userID int, ip string, userAgent string, rememberMe bool, response http.ResponseWriter) {
-	value := map[string]int{
-		"name": userID,
-	}
-
-	// sessionToken := uuid.NewV4().String()
-	encoded, err := cookieHandler.Encode("cookie", value)
-	if err == nil {
-		var cookie *http.Cookie
-		if rememberMe {
-			cookie = &http.Cookie{
-				Name:    "cookie",
-				Value:   encoded,
-				Path:    "/",
-				Expires: time.Now().Add(365 * 24 * time.Hour),
-			}
-		} else {
-			cookie = &http.Cookie{
-				Name:  "cookie",
-				Value: encoded,
-				Path:  "/",
-			}
-		}
-		if len(userAgent) > 256 {
-			userAgent = userAgent[:256]
-		}
-		if len(ip) > 128 {
-			ip = ip[:128]
-		}
-		_, err = database.Exec(
-			"INSERT INTO sessions(initiated, user_id, ip, user_agent, token) VALUES (NOW(), $1, $2, $3, $4)",
-			userID, ip, userAgent, encoded,
-		)
-		if err != nil {
-			log.Println(err)
-		}
-		http.SetCookie(response, cookie)
+func changeWeekStart(w http.ResponseWriter, r *http.Request, userID int) {
+	err := r.ParseForm()
+	if err != nil {
+		log.Println("Form parse failed", err)
+		http.Redirect(w, r, "/settings?error=9", 302)
+		return
 	}
+	weekStart, err := strconv.ParseInt(r.FormValue("week-start"), 10, 32)
+	if err != nil || weekStart < 0 || weekStart > 6 {
+		log.Println("Invalid week start", r.FormValue("week-start"))
+		http.Redirect(w, r, "/settings?error=9", 302)
+		return
+	}
+
+	_, err = database.Exec(
+		"UPDATE users SET week_start = $1 WHERE id = $2",
+		weekStart, userID,
+	)
+	if err != nil {
+		log.Println("Updating failed", err)
+		http.Redirect(w, r, "/settings?error=9", 302)
+		return
+	}
+	http.Redirect(w, r, "/settings?success=2", 302)
 }
 
-func clearCookie(response http.ResponseWriter) {
+// setCookie opens a new session, the returned cookie value and the token of
+// its forms are empty when it fails
+func setCookie(w http.ResponseWriter, r *http.Request, userID int, rememberMe bool) (encoded string, csrf string) {
+	token, err := generateSessionToken()
+	if err != nil {
+		log.Println(err)
+		return "", ""
+	}
+	encoded, err = securecookie.EncodeMulti("cookie", token, cookieCodecs...)
+	if err != nil {
+		log.Println(err)
+		return "", ""
+	}
+
+	lifetime := sessionLifetime
 	cookie := &http.Cookie{
-		Name:   "cookie",
-		Value:  "",
-		Path:   "/",
-		MaxAge: -1,
+		Name:     "cookie",
+		Value:    encoded,
+		Path:     "/",
+		HttpOnly: true,
+		Secure:   isSecureRequest(r),
+		SameSite: http.SameSiteLaxMode,
+	}
+	if rememberMe {
+		lifetime = rememberedSessionLifetime
+		cookie.Expires = time.Now().Add(lifetime)
+	}
+	ip := truncateText(clientIP(r), 128)
+	userAgent := truncateText(r.Header.Get("User-Agent"), 256)
+	// Expired sessions of the user are cleaned up on every login
+	_, err = database.Exec("DELETE FROM sessions WHERE user_id = $1 AND expires <= NOW()", userID)
+	if err != nil {
+		log.Println(err)
+	}
+	_, err = database.Exec(
+		"INSERT INTO sessions(initiated, expires, user_id, ip, user_agent, token_hash) VALUES (NOW(), NOW() + $1 * interval '1 second', $2, $3, $4, $5::bytea)",
+		int64(lifetime.Seconds()), userID, ip, userAgent, hashToken(token),
+	)
+	if err != nil {
+		log.Println(err)
+		return "", ""
 	}
-	http.SetCookie(response, cookie)
+	http.SetCookie(w, cookie)
+	return encoded, csrfToken(token)
 }
 
-var cookieHandler = securecookie.New(
-	securecookie.GenerateRandomKey(64),
-	securecookie.GenerateRandomKey(32))
+func clearCookie(w http.ResponseWriter, r *http.Request) {
+	cookie := &http.Cookie{
+		Name:     "cookie",
+		Value:    "",
+		Path:     "/",
+		MaxAge:   -1,
+		HttpOnly: true,
+		Secure:   isSecureRequest(r),
+		SameSite: http.SameSiteLaxMode,
+	}
+	http.SetCookie(w, cookie)
+}
 
+// getUserID returns the user of the session cookie, API tokens are accepted
+// only by apiLoginRequired
 func getUserID(r *http.Request) (userID int) {
-	cookie, err := r.Cookie("cookie")
-	if err == nil {
-		err = database.QueryRowx("select user_id FROM sessions where token = $1", cookie.Value).Scan(&userID)
+	token := getSessionToken(r)
+	if token != "" {
+		err := database.QueryRowx(
+			"SELECT user_id FROM sessions WHERE token_hash = $1::bytea AND expires > NOW()", hashToken(token),
+		).Scan(&userID)
 		if err != nil {
 			log.Println("User id by token failed", err)
 		}
 	}
 	return userID
 }
-
-const saltLength = 5
-const saltCharset = "abcdefghijklmnopqrstuvwxyz" +
-	"ABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789"
-
-var seededRand *rand.Rand = rand.New(
-	rand.NewSource(time.Now().UnixNano()))
-
-func stringWithCharset(length int, charset string) string {
-	b := make([]byte, length)
-	for i := range b {
-		b[i] = charset[seededRand.Intn(len(charset))]
-	}
-	return string(b)
-}